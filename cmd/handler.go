@@ -0,0 +1,310 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kunalvirwal/minato/internal/auth"
+	"github.com/kunalvirwal/minato/internal/balancer"
+	"github.com/kunalvirwal/minato/internal/cache"
+	"github.com/kunalvirwal/minato/internal/cors"
+	"github.com/kunalvirwal/minato/internal/ipfilter"
+	"github.com/kunalvirwal/minato/internal/normalize"
+	"github.com/kunalvirwal/minato/internal/proxy"
+	"github.com/kunalvirwal/minato/internal/ratelimit"
+	"github.com/kunalvirwal/minato/internal/redirect"
+	"github.com/kunalvirwal/minato/internal/requestid"
+	"github.com/kunalvirwal/minato/internal/router"
+	"github.com/kunalvirwal/minato/internal/state"
+	"github.com/kunalvirwal/minato/internal/utils"
+	"github.com/kunalvirwal/minato/internal/waf"
+)
+
+// Requests which match no route, logged once a minute
+var unmatchedHosts = utils.NewCountedLog(time.Minute, "Requests matching no route")
+
+// reqHandler returns the request handler for the listener running on port
+func reqHandler(port uint64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		// Loads the latest config
+		cfg := state.RuntimeCfg.Config.Load()
+
+		// Every request gets an ID which is forwarded upstream, echoed back and used in its log lines
+		r = cfg.RequestID.Assign(r)
+		requestid.SetResponseHeader(w.Header(), r)
+
+		// Routing, caching and the upstream see the same normalized path
+		if err := normalize.Request(r, cfg.Normalization); err != nil {
+			utils.LogRequestError(r, "Rejected request: "+err.Error())
+			cfg.ErrorPages.Write(w, r, http.StatusBadRequest, "Bad Request", "")
+			return
+		}
+
+		// IP filters see the real client behind trusted proxies
+		r = ipfilter.ResolveClientIP(r, cfg.TrustedProxies)
+		clientIP := ipfilter.ClientIP(r)
+		if !cfg.ListenerFilters[port].Allowed(clientIP) {
+			utils.LogRequestError(r, fmt.Sprintf("Request from %v denied by the ip filter of listener %v", clientIP, port))
+			cfg.ErrorPages.Write(w, r, http.StatusForbidden, "Forbidden", "")
+			return
+		}
+
+		// A connection verified for one host can't be used to reach a host verifying client certificates differently
+		if l := cfg.TLS[port]; l != nil && r.TLS != nil && !l.SameClientAuth(r.TLS.ServerName, r.Host) {
+			utils.LogRequestError(r, fmt.Sprintf("Request for host %v on a connection set up for %v", r.Host, r.TLS.ServerName))
+			cfg.ErrorPages.Write(w, r, http.StatusMisdirectedRequest, "Misdirected Request", "")
+			return
+		}
+
+		route, captures := findRoute(cfg, r, port)
+		if route == nil {
+			// Scanners send lots of these, so they are logged together instead of one line each
+			unmatchedHosts.Add(fmt.Sprintf("%.100s on port %d", r.Host, port))
+			defaults := cfg.Defaults[port]
+			route = defaults.Route(r)
+			if route == nil {
+				if !defaults.Write(w) {
+					cfg.ErrorPages.Write(w, r, http.StatusNotFound, "Service not found", "")
+				}
+				return
+			}
+		}
+		// Header rules can use what a wildcard or regex host captured
+		r = proxy.WithHostCaptures(r, captures)
+
+		for _, filter := range route.IPFilters {
+			if !filter.Allowed(clientIP) {
+				utils.LogRequestError(r, fmt.Sprintf("Request from %v denied by the ip filter of service %v", clientIP, route.Service))
+				route.Options.WriteError(w, r, http.StatusForbidden, "Forbidden")
+				return
+			}
+		}
+
+		if cfg.WAF != nil && route.WAFMode != waf.ModeOff {
+			// The WAF doesn't read bodies which the route would reject for their size anyway
+			if !route.Options.CheckBodyLength(w, r) {
+				return
+			}
+			if rule := cfg.WAF.Evaluate(r, route.WAFMode == waf.ModeDetect); rule != nil {
+				route.Options.WriteError(w, r, rule.Status, http.StatusText(rule.Status))
+				return
+			}
+		}
+
+		// Limits keyed by a claim wait for the token to be verified
+		if route.RateLimit != nil && !route.RateLimit.KeyedByClaim() && !takeRateLimit(w, r, route) {
+			return
+		}
+
+		// Preflights carry no credentials, so they are answered before any authentication
+		if policy := route.Options.CORS; policy != nil && cors.IsPreflight(r) {
+			if !policy.Preflight(w.Header(), r) {
+				utils.LogRequestError(r, fmt.Sprintf("CORS preflight from origin %v rejected by service %v", r.Header.Get("Origin"), route.Service))
+				route.Options.WriteError(w, r, http.StatusForbidden, "Forbidden")
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if route.ForceHTTPS && !redirect.IsSecure(r) {
+			redirect.ToHTTPS(w, r, route.HTTPSPort)
+			return
+		}
+
+		if route.ClientCert != nil {
+			if err := route.ClientCert.Authorize(r); err != nil {
+				utils.LogRequestError(r, fmt.Sprintf("Client certificate rejected by service %v: %v", route.Service, err))
+				route.Options.WriteError(w, r, http.StatusForbidden, "Forbidden")
+				return
+			}
+			route.ClientCert.Forward(r)
+		}
+
+		if route.Auth != nil {
+			id, err := route.Auth.Authenticate(r)
+			if err != nil {
+				utils.LogRequestError(r, fmt.Sprintf("Authentication failed for service %v: %v", route.Service, err))
+				if errors.Is(err, auth.ErrForbidden) {
+					route.Options.WriteError(w, r, http.StatusForbidden, "Forbidden")
+				} else {
+					route.Auth.Challenge(w.Header())
+					route.Options.WriteError(w, r, http.StatusUnauthorized, "Unauthorized")
+				}
+				return
+			}
+			route.Auth.Forward(r, id)
+			r = ratelimit.WithClaims(r, id.Claims)
+		}
+
+		if route.RateLimit.KeyedByClaim() && !takeRateLimit(w, r, route) {
+			return
+		}
+
+		if route.OIDC != nil {
+			session, ok := route.OIDC.Authenticate(w, proxy.WithOptions(r, route.Options))
+			if !ok {
+				return
+			}
+			route.OIDC.Forward(r, session)
+		}
+
+		if route.ForwardAuth != nil {
+			decision, err := route.ForwardAuth.Check(r)
+			if err != nil {
+				utils.LogRequestError(r, fmt.Sprintf("Forward auth failed for service %v: %v", route.Service, err))
+				route.Options.WriteError(w, r, http.StatusBadGateway, "Bad Gateway")
+				return
+			}
+			if !decision.Allowed {
+				utils.LogRequestError(r, fmt.Sprintf("Request denied by forward auth of service %v with status %v", route.Service, decision.Status))
+				decision.Write(w, r, route.Options)
+				return
+			}
+			route.ForwardAuth.Apply(r, decision)
+		}
+
+		if route.Redirects != nil && route.Redirects.Serve(w, r) {
+			return
+		}
+
+		if route.Static != nil {
+			route.Options.CORS.Prepare(w.Header())
+			route.Options.CORS.Decorate(w.Header(), r)
+			route.Options.Security.Apply(w.Header(), r)
+			route.Static.ServeHTTP(w, proxy.WithOptions(r, route.Options))
+			return
+		}
+
+		// Redirect services don't have anything to proxy to, nor do keyed upstreams for other keys
+		lb := route.LoadBalancer(captures)
+		if lb == nil {
+			route.Options.WriteError(w, r, http.StatusNotFound, "Service not found")
+			return
+		}
+
+		serveProxy(w, r, port, cfg, route, lb)
+	}
+}
+
+// takeRateLimit takes a token of the route's rate limit, returns false if the request was limited and answered
+func takeRateLimit(w http.ResponseWriter, r *http.Request, route *state.Route) bool {
+	res := route.RateLimit.Take(r)
+	res.SetHeaders(w.Header())
+	if !res.Allowed {
+		utils.LogRequestError(r, fmt.Sprintf("Request rate limited for service %v", route.Service))
+		route.Options.WriteError(w, r, http.StatusTooManyRequests, "Too Many Requests")
+	}
+	return res.Allowed
+}
+
+// findRoute finds the route for the request's domain and port with the longest matching path prefix
+// whose matchers accept the request, along with what a wildcard or regex host captured
+func findRoute(cfg *state.ConfigHolder, r *http.Request, port uint64) (*state.Route, router.Captures) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	route, captures, _ := cfg.Routes.Lookup(port, host, r.URL.Path, r)
+	return route, captures
+}
+
+// serveProxy serves the request from the cache if possible, else proxies it upstream and caches the response
+func serveProxy(w http.ResponseWriter, r *http.Request, port uint64, cfg *state.ConfigHolder, route *state.Route, lb balancer.LoadBalancer) {
+	var runtimeCache cache.Cache
+	key := ""
+	// Authenticated responses can differ per user, so they skip the shared cache unless allowed
+	cacheable := (route.Auth == nil || route.Auth.AllowCache) &&
+		(route.ForwardAuth == nil || route.ForwardAuth.AllowCache) &&
+		(route.OIDC == nil || route.OIDC.AllowCache) &&
+		(route.ClientCert == nil || route.ClientCert.AllowCache)
+	if cacheable && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		runtimeCache = cfg.Cache
+		if runtimeCache != nil {
+			key = cache.BuildCacheKey(r, int(port))
+			if route.MatchKey != "" {
+				key += "|" + route.MatchKey
+			}
+			// Each encoding of a compressed response is cached as its own variant
+			if zc := route.Options.Compression; zc != nil {
+				key += "|" + zc.Negotiate(r.Header.Get("Accept-Encoding"))
+			}
+			if resp, found := runtimeCache.Get(key); found {
+				utils.LogRequestCustom(r, utils.Cyan, "Cache", (fmt.Sprintf("Cache hit for %v", key)))
+				writeCachedResponse(w, r, resp, route.Options)
+				return
+			}
+		}
+	}
+
+	// Enforce the body size limit and buffer the body before an upstream is picked
+	release, ok := route.Options.PrepareBody(w, r)
+	defer release()
+	if !ok {
+		return
+	}
+
+	resp := lb.ServeProxy(w, proxy.WithOptions(r, route.Options))
+
+	// Store in cache if applicable
+	if runtimeCache != nil && resp != nil && key != "" && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		hdr := resp.Header
+		noCache := false
+		ttl := runtimeCache.GetTTL()
+		utils.LogRequestCustom(r, utils.Cyan, "Cache", fmt.Sprintf("Storing cache with key %v", key))
+		if cc := hdr.Get("Cache-Control"); cc != "" {
+
+			parts := strings.Split(cc, ",")
+			for i := range parts {
+				p := strings.TrimSpace(parts[i])
+				if p == "no-store" || p == "no-cache" || p == "private" {
+					noCache = true
+				}
+
+				if n, found := strings.CutPrefix(p, "max-age="); found {
+					n, err := strconv.Atoi(n)
+					if err == nil {
+						if n == 0 {
+							noCache = true
+						} else {
+							ttl = int64(n)
+						}
+					}
+				}
+			}
+
+		}
+
+		if !noCache {
+			expiresAt := time.Now().Unix() + ttl
+			runtimeCache.Set(key, *resp, expiresAt)
+			utils.LogRequestInfo(r, fmt.Sprintf("Response cached for key %v", key))
+		}
+	}
+}
+
+func writeCachedResponse(w http.ResponseWriter, r *http.Request, resp cache.Response, opts *proxy.Options) {
+	for k, vv := range resp.Header {
+		for _, v := range vv {
+			w.Header().Add(k, v)
+		}
+	}
+	// The cached headers can hold the ID of the request which filled the cache
+	requestid.SetResponseHeader(w.Header(), r)
+	// CORS headers are kept out of the cache and added for the origin of this request
+	opts.CORS.Decorate(w.Header(), r)
+	opts.Security.Apply(w.Header(), r)
+	w.WriteHeader(resp.StatusCode)
+	if len(resp.Body) > 0 {
+		_, err := w.Write(resp.Body)
+		if err != nil {
+			utils.LogRequestError(r, "Error writing cached response body: "+err.Error())
+		}
+	}
+}
@@ -2,19 +2,26 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"maps"
 	"net"
 	"net/http"
+	"os"
+	"reflect"
 	"slices"
 	"strconv"
-	"strings"
 	"time"
 
-	"github.com/kunalvirwal/minato/internal/balancer"
-	"github.com/kunalvirwal/minato/internal/cache"
+	"github.com/kunalvirwal/minato/internal/backend"
 	"github.com/kunalvirwal/minato/internal/config"
 	"github.com/kunalvirwal/minato/internal/healthcheck"
+	"github.com/kunalvirwal/minato/internal/normalize"
+	"github.com/kunalvirwal/minato/internal/proxy"
+	"github.com/kunalvirwal/minato/internal/ratelimit"
 	"github.com/kunalvirwal/minato/internal/state"
+	"github.com/kunalvirwal/minato/internal/stream"
 	"github.com/kunalvirwal/minato/internal/utils"
 )
 
@@ -28,160 +35,254 @@ func buildRuntimeConfig() []uint64 {
 	return state.GenerateRuntimeResources(config.RawConfig)
 }
 
-// initListener removes old Listeners which are not in latest config and starts new Listeners
+// initListener removes old Listeners which are not in latest config, restarts Listeners whose settings changed and starts new Listeners
 func initListeners(newPorts []uint64) {
 
 	state.RuntimeCfg.Lm.Mu.Lock()
 	defer state.RuntimeCfg.Lm.Mu.Unlock()
 
+	listenerCfg := state.RuntimeCfg.Config.Load().Listeners
+
 	// stop old Listeners
 	for port, listener := range state.RuntimeCfg.Lm.Listeners {
 		if !slices.Contains(newPorts, port) {
+			releaseSocket(state.RuntimeCfg.Lm.Settings[port], listenerCfg)
 			delete(state.RuntimeCfg.Lm.Listeners, port)
+			delete(state.RuntimeCfg.Lm.Settings, port)
 			if listener != nil {
-				go func() {
-					ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-					defer cancel()
-					listener.Shutdown(ctx)
-				}()
+				go shutdownServer(listener)
 			}
 		}
 	}
 
-	// Request handler Logic
-	reqHandler := func(port uint64) func(w http.ResponseWriter, r *http.Request) {
-		return func(w http.ResponseWriter, r *http.Request) {
+	// start new listeners
+	for _, port := range newPorts {
+		settings := listenerCfg[port]
+		old, exists := state.RuntimeCfg.Lm.Listeners[port]
+		// listener already exists on this port with the same settings, do nothing
+		if exists && sameServerSettings(state.RuntimeCfg.Lm.Settings[port], settings) {
+			state.RuntimeCfg.Lm.Settings[port] = settings
+			continue
+		}
 
-			host := r.Host
-			reqPath := r.URL.Path
+		srv := &http.Server{
+			Addr:              fmt.Sprintf(":%d", port),
+			Handler:           reqHandler(port),
+			ReadHeaderTimeout: settings.ReadHeaderTimeout,
+			ReadTimeout:       settings.ReadTimeout,
+			WriteTimeout:      settings.WriteTimeout,
+			IdleTimeout:       settings.IdleTimeout,
+			MaxHeaderBytes:    settings.MaxHeaderBytes,
+		}
+		if settings.TLS.Enabled() {
+			srv.TLSConfig = &tls.Config{GetConfigForClient: tlsLookup(port)}
+		}
+		oldSettings := state.RuntimeCfg.Lm.Settings[port]
+		state.RuntimeCfg.Lm.Listeners[port] = srv
+		state.RuntimeCfg.Lm.Settings[port] = settings
 
-			if h, _, err := net.SplitHostPort(host); err == nil {
-				host = h
-			}
+		// Server settings can't be changed while it is running, so it is replaced
+		if exists {
+			utils.LogInfo(fmt.Sprintf("Listener settings changed, restarting listener on port %v", port))
+			releaseSocket(oldSettings, listenerCfg)
+			go shutdownServer(old)
+		}
+		go serve(srv, port)
+		if settings.Socket != "" {
+			go serveUnix(srv, settings)
+		}
+	}
+}
 
-			// Loads the latest config
-			cfg := state.RuntimeCfg.Config.Load()
+// sameServerSettings reports if two listener settings create the same server.
+// IP filters and defaults are checked per request and certificates per handshake, so changing them doesn't need a restart.
+func sameServerSettings(a config.Listener, b config.Listener) bool {
+	if a.TLS.Enabled() != b.TLS.Enabled() {
+		return false
+	}
+	a.IPFilter, b.IPFilter = config.IPFilter{}, config.IPFilter{}
+	a.Default, b.Default = config.ListenerDefault{}, config.ListenerDefault{}
+	a.TLS, b.TLS = config.TLS{}, config.TLS{}
+	return reflect.DeepEqual(a, b)
+}
 
-			// Find the load balancer for this domain  and port with the longest matching path prefix
-			var LB balancer.LoadBalancer
-			longestPrefix := -1
-			for key, lb := range cfg.Router {
-				if key.Domain != host || key.Port != port {
-					continue
-				}
-				// If this routekey has a path prefix matching the request path
-				if strings.HasPrefix(reqPath, key.PathPrefix) {
-					if len(key.PathPrefix) > longestPrefix {
-						LB = lb
-						longestPrefix = len(key.PathPrefix)
-					}
-				}
-			}
+// tlsLookup returns the function a https listener uses to find the TLS config of a handshake in the latest config
+func tlsLookup(port uint64) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		l := state.RuntimeCfg.Config.Load().TLS[port]
+		if l == nil {
+			return nil, fmt.Errorf("no TLS certificate loaded for port %d", port)
+		}
+		return l.ConfigForClient(hello)
+	}
+}
 
-			if LB == nil {
-				utils.LogNewError("A request with unrecognised domain or path recieved, please update config.yml file or DNS ")
-				http.Error(w, "Service not found", http.StatusNotFound)
-				return
-			}
+// serveUnix runs srv on the unix socket of its listener too, replacing a socket file left behind
+func serveUnix(srv *http.Server, settings config.Listener) {
+	if info, err := os.Lstat(settings.Socket); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(settings.Socket)
+	}
+	ln, err := net.Listen("unix", settings.Socket)
+	if err != nil {
+		utils.LogNewError(fmt.Sprintf("Error in server running on socket %s : %v", settings.Socket, err))
+		return
+	}
+	// A restarted listener binds the same path before the old one is closed, so the old one must not remove it
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
 
-			var runtimeCache cache.Cache
-			key := ""
-			if r.Method == http.MethodGet || r.Method == http.MethodHead {
-				runtimeCache = state.RuntimeCfg.Config.Load().Cache
-				if runtimeCache != nil {
-					key = cache.BuildCacheKey(r, int(port))
-					if resp, found := runtimeCache.Get(key); found {
-						utils.LogCustom(utils.Cyan, "Cache", (fmt.Sprintf("Cache hit for %v", key)))
-						writeCachedResponse(w, resp)
-						return
-					}
-				}
-			}
-			resp := LB.ServeProxy(w, r)
-
-			// Store in cache if applicable
-			if runtimeCache != nil && resp != nil && key != "" && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
-				hdr := resp.Header
-				noCache := false
-				ttl := runtimeCache.GetTTL()
-				utils.LogCustom(utils.Cyan, "Cache", fmt.Sprintf("Storing cache with key %v", key))
-				if cc := hdr.Get("Cache-Control"); cc != "" {
-
-					parts := strings.Split(cc, ",")
-					for i := range parts {
-						p := strings.TrimSpace(parts[i])
-						if p == "no-store" || p == "no-cache" || p == "private" {
-							noCache = true
-						}
-
-						if n, found := strings.CutPrefix(p, "max-age="); found {
-							n, err := strconv.Atoi(n)
-							if err == nil {
-								if n == 0 {
-									noCache = true
-								} else {
-									ttl = int64(n)
-								}
-							}
-						}
-					}
+	// The mode is checked by validateListeners while loading the config
+	mode, _ := strconv.ParseUint(settings.SocketMode, 8, 32)
+	if err := os.Chmod(settings.Socket, os.FileMode(mode)); err != nil {
+		utils.LogNewError(fmt.Sprintf("Unable to set permissions of socket %s : %v", settings.Socket, err))
+	}
 
-				}
+	utils.LogInfo(fmt.Sprintf("Listening on socket %v", settings.Socket))
+	if err := serveListener(srv, ln); err != nil && err != http.ErrServerClosed {
+		utils.LogNewError(fmt.Sprintf("Error in server running on socket %s : %v", settings.Socket, err))
+	}
+}
 
-				if !noCache {
-					expiresAt := time.Now().Unix() + ttl
-					runtimeCache.Set(key, *resp, expiresAt)
-					utils.LogInfo(fmt.Sprintf("Response cached for key %v", key))
-				}
-			}
+// releaseSocket removes the socket file of a listener being stopped unless a listener of the latest config uses it
+func releaseSocket(old config.Listener, listeners map[uint64]config.Listener) {
+	if old.Socket == "" {
+		return
+	}
+	for _, ln := range listeners {
+		if ln.Socket == old.Socket {
+			return
 		}
 	}
+	os.Remove(old.Socket)
+}
 
-	// start new listeners
-	for _, port := range newPorts {
-		_, exists := state.RuntimeCfg.Lm.Listeners[port]
-		// if listener does not exist on this port, create one
-		if !exists {
-			srv := &http.Server{
-				Addr:    fmt.Sprintf(":%d", port),
-				Handler: http.HandlerFunc(reqHandler(port)),
-			}
-			state.RuntimeCfg.Lm.Listeners[port] = srv
+// serve runs srv, retrying to bind for a while in case the port is still held by a server being shut down
+func serve(srv *http.Server, port uint64) {
+	var ln net.Listener
+	var err error
+	for range 20 {
+		if ln, err = net.Listen("tcp", srv.Addr); err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		utils.LogNewError(fmt.Sprintf("Error in server running on port %d : %v", port, err))
+		return
+	}
 
-			go func(srv *http.Server, port uint64) {
-				utils.LogInfo(fmt.Sprintf("Listening on port %v", port))
-				if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-					utils.LogNewError(fmt.Sprintf("Error in server running on port %d : %v", port, err))
-				}
-			}(srv, port)
+	utils.LogInfo(fmt.Sprintf("Listening on port %v", port))
+	if err := serveListener(srv, ln); err != nil && err != http.ErrServerClosed {
+		utils.LogNewError(fmt.Sprintf("Error in server running on port %d : %v", port, err))
+	}
+}
+
+// serveListener runs srv on ln, over TLS if the server has a TLS config.
+// The normalization level doesn't apply under TLS: the server decrypts the connection itself and needs the *tls.Conn
+// for r.TLS and HTTP/2, so the raw bytes can't be checked and those listeners rely on the checks of the HTTP server.
+func serveListener(srv *http.Server, ln net.Listener) error {
+	if srv.TLSConfig != nil {
+		return srv.ServeTLS(ln, "", "")
+	}
+	return srv.Serve(normalizedListener(ln))
+}
+
+// normalizedListener checks the raw requests of every connection at the normalization level of the latest config
+func normalizedListener(ln net.Listener) net.Listener {
+	return &normalize.Listener{
+		Listener: ln,
+		Level:    func() string { return state.RuntimeCfg.Config.Load().Normalization },
+	}
+}
+
+// initStreams stops the stream servers which are not in the latest config and starts the new ones.
+// Servers look up their route on every connection, so unchanged servers pick up the new upstreams by themselves.
+func initStreams() {
+	state.RuntimeCfg.Sm.Mu.Lock()
+	defer state.RuntimeCfg.Sm.Mu.Unlock()
+
+	streams := state.RuntimeCfg.Config.Load().Streams
+
+	// stop old stream servers
+	for key, srv := range state.RuntimeCfg.Sm.Servers {
+		if _, ok := streams[key]; !ok {
+			delete(state.RuntimeCfg.Sm.Servers, key)
+			srv.Close()
+			utils.LogInfo(fmt.Sprintf("Stopped %s stream listener on port %v", key.Protocol, key.Port))
+		}
+	}
+
+	// start new stream servers
+	for key := range streams {
+		if _, exists := state.RuntimeCfg.Sm.Servers[key]; exists {
+			continue
 		}
-		// else listener already exists on this port, do nothing
+		srv := stream.NewServer(key.Protocol, key.Port, streamLookup(key))
+		state.RuntimeCfg.Sm.Servers[key] = srv
+		go serveStream(srv)
+	}
+}
+
+// streamLookup returns the function a stream server uses to find its route in the latest config
+func streamLookup(key state.StreamKey) func() *stream.Route {
+	return func() *stream.Route {
+		return state.RuntimeCfg.Config.Load().Streams[key]
 	}
 }
 
-func writeCachedResponse(w http.ResponseWriter, resp cache.Response) {
-	for k, vv := range resp.Header {
-		for _, v := range vv {
-			w.Header().Add(k, v)
+// serveStream runs a stream server, retrying to bind for a while in case the port is still held by a server being shut down
+func serveStream(srv *stream.Server) {
+	var err error
+	for range 20 {
+		if err = srv.Listen(); err == nil || errors.Is(err, net.ErrClosed) {
+			break
 		}
+		time.Sleep(100 * time.Millisecond)
 	}
-	w.WriteHeader(resp.StatusCode)
-	if len(resp.Body) > 0 {
-		_, err := w.Write(resp.Body)
-		if err != nil {
-			utils.LogNewError("Error writing cached response body: " + err.Error())
+	if err != nil {
+		if !errors.Is(err, net.ErrClosed) {
+			utils.LogNewError(fmt.Sprintf("Error in %s stream server running on port %d : %v", srv.Protocol, srv.Port, err))
 		}
+		return
+	}
+
+	utils.LogInfo(fmt.Sprintf("Listening for %s streams on port %v", srv.Protocol, srv.Port))
+	if err := srv.Serve(); err != nil {
+		utils.LogNewError(fmt.Sprintf("Error in %s stream server running on port %d : %v", srv.Protocol, srv.Port, err))
 	}
 }
 
+// shutdownServer gracefully shuts down a server, giving active connections 5 seconds to finish
+func shutdownServer(srv *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv.Shutdown(ctx)
+}
+
 func cleanUnusedBackends() {
 	active := make(map[state.BackendKey]bool)
 
-	for _, lb := range state.RuntimeCfg.Config.Load().Router {
-		for _, backend := range lb.GetBackends() {
+	cfg := state.RuntimeCfg.Config.Load()
+	for _, route := range cfg.Router {
+		lbs := slices.Collect(maps.Values(route.KeyedLBs))
+		if route.LB != nil {
+			lbs = append(lbs, route.LB)
+		}
+		for _, lb := range lbs {
+			for _, backend := range lb.GetBackends() {
+				key := state.BackendKey{
+					Address:    backend.Address(),
+					Health_uri: backend.Config.Health_uri,
+				}
+				active[key] = true
+			}
+		}
+	}
+	for streamKey, route := range cfg.Streams {
+		for _, backend := range route.LB.GetBackends() {
 			key := state.BackendKey{
 				Address:    backend.Address(),
 				Health_uri: backend.Config.Health_uri,
+				Protocol:   streamKey.Protocol,
 			}
 			active[key] = true
 		}
@@ -198,6 +299,73 @@ func cleanUnusedBackends() {
 	}
 }
 
+// cleanUnusedTransports drops the upstream transports of timeouts which no route of the latest config uses
+func cleanUnusedTransports() {
+	inUse := make(map[*backend.Backend][]*proxy.Timeouts)
+	cfg := state.RuntimeCfg.Config.Load()
+	for _, route := range cfg.Router {
+		lbs := slices.Collect(maps.Values(route.KeyedLBs))
+		if route.LB != nil {
+			lbs = append(lbs, route.LB)
+		}
+		for _, lb := range lbs {
+			for _, b := range lb.GetBackends() {
+				inUse[b] = append(inUse[b], route.Options.Timeouts)
+			}
+		}
+	}
+
+	state.RuntimeCfg.Mu.RLock()
+	defer state.RuntimeCfg.Mu.RUnlock()
+
+	for _, b := range state.RuntimeCfg.BackendRegistry {
+		// Stream backends have no transports
+		if b.Config.Proxy != nil {
+			b.Config.Proxy.KeepTransports(inUse[b])
+		}
+	}
+}
+
+// cleanUnusedRateLimiters drops the limiters which no route of the latest config uses
+func cleanUnusedRateLimiters() {
+	active := make(map[*ratelimit.Limiter]bool)
+	cfg := state.RuntimeCfg.Config.Load()
+	for _, route := range cfg.Router {
+		if route.RateLimit != nil {
+			active[route.RateLimit] = true
+		}
+	}
+	if cfg.WAF != nil {
+		for _, rule := range cfg.WAF.Rules {
+			if rule.Limiter != nil {
+				active[rule.Limiter] = true
+			}
+		}
+	}
+
+	state.RuntimeCfg.Mu.Lock()
+	defer state.RuntimeCfg.Mu.Unlock()
+
+	for key, limiter := range state.RuntimeCfg.RateLimiters {
+		if !active[limiter] {
+			delete(state.RuntimeCfg.RateLimiters, key)
+		}
+	}
+}
+
+// startRateLimitJanitor periodically frees the buckets of clients which have been idle long enough to be full again
+func startRateLimitJanitor() {
+	go func() {
+		for range time.Tick(ratelimit.SweepInterval) {
+			state.RuntimeCfg.Mu.RLock()
+			for _, limiter := range state.RuntimeCfg.RateLimiters {
+				limiter.Sweep()
+			}
+			state.RuntimeCfg.Mu.RUnlock()
+		}
+	}()
+}
+
 func startHealthchecks() {
 	go healthcheck.StartHealthchecks()
 }
@@ -30,8 +30,12 @@ func updateMinato(coldstart bool) {
 	Ports := buildRuntimeConfig()
 	if coldstart {
 		startHealthchecks()
+		startRateLimitJanitor()
 	} else {
 		cleanUnusedBackends()
+		cleanUnusedTransports()
+		cleanUnusedRateLimiters()
 	}
 	initListeners(Ports)
+	initStreams()
 }
@@ -2,4 +2,9 @@ module github.com/kunalvirwal/minato
 
 go 1.23.4
 
-require gopkg.in/yaml.v3 v3.0.1 // indirect
+require (
+	github.com/andybalholm/brotli v1.1.1
+	github.com/klauspost/compress v1.18.0
+	golang.org/x/crypto v0.31.0
+	gopkg.in/yaml.v3 v3.0.1
+)
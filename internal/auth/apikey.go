@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// DefaultAPIKeyHeader carries the API key when no header is configured
+const DefaultAPIKeyHeader = "X-API-Key"
+
+// APIKeys authenticates static API keys sent in a header
+type APIKeys struct {
+	Header string
+
+	// Key names by the SHA-256 of the key, so lookups don't compare the keys themselves
+	keys map[[32]byte]string
+}
+
+// LoadAPIKeys reads a key file with one key per line, optionally named like name:key.
+// Blank lines and lines starting with # are ignored.
+func LoadAPIKeys(file string, header string) (*APIKeys, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	k := &APIKeys{Header: header, keys: make(map[[32]byte]string)}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, key, found := strings.Cut(line, ":")
+		if !found {
+			name, key = fmt.Sprintf("key-%d", n), line
+		}
+		if key == "" {
+			return nil, fmt.Errorf("%s:%d: empty key", file, n)
+		}
+		k.keys[sha256.Sum256([]byte(key))] = name
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Present reports if the request carries an API key
+func (k *APIKeys) Present(r *http.Request) bool {
+	return r.Header.Get(k.Header) != ""
+}
+
+// Authenticate checks the API key of a request
+func (k *APIKeys) Authenticate(r *http.Request) (*Identity, error) {
+	name, ok := k.keys[sha256.Sum256([]byte(r.Header.Get(k.Header)))]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown api key", ErrUnauthorized)
+	}
+	return &Identity{Method: "api_key", User: name}, nil
+}
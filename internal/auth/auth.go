@@ -0,0 +1,117 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+var (
+	// ErrUnauthorized is returned for requests without valid credentials
+	ErrUnauthorized = errors.New("unauthorized")
+
+	// ErrForbidden is returned for valid credentials which are not allowed on the route
+	ErrForbidden = errors.New("forbidden")
+)
+
+// Identity is the authenticated client of a request
+type Identity struct {
+	// Method which authenticated the request: basic, api_key or jwt
+	Method string
+
+	// Basic auth user, API key name or JWT subject
+	User string
+
+	// Headers to set on the upstream request
+	Headers http.Header
+
+	// Verified claims of a JWT, nil for the other methods
+	Claims map[string]any
+}
+
+// Policy authenticates the requests of a route. A request is let through if any of the configured methods accepts it.
+type Policy struct {
+	Basic   *Basic
+	APIKeys *APIKeys
+	JWT     *JWT
+
+	// Header carrying the authenticated user upstream, empty to not forward it
+	UserHeader string
+
+	// Responses of authenticated routes are only cached when this is set
+	AllowCache bool
+}
+
+// Authenticate checks the credentials of a request.
+// The error wraps ErrUnauthorized or ErrForbidden and describes why the request was rejected.
+func (p *Policy) Authenticate(r *http.Request) (*Identity, error) {
+	var id *Identity
+	var err error
+	switch {
+	case p.JWT != nil && hasBearer(r):
+		id, err = p.JWT.Authenticate(r)
+	case p.Basic != nil && hasBasic(r):
+		id, err = p.Basic.Authenticate(r)
+	case p.APIKeys != nil && p.APIKeys.Present(r):
+		id, err = p.APIKeys.Authenticate(r)
+	default:
+		return nil, fmt.Errorf("%w: no credentials", ErrUnauthorized)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if p.UserHeader != "" {
+		if id.Headers == nil {
+			id.Headers = make(http.Header)
+		}
+		id.Headers.Set(p.UserHeader, id.User)
+	}
+	return id, nil
+}
+
+// Forward removes the headers forwarded by the policy from the client's request and sets the identity's ones.
+// Clients can't send these headers themselves, even on routes where the header is not set.
+func (p *Policy) Forward(r *http.Request, id *Identity) {
+	for _, h := range p.ForwardedHeaders() {
+		r.Header.Del(h)
+	}
+	for k, vv := range id.Headers {
+		r.Header[k] = vv
+	}
+}
+
+// ForwardedHeaders lists the headers the policy sets upstream
+func (p *Policy) ForwardedHeaders() []string {
+	var headers []string
+	if p.UserHeader != "" {
+		headers = append(headers, p.UserHeader)
+	}
+	if p.JWT != nil {
+		for _, h := range p.JWT.ForwardClaims {
+			headers = append(headers, h)
+		}
+	}
+	return headers
+}
+
+// Challenge sets the WWW-Authenticate headers of a 401 response
+func (p *Policy) Challenge(h http.Header) {
+	if p.Basic != nil {
+		h.Add("WWW-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", p.Basic.Realm))
+	}
+	if p.JWT != nil {
+		h.Add("WWW-Authenticate", "Bearer")
+	}
+}
+
+func hasBearer(r *http.Request) bool {
+	scheme, _, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	return strings.EqualFold(scheme, "Bearer")
+}
+
+func hasBasic(r *http.Request) bool {
+	scheme, _, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	return strings.EqualFold(scheme, "Basic")
+}
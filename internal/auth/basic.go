@@ -0,0 +1,69 @@
+package auth
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// DefaultRealm is sent in the Basic challenge when no realm is configured
+const DefaultRealm = "Restricted"
+
+// Compared against for unknown users, so they take as long to reject as wrong passwords
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("minato"), bcrypt.DefaultCost)
+
+// Basic authenticates HTTP Basic credentials against bcrypt hashes from an htpasswd file
+type Basic struct {
+	Realm string
+	users map[string][]byte
+}
+
+// LoadHtpasswd reads an htpasswd file with one user:hash per line, only bcrypt hashes are supported
+func LoadHtpasswd(file string, realm string) (*Basic, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	b := &Basic{Realm: realm, users: make(map[string][]byte)}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, found := strings.Cut(line, ":")
+		if !found || user == "" {
+			return nil, fmt.Errorf("%s:%d: expected user:hash", file, n)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("%s:%d: user '%s' does not have a bcrypt hash", file, n, user)
+		}
+		b.users[user] = []byte(hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Authenticate checks the Basic credentials of a request
+func (b *Basic) Authenticate(r *http.Request) (*Identity, error) {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, fmt.Errorf("%w: malformed basic credentials", ErrUnauthorized)
+	}
+	hash, exists := b.users[user]
+	if !exists {
+		hash = dummyHash
+	}
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil || !exists {
+		return nil, fmt.Errorf("%w: invalid password for user '%s'", ErrUnauthorized, user)
+	}
+	return &Identity{Method: "basic", User: user}, nil
+}
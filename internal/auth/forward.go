@@ -0,0 +1,219 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/kunalvirwal/minato/internal/ipfilter"
+	"github.com/kunalvirwal/minato/internal/proxy"
+	"github.com/kunalvirwal/minato/internal/requestid"
+)
+
+// DefaultForwardTimeout limits the subrequest when no timeout is configured
+const DefaultForwardTimeout = 5 * time.Second
+
+// Request headers sent to the authorization service when none are configured
+var DefaultForwardRequestHeaders = []string{"Authorization", "Cookie"}
+
+// Largest response body of a denial passed back to the client
+const maxDenialBody = 64 << 10
+
+// Decisions cached beyond this many trigger a sweep of the expired ones
+const maxCachedDecisions = 10000
+
+// ForwardAuth asks an external authorization service whether a request may pass
+type ForwardAuth struct {
+	URL string
+
+	// Request headers copied to the subrequest
+	RequestHeaders []string
+
+	// Headers of an allowing response copied onto the upstream request
+	ResponseHeaders []string
+
+	Timeout time.Duration
+
+	// Decisions are cached for this long, zero disables caching
+	CacheTTL time.Duration
+
+	// Responses of the route are only cached when this is set
+	AllowCache bool
+
+	client *http.Client
+
+	mu    sync.Mutex
+	cache map[[32]byte]*Decision
+}
+
+// Decision is the answer of the authorization service
+type Decision struct {
+	Allowed bool
+
+	// Response of the authorization service, only the body of denials is kept
+	Status int
+	Header http.Header
+	Body   []byte
+
+	expires time.Time
+}
+
+// NewForwardAuth creates a forward auth middleware with its own client.
+// Redirects of the authorization service, like to a login page, are passed to the client instead of followed.
+func NewForwardAuth(f *ForwardAuth) *ForwardAuth {
+	f.client = &http.Client{
+		Timeout: f.Timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	f.cache = make(map[[32]byte]*Decision)
+	return f
+}
+
+// Check sends the subrequest for r, or returns the cached decision for its credentials
+func (f *ForwardAuth) Check(r *http.Request) (*Decision, error) {
+	key := f.cacheKey(r)
+	if f.CacheTTL > 0 {
+		if d := f.cached(key); d != nil {
+			return d, nil
+		}
+	}
+
+	sub, err := http.NewRequestWithContext(r.Context(), http.MethodGet, f.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range f.RequestHeaders {
+		for _, v := range r.Header.Values(h) {
+			sub.Header.Add(h, v)
+		}
+	}
+	sub.Header.Set("X-Forwarded-Method", r.Method)
+	sub.Header.Set("X-Forwarded-Proto", forwardedProto(r))
+	sub.Header.Set("X-Forwarded-Host", r.Host)
+	sub.Header.Set("X-Forwarded-Uri", r.URL.RequestURI())
+	if ip := ipfilter.ClientIP(r); ip != nil {
+		sub.Header.Set("X-Forwarded-For", ip.String())
+	}
+	if id, ok := requestid.FromRequest(r); ok {
+		sub.Header.Set(id.Header, id.Value)
+	}
+
+	resp, err := f.client.Do(sub)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	d := &Decision{
+		Allowed: resp.StatusCode >= 200 && resp.StatusCode < 300,
+		Status:  resp.StatusCode,
+		Header:  resp.Header,
+	}
+	if !d.Allowed {
+		if d.Body, err = io.ReadAll(io.LimitReader(resp.Body, maxDenialBody)); err != nil {
+			return nil, err
+		}
+	}
+	if resp.StatusCode >= 500 {
+		return nil, errors.New("authorization service returned " + resp.Status)
+	}
+
+	if f.CacheTTL > 0 {
+		f.store(key, d)
+	}
+	return d, nil
+}
+
+// Apply sets the chosen response headers of an allowing decision on the upstream request.
+// Client supplied values of these headers are removed, even if the authorization service didn't send them.
+func (f *ForwardAuth) Apply(r *http.Request, d *Decision) {
+	for _, h := range f.ResponseHeaders {
+		r.Header.Del(h)
+		for _, v := range d.Header.Values(h) {
+			r.Header.Add(h, v)
+		}
+	}
+}
+
+// Write returns the response of a denying decision to the client with the CORS and security headers of the route,
+// like every other error response. CORS headers of the authorization service are replaced by the route's policy.
+func (d *Decision) Write(w http.ResponseWriter, r *http.Request, opts *proxy.Options) {
+	for k, vv := range d.Header {
+		// The body is sent as read, so its framing headers don't apply
+		if k == "Content-Length" || k == "Transfer-Encoding" || k == "Connection" {
+			continue
+		}
+		// Cached decisions are shared between requests
+		w.Header()[k] = slices.Clone(vv)
+	}
+	// The authorization service may echo the ID of the request which filled the cache
+	requestid.SetResponseHeader(w.Header(), r)
+	if opts != nil {
+		opts.CORS.Prepare(w.Header())
+		opts.CORS.Decorate(w.Header(), r)
+		opts.Security.Apply(w.Header(), r)
+	}
+	w.WriteHeader(d.Status)
+	w.Write(d.Body)
+}
+
+// cacheKey hashes the credentials along with everything else the subrequest tells about the request,
+// as the authorization service can decide differently per path, method, scheme or client IP
+func (f *ForwardAuth) cacheKey(r *http.Request) [32]byte {
+	h := sha256.New()
+	for _, name := range f.RequestHeaders {
+		for _, v := range r.Header.Values(name) {
+			io.WriteString(h, name+":"+v+"\n")
+		}
+	}
+	io.WriteString(h, r.Method+" "+forwardedProto(r)+" "+r.Host+" "+r.URL.RequestURI()+"\n")
+	if ip := ipfilter.ClientIP(r); ip != nil {
+		io.WriteString(h, ip.String())
+	}
+	var key [32]byte
+	h.Sum(key[:0])
+	return key
+}
+
+func forwardedProto(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+func (f *ForwardAuth) cached(key [32]byte) *Decision {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, ok := f.cache[key]
+	if !ok || time.Now().After(d.expires) {
+		return nil
+	}
+	return d
+}
+
+func (f *ForwardAuth) store(key [32]byte, d *Decision) {
+	now := time.Now()
+	d.expires = now.Add(f.CacheTTL)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.cache) >= maxCachedDecisions {
+		for k, old := range f.cache {
+			if now.After(old.expires) {
+				delete(f.cache, k)
+			}
+		}
+		// Still full of live decisions, start over rather than grow without bound
+		if len(f.cache) >= maxCachedDecisions {
+			clear(f.cache)
+		}
+	}
+	f.cache[key] = d
+}
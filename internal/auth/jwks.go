@@ -0,0 +1,236 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// How often keys fetched from a JWKS URL are refreshed
+const JWKSRefreshInterval = 10 * time.Minute
+
+// Tokens signed with an unknown key trigger a refresh at most this often
+const jwksMinRefreshInterval = time.Minute
+
+// Largest JWKS document read from a URL
+const maxJWKSSize = 1 << 20
+
+var jwksClient = &http.Client{Timeout: 5 * time.Second}
+
+// JWK is a public key of a JWKS
+type JWK struct {
+	ID  string
+	Alg string
+	Key crypto.PublicKey
+}
+
+// JWKS is a set of JSON Web Keys, loaded once from a file or fetched and refreshed from a URL
+type JWKS struct {
+	URL string
+
+	mu      sync.Mutex
+	keys    []JWK
+	fetched time.Time
+
+	// Closed when the fetch in flight finishes, nil while none is
+	refreshing chan struct{}
+}
+
+// LoadJWKSFile reads the keys of a local JWKS file
+func LoadJWKSFile(file string) (*JWKS, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := ParseJWKS(data)
+	if err != nil {
+		return nil, err
+	}
+	return &JWKS{keys: keys}, nil
+}
+
+// NewRemoteJWKS returns a JWKS fetched from url the first time a key is needed
+func NewRemoteJWKS(url string) *JWKS {
+	return &JWKS{URL: url}
+}
+
+// Keys returns the keys which can verify a token with the kid and alg.
+// Remote keys are refreshed in the background when they are stale or no key has the kid. Only requests without
+// a matching key wait for the refresh, the others keep using the current keys meanwhile.
+func (s *JWKS) Keys(kid string, alg string) []JWK {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.URL != "" {
+		matched := len(s.match(kid, alg)) > 0
+		since := time.Since(s.fetched)
+		if since > JWKSRefreshInterval || (since > jwksMinRefreshInterval && !matched) {
+			done := s.startRefresh()
+			if !matched {
+				s.mu.Unlock()
+				<-done
+				s.mu.Lock()
+			}
+		}
+	}
+	return s.match(kid, alg)
+}
+
+func (s *JWKS) match(kid string, alg string) []JWK {
+	var keys []JWK
+	for _, k := range s.keys {
+		if (kid == "" || k.ID == kid) && (k.Alg == "" || k.Alg == alg) {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// startRefresh starts fetching the keys unless a fetch is already in flight, s.mu must be held
+func (s *JWKS) startRefresh() <-chan struct{} {
+	if s.refreshing == nil {
+		s.refreshing = make(chan struct{})
+		s.fetched = time.Now()
+		go s.refresh(s.refreshing)
+	}
+	return s.refreshing
+}
+
+// refresh fetches the keys from the URL without holding the lock, keeping the old keys if that fails
+func (s *JWKS) refresh(done chan struct{}) {
+	keys, err := fetchJWKS(s.URL)
+
+	s.mu.Lock()
+	// An error surfaces as an unknown key on the requests using it
+	if err == nil {
+		s.keys = keys
+	}
+	s.refreshing = nil
+	s.mu.Unlock()
+	close(done)
+}
+
+func fetchJWKS(url string) ([]JWK, error) {
+	resp, err := jwksClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("jwks url returned %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxJWKSSize))
+	if err != nil {
+		return nil, err
+	}
+	return ParseJWKS(data)
+}
+
+// ParseJWKS parses the signing keys of a JWKS document, keys of unsupported types are skipped
+func ParseJWKS(data []byte) ([]JWK, error) {
+	var doc struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Alg string `json:"alg"`
+			Use string `json:"use"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("invalid jwks: %v", err)
+	}
+
+	var keys []JWK
+	for i, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		var pub crypto.PublicKey
+		var err error
+		switch k.Kty {
+		case "RSA":
+			pub, err = rsaKey(k.N, k.E)
+		case "EC":
+			pub, err = ecKey(k.Crv, k.X, k.Y)
+		case "OKP":
+			pub, err = okpKey(k.Crv, k.X)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid jwks key[%d]: %v", i, err)
+		}
+		keys = append(keys, JWK{ID: k.Kid, Alg: k.Alg, Key: pub})
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("jwks has no supported signing keys")
+	}
+	return keys, nil
+}
+
+func rsaKey(n string, e string) (*rsa.PublicKey, error) {
+	nb, err := base64.RawURLEncoding.DecodeString(n)
+	if err != nil || len(nb) == 0 {
+		return nil, errors.New("invalid RSA modulus")
+	}
+	eb, err := base64.RawURLEncoding.DecodeString(e)
+	if err != nil || len(eb) == 0 || len(eb) > 4 {
+		return nil, errors.New("invalid RSA exponent")
+	}
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(nb),
+		E: int(new(big.Int).SetBytes(eb).Int64()),
+	}, nil
+}
+
+func ecKey(crv string, x string, y string) (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	switch crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("unsupported curve '%s'", crv)
+	}
+	xb, errX := base64.RawURLEncoding.DecodeString(x)
+	yb, errY := base64.RawURLEncoding.DecodeString(y)
+	if errX != nil || errY != nil {
+		return nil, errors.New("invalid EC point")
+	}
+	key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(xb), Y: new(big.Int).SetBytes(yb)}
+	if !curve.IsOnCurve(key.X, key.Y) {
+		return nil, errors.New("EC point is not on the curve")
+	}
+	return key, nil
+}
+
+func okpKey(crv string, x string) (ed25519.PublicKey, error) {
+	if crv != "Ed25519" {
+		return nil, fmt.Errorf("unsupported curve '%s'", crv)
+	}
+	xb, err := base64.RawURLEncoding.DecodeString(x)
+	if err != nil || len(xb) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid Ed25519 key")
+	}
+	return ed25519.PublicKey(xb), nil
+}
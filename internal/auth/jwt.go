@@ -0,0 +1,198 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// JWT validates bearer tokens signed by a key of a JWKS
+type JWT struct {
+	Keys *JWKS
+
+	// Expected iss claim, empty accepts any issuer
+	Issuer string
+
+	// The aud claim must contain one of these, empty accepts any audience
+	Audience []string
+
+	// Claims which must have a value, or contain it for list claims
+	RequiredClaims map[string]string
+
+	// Headers set upstream from claims, keyed by claim name
+	ForwardClaims map[string]string
+
+	// Clock skew tolerated when checking exp and nbf
+	Leeway time.Duration
+}
+
+// Authenticate validates the bearer token of a request
+func (j *JWT) Authenticate(r *http.Request) (*Identity, error) {
+	_, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	claims, err := j.Verify(strings.TrimSpace(token))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnauthorized, err)
+	}
+	for claim, want := range j.RequiredClaims {
+		if !ClaimHas(claims[claim], want) {
+			return nil, fmt.Errorf("%w: claim '%s' is not '%s'", ErrForbidden, claim, want)
+		}
+	}
+
+	id := &Identity{Method: "jwt", User: ClaimString(claims["sub"]), Headers: make(http.Header), Claims: claims}
+	for claim, header := range j.ForwardClaims {
+		// Claims with line breaks could split the header
+		if v := ClaimString(claims[claim]); v != "" && !strings.ContainsAny(v, "\r\n\x00") {
+			id.Headers.Set(header, v)
+		}
+	}
+	return id, nil
+}
+
+// Verify checks the signature, issuer, audience and lifetime of a token and returns its claims
+func (j *JWT) Verify(token string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed token header: %v", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, key := range j.Keys.Keys(header.Kid, header.Alg) {
+		if verifySignature(header.Alg, key.Key, signed, sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, fmt.Errorf("invalid signature for alg '%s' and kid '%s'", header.Alg, header.Kid)
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed token claims: %v", err)
+	}
+
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, errors.New("token has no expiry")
+	}
+	if now.After(unixTime(exp).Add(j.Leeway)) {
+		return nil, errors.New("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(j.Leeway).Before(unixTime(nbf)) {
+		return nil, errors.New("token not valid yet")
+	}
+	if j.Issuer != "" && claims["iss"] != j.Issuer {
+		return nil, fmt.Errorf("unexpected issuer '%v'", claims["iss"])
+	}
+	if len(j.Audience) != 0 && !slices.ContainsFunc(j.Audience, func(aud string) bool { return ClaimHas(claims["aud"], aud) }) {
+		return nil, fmt.Errorf("unexpected audience '%v'", claims["aud"])
+	}
+	return claims, nil
+}
+
+// verifySignature checks a signature made with one of the asymmetric JWS algorithms
+func verifySignature(alg string, key crypto.PublicKey, signed []byte, sig []byte) bool {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "PS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "PS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "PS512", "ES512":
+		hash = crypto.SHA512
+	case "EdDSA":
+		pub, ok := key.(ed25519.PublicKey)
+		return ok && ed25519.Verify(pub, signed, sig)
+	default:
+		// none and HMAC algorithms are never accepted
+		return false
+	}
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if alg[0] == 'R' {
+			return rsa.VerifyPKCS1v15(pub, hash, digest, sig) == nil
+		}
+		if alg[0] == 'P' {
+			return rsa.VerifyPSS(pub, hash, digest, sig, nil) == nil
+		}
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if alg[0] != 'E' || len(sig) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(pub, digest, r, s)
+	}
+	return false
+}
+
+func decodeSegment(seg string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func unixTime(seconds float64) time.Time {
+	return time.Unix(0, int64(seconds*float64(time.Second)))
+}
+
+// ClaimHas reports if a claim equals want, or contains it if the claim is a list
+func ClaimHas(claim any, want string) bool {
+	if list, ok := claim.([]any); ok {
+		return slices.ContainsFunc(list, func(v any) bool { return ClaimString(v) == want })
+	}
+	return claim != nil && ClaimString(claim) == want
+}
+
+// ClaimString formats a claim as a header value, lists are joined with commas
+func ClaimString(claim any) string {
+	switch v := claim.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []any:
+		parts := make([]string, len(v))
+		for i, item := range v {
+			parts[i] = ClaimString(item)
+		}
+		return strings.Join(parts, ",")
+	case float64:
+		return big.NewFloat(v).Text('f', -1)
+	default:
+		data, _ := json.Marshal(v)
+		return string(data)
+	}
+}
@@ -12,7 +12,9 @@ import (
 type BackendConfig struct {
 	URL        *url.URL
 	Health_uri string
-	Proxy      *proxy.RevProxy
+
+	// Nil for stream backends
+	Proxy *proxy.RevProxy
 }
 
 type BackendState struct {
@@ -48,6 +50,21 @@ func CreateBackend(URL string, Health_uri string, state *BackendState) *Backend
 	}
 }
 
+// CreateStreamBackend creates the backend of a TCP or UDP upstream, it is dialed at its address and has no HTTP proxy
+func CreateStreamBackend(URL string, state *BackendState) *Backend {
+	backendURL, _ := url.Parse(URL)
+
+	if state == nil {
+		state = &BackendState{}
+		state.Healthy.Store(true)
+	}
+
+	return &Backend{
+		Config: &BackendConfig{URL: backendURL},
+		State:  state,
+	}
+}
+
 // Address returns the upstream URI of this backend
 func (b *Backend) Address() string {
 	return b.Config.URL.Host + b.Config.URL.Path
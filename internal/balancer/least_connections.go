@@ -6,6 +6,7 @@ import (
 
 	"github.com/kunalvirwal/minato/internal/backend"
 	"github.com/kunalvirwal/minato/internal/cache"
+	"github.com/kunalvirwal/minato/internal/proxy"
 	"github.com/kunalvirwal/minato/internal/utils"
 )
 
@@ -42,13 +43,13 @@ func (lb *LCbalancer) GetNextBackend() *backend.Backend {
 func (lb *LCbalancer) ServeProxy(w http.ResponseWriter, r *http.Request) *cache.Response {
 	backend := lb.GetNextBackend()
 	if backend == nil {
-		http.Error(w, "Service Unavailable: No healthy servers available", http.StatusServiceUnavailable)
-		utils.LogNewError(fmt.Sprintf("Request Dropped %v: No healthy servers available", lb.SvcName))
+		proxy.WriteError(w, r, http.StatusServiceUnavailable, "Service Unavailable: No healthy servers available")
+		utils.LogRequestError(r, fmt.Sprintf("Request Dropped %v: No healthy servers available", lb.SvcName))
 		return nil
 	}
 	backend.IncrementConnections()
 	defer backend.DecrementConnections()
-	utils.LogInfo(fmt.Sprintf("Request forwarded to: %v", backend.Address()))
+	utils.LogRequestInfo(r, fmt.Sprintf("Request forwarded to: %v", backend.Address()))
 	return backend.Serve(w, r)
 }
 
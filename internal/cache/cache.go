@@ -52,7 +52,7 @@ func CreateCache(cacheType string, capacity uint64, maxsize uint64, ttl uint64)
 // Build cache key takes query parameters into account while building the key,
 // so if the request includes time dependent query parameters, then cache might never hit.
 func BuildCacheKey(r *http.Request, port int) string {
-	key := r.Method + "_" + strconv.Itoa(port) + "_" + r.Host + r.URL.Path
+	key := r.Method + "_" + strconv.Itoa(port) + "_" + r.Host + r.URL.EscapedPath()
 	if r.URL.RawQuery != "" {
 		key += "?" + r.URL.RawQuery
 	}
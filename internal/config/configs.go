@@ -9,6 +9,8 @@ import (
 
 	"github.com/kunalvirwal/minato/internal/balancer"
 	"github.com/kunalvirwal/minato/internal/cache"
+	"github.com/kunalvirwal/minato/internal/ipfilter"
+	"github.com/kunalvirwal/minato/internal/proxy"
 	"github.com/kunalvirwal/minato/internal/utils"
 	"gopkg.in/yaml.v3"
 )
@@ -68,6 +70,30 @@ func validateConfig(cfg *Config) error {
 		return errors.New("Cache Capacity must be greater than 0")
 	}
 
+	if err := validateHealthCheck(&cfg.HealthCheck); err != nil {
+		return err
+	}
+
+	if err := validateErrorPages(cfg.ErrorPages, "error_pages"); err != nil {
+		return err
+	}
+
+	if err := validateRequestID(&cfg.RequestID); err != nil {
+		return err
+	}
+
+	if _, err := ipfilter.ParseNetworks(cfg.TrustedProxies); err != nil {
+		return fmt.Errorf("trusted_proxies: %v", err)
+	}
+
+	if err := validateNormalization(&cfg.Normalization); err != nil {
+		return err
+	}
+
+	if err := validateWAF(&cfg.WAF); err != nil {
+		return err
+	}
+
 	// There should be atleast one service defined
 	if len(cfg.Services) == 0 {
 		return errors.New("No services defined in config file")
@@ -76,6 +102,7 @@ func validateConfig(cfg *Config) error {
 	serviceNames := make(map[string]bool)
 	// Track RouteKeys to prevent duplicate domain+path+port combinations
 	routeKeys := make(map[string]bool)
+	var hostRoutes []hostRoute
 	for i, service := range cfg.Services {
 		// No empty service names
 		if service.Name == "" {
@@ -92,23 +119,97 @@ func validateConfig(cfg *Config) error {
 			return fmt.Errorf("Invalid port %d in service %s", service.Port, service.Name)
 		}
 
+		// Services proxy requests unless a type is given
+		if service.Type == "" {
+			cfg.Services[i].Type = ServiceProxy
+			service.Type = ServiceProxy
+		}
+		if service.Type != ServiceProxy && service.Type != ServiceRedirect && service.Type != ServiceStatic && service.Type != ServiceStream {
+			return fmt.Errorf("Invalid service type %s in service %s, can use proxy, redirect, static or stream", service.Type, service.Name)
+		}
+
 		// Validate balancer type
-		if service.Balancer != balancer.Round_robin && service.Balancer != balancer.Least_conn {
+		balanced := service.Type == ServiceProxy || service.Type == ServiceStream
+		if balanced && service.Balancer != balancer.Round_robin && service.Balancer != balancer.Least_conn {
 			return fmt.Errorf("Invalid balancer type %s in service %s", service.Balancer, service.Name)
 		}
 
+		// Stream services forward whole connections, so they have no hosts or HTTP settings
+		if service.Type == ServiceStream {
+			if err := validateStream(&cfg.Services[i]); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := validateRedirects(cfg.Services[i].Redirects, service.Name); err != nil {
+			return err
+		}
+		if service.Type == ServiceRedirect && len(service.Redirects) == 0 {
+			return fmt.Errorf("No redirects defined for redirect service %s", service.Name)
+		}
+		if service.Type == ServiceStatic {
+			if err := validateStatic(&cfg.Services[i].Static, service.Name); err != nil {
+				return err
+			}
+		}
+		if service.HTTPSPort < 0 || service.HTTPSPort > 65535 {
+			return fmt.Errorf("Invalid https_port %d in service %s", service.HTTPSPort, service.Name)
+		}
+
+		if err := validateHeaderRules(service.Headers, "service '"+service.Name+"'"); err != nil {
+			return err
+		}
+		if err := validateTimeouts(service.Timeouts, "service '"+service.Name+"'"); err != nil {
+			return err
+		}
+		if err := validateCompression(&cfg.Services[i].Compression, service.Name); err != nil {
+			return err
+		}
+		if err := validateRequestBody(service.RequestBody, "service '"+service.Name+"'"); err != nil {
+			return err
+		}
+		if err := validateCORS(&cfg.Services[i].CORS, "service '"+service.Name+"'"); err != nil {
+			return err
+		}
+		if err := validateSecurityHeaders(service.SecurityHeaders, "service '"+service.Name+"'"); err != nil {
+			return err
+		}
+		if err := validateRateLimit(&cfg.Services[i].RateLimit, "service '"+service.Name+"'"); err != nil {
+			return err
+		}
+		if err := validateIPFilter(service.IPFilter, "service '"+service.Name+"'"); err != nil {
+			return err
+		}
+		if err := validateAuth(&cfg.Services[i].Auth, "service '"+service.Name+"'"); err != nil {
+			return err
+		}
+		if err := validateForwardAuth(&cfg.Services[i].ForwardAuth, "service '"+service.Name+"'"); err != nil {
+			return err
+		}
+		if err := validateClientCert(&cfg.Services[i].ClientCert, "service '"+service.Name+"'"); err != nil {
+			return err
+		}
+		if service.WAFMode != "" && !validWAFMode(service.WAFMode) {
+			return fmt.Errorf("service '%s': invalid waf_mode '%s', can use block, detect or off", service.Name, service.WAFMode)
+		}
+		if err := validateErrorPages(service.ErrorPages, "service '"+service.Name+"': error_pages"); err != nil {
+			return err
+		}
+
 		// There should be atleast one host
 		if len(service.Hosts) == 0 {
 			return fmt.Errorf("No hosts defined for service %s", service.Name)
 		}
 
 		inboundHosts := make(map[string]bool)
-		for j, link := range service.Hosts {
+		for j, route := range service.Hosts {
+			link := route.URL
 
 			// remove trailing slash
 			if strings.HasSuffix(link, "/") {
 				link = link[:len(link)-1]
-				cfg.Services[i].Hosts[j] = link
+				cfg.Services[i].Hosts[j].URL = link
 			}
 
 			// No empty host
@@ -122,19 +223,100 @@ func validateConfig(cfg *Config) error {
 				return fmt.Errorf("service '%s': Hosts[%d] has invalid host URL '%s'", service.Name, j, link)
 			}
 
-			// No duplicate link hosts
-			if inboundHosts[link] {
+			if err := validateRouteMatch(&cfg.Services[i].Hosts[j].Match, fmt.Sprintf("service '%s': host '%s'", service.Name, link)); err != nil {
+				return err
+			}
+			matchKey := cfg.Services[i].Hosts[j].Match.Key()
+
+			// No duplicate link hosts, routes with a host_regex share the URL * and routes with matchers their URL
+			inboundKey := link + " " + route.HostRegex + " " + matchKey
+			if inboundHosts[inboundKey] {
 				return fmt.Errorf("Duplicate host %s found in service %s", link, service.Name)
 			}
-			inboundHosts[link] = true
+			inboundHosts[inboundKey] = true
 
-			// Validate unique RouteKey (domain + path + port combination)
-			routeKey := fmt.Sprintf("%s|%s|%d", parsed.Host, parsed.Path, service.Port)
+			// Hosts are matched case insensitively, regex hosts are told apart by their pattern
+			host, err := validateHost(parsed.Host, route.HostRegex)
+			if err != nil {
+				return fmt.Errorf("service '%s': host '%s': %v", service.Name, link, err)
+			}
+
+			// Validate unique RouteKey (domain + path + matchers + port combination)
+			routeKey := fmt.Sprintf("%s|%s|%s|%d", host, parsed.Path, matchKey, service.Port)
 			if routeKeys[routeKey] {
-				return fmt.Errorf("Duplicate route found: domain '%s' with path '%s' on port %d is already defined in another service", parsed.Host, parsed.Path, service.Port)
+				if matchKey != "" {
+					return fmt.Errorf("Duplicate route found: domain '%s' with path '%s' and matchers '%s' on port %d is already defined in another service", host, parsed.Path, matchKey, service.Port)
+				}
+				return fmt.Errorf("Duplicate route found: domain '%s' with path '%s' on port %d is already defined in another service", host, parsed.Path, service.Port)
 			}
 			routeKeys[routeKey] = true
+			hostRoutes = append(hostRoutes, hostRoute{service: service.Name, port: service.Port, path: parsed.Path, host: host, regex: route.HostRegex})
+
+			if err := validateRewrite(&cfg.Services[i].Hosts[j], service.Name); err != nil {
+				return err
+			}
+
+			// Routes are named after their service unless named explicitly
+			if route.Name == "" {
+				cfg.Services[i].Hosts[j].Name = service.Name
+			}
+			if err := validateHeaderRules(route.Headers, fmt.Sprintf("service '%s': host '%s'", service.Name, link)); err != nil {
+				return err
+			}
+			if err := validateTimeouts(route.Timeouts, fmt.Sprintf("service '%s': host '%s'", service.Name, link)); err != nil {
+				return err
+			}
+			if err := validateRequestBody(route.RequestBody, fmt.Sprintf("service '%s': host '%s'", service.Name, link)); err != nil {
+				return err
+			}
+			if err := validateCORS(&cfg.Services[i].Hosts[j].CORS, fmt.Sprintf("service '%s': host '%s'", service.Name, link)); err != nil {
+				return err
+			}
+			if err := validateRateLimit(&cfg.Services[i].Hosts[j].RateLimit, fmt.Sprintf("service '%s': host '%s'", service.Name, link)); err != nil {
+				return err
+			}
+			if err := validateIPFilter(route.IPFilter, fmt.Sprintf("service '%s': host '%s'", service.Name, link)); err != nil {
+				return err
+			}
+			if err := validateAuth(&cfg.Services[i].Hosts[j].Auth, fmt.Sprintf("service '%s': host '%s'", service.Name, link)); err != nil {
+				return err
+			}
+			// Routes use their own rate limit and auth if set, else the service's
+			limit, policy := cfg.Services[i].RateLimit, cfg.Services[i].Auth
+			if route.RateLimit.Requests > 0 {
+				limit = cfg.Services[i].Hosts[j].RateLimit
+			}
+			if route.Auth.Enabled() {
+				policy = cfg.Services[i].Hosts[j].Auth
+			}
+			if err := validateClaimKey(limit, policy, fmt.Sprintf("service '%s': host '%s'", service.Name, link)); err != nil {
+				return err
+			}
+			if err := validateForwardAuth(&cfg.Services[i].Hosts[j].ForwardAuth, fmt.Sprintf("service '%s': host '%s'", service.Name, link)); err != nil {
+				return err
+			}
+			if err := validateClientCert(&cfg.Services[i].Hosts[j].ClientCert, fmt.Sprintf("service '%s': host '%s'", service.Name, link)); err != nil {
+				return err
+			}
+			if err := validateOIDC(&cfg.Services[i].Hosts[j].OIDC, []string{link}, fmt.Sprintf("service '%s': host '%s'", service.Name, link)); err != nil {
+				return err
+			}
+		}
 
+		var hostURLs []string
+		for _, route := range cfg.Services[i].Hosts {
+			hostURLs = append(hostURLs, route.URL)
+		}
+		if err := validateOIDC(&cfg.Services[i].OIDC, hostURLs, "service '"+service.Name+"'"); err != nil {
+			return err
+		}
+
+		// Redirect and static services don't have upstreams
+		if service.Type == ServiceRedirect || service.Type == ServiceStatic {
+			if len(service.Upstreams) != 0 {
+				return fmt.Errorf("%s service %s can not have upstreams", service.Type, service.Name)
+			}
+			continue
 		}
 
 		// There should be atleast one upstream
@@ -155,9 +337,13 @@ func validateConfig(cfg *Config) error {
 				cfg.Services[i].Upstreams[j].Host = upstream.Host
 			}
 
-			// validate the upstream URL
+			// validate the upstream URL, unix socket upstreams have a path instead of a host
 			parsed, err := url.Parse(upstream.Host)
-			if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+			if parsed != nil && parsed.Scheme == proxy.SchemeUnix {
+				if parsed.Host != "" || parsed.Path == "" || parsed.RawQuery != "" {
+					return fmt.Errorf("service '%s': upstream[%d] has invalid unix socket URL '%s', must be like unix:///path/to.sock", service.Name, j, upstream.Host)
+				}
+			} else if err != nil || parsed.Scheme == "" || parsed.Host == "" {
 				return fmt.Errorf("service '%s': upstream[%d] has invalid host URL '%s'", service.Name, j, upstream.Host)
 			}
 
@@ -177,6 +363,15 @@ func validateConfig(cfg *Config) error {
 				cfg.Services[i].Upstreams[j].Health_uri = "/" + upstream.Health_uri
 			}
 		}
+		if err := validateUpstreamKey(service); err != nil {
+			return err
+		}
 	}
-	return nil
+	if err := validateRegexHosts(hostRoutes); err != nil {
+		return err
+	}
+	if err := validateStreamPorts(cfg); err != nil {
+		return err
+	}
+	return validateListeners(cfg)
 }
@@ -0,0 +1,94 @@
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// parseConfig reads a config of the given services with the cache disabled
+func parseConfig(t *testing.T, services string) *Config {
+	t.Helper()
+	var cfg Config
+	data := "cache: {enabled: false, type: LRU, ttl: 60, capacity: 10}\nservices:\n" + services
+	if err := yaml.Unmarshal([]byte(data), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	return &cfg
+}
+
+func TestRouteMatchKeys(t *testing.T) {
+	tests := []struct {
+		name     string
+		services string
+		err      string
+	}{
+		{
+			name: "different matchers",
+			services: `
+  - name: a
+    listen_port: 8080
+    balancer: RoundRobin
+    upstreams: [{host: "http://127.0.0.1:6001"}]
+    hosts:
+      - {url: "http://app.local", match: {headers: [{name: x-canary, value: "1"}]}}
+      - {url: "http://app.local", match: {query: [{name: beta, value: "1"}]}}
+      - "http://app.local"
+`,
+		},
+		{
+			name: "identical matchers in one service",
+			services: `
+  - name: a
+    listen_port: 8080
+    balancer: RoundRobin
+    upstreams: [{host: "http://127.0.0.1:6001"}]
+    hosts:
+      - {url: "http://app.local", match: {methods: [get, post]}}
+      - {url: "http://app.local", match: {methods: [POST, GET]}}
+`,
+			err: "Duplicate host",
+		},
+		{
+			name: "identical matchers in two services",
+			services: `
+  - name: a
+    listen_port: 8080
+    balancer: RoundRobin
+    upstreams: [{host: "http://127.0.0.1:6001"}]
+    hosts: [{url: "http://app.local/api", match: {headers: [{name: x-canary, value: "1"}], cookies: [{name: pin}]}}]
+  - name: b
+    listen_port: 8080
+    balancer: RoundRobin
+    upstreams: [{host: "http://127.0.0.1:6002"}]
+    hosts: [{url: "http://app.local/api", match: {cookies: [{name: pin}], headers: [{name: X-Canary, value: "1"}]}}]
+`,
+			err: "Duplicate route found",
+		},
+		{
+			name: "matchers on other ports",
+			services: `
+  - name: a
+    listen_port: 8080
+    balancer: RoundRobin
+    upstreams: [{host: "http://127.0.0.1:6001"}]
+    hosts: [{url: "http://app.local", match: {query: [{name: beta, value: "1"}]}}]
+  - name: b
+    listen_port: 8081
+    balancer: RoundRobin
+    upstreams: [{host: "http://127.0.0.1:6002"}]
+    hosts: [{url: "http://app.local", match: {query: [{name: beta, value: "1"}]}}]
+`,
+		},
+	}
+	for _, tt := range tests {
+		err := validateConfig(parseConfig(t, tt.services))
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
@@ -1,18 +1,629 @@
 package config
 
+import (
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/kunalvirwal/minato/internal/router"
+	"github.com/kunalvirwal/minato/internal/secheaders"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Service types
+const (
+	ServiceProxy    = "proxy"
+	ServiceRedirect = "redirect"
+	ServiceStatic   = "static"
+	ServiceStream   = "stream"
+)
+
 type Upstream struct {
 	Host       string `yaml:"host"`
 	Health_uri string `yaml:"health_uri"`
+
+	// Values of the service's upstream_key this upstream serves, upstreams without keys serve every other request
+	Keys []string `yaml:"keys"`
 }
 
 // Services are the Load Balancers we have to create which are defined in Config.yaml
 // Host here refers to complete inbound URL including path prefix and has been used for generalization
 type Service struct {
 	Name      string     `yaml:"name"`
+	Type      string     `yaml:"type"`
 	Port      int        `yaml:"listen_port"`
 	Balancer  string     `yaml:"balancer"`
-	Hosts     []string   `yaml:"hosts"`
+	Hosts     []Route    `yaml:"hosts"`
 	Upstreams []Upstream `yaml:"upstreams"`
+
+	// Host capture, like 1 or tenant, whose value picks the upstreams having it in their keys
+	UpstreamKey string `yaml:"upstream_key"`
+
+	// Redirect rules checked before proxying, a redirect service only serves these
+	Redirects []Redirect `yaml:"redirects"`
+
+	// Redirects plaintext requests to https, HTTPSPort defaults to 443
+	ForceHTTPS bool `yaml:"force_https"`
+	HTTPSPort  int  `yaml:"https_port"`
+
+	// Header rules applied to every route of this service, before the route's own rules
+	Headers HeaderRules `yaml:"headers"`
+
+	// Upstream timeouts of every route of this service, routes can override them
+	Timeouts Timeouts `yaml:"timeouts"`
+
+	// Compression of upstream responses
+	Compression Compression `yaml:"compression"`
+
+	// CORS policy of every route of this service, routes can set their own
+	CORS CORS `yaml:"cors"`
+
+	// Security headers added to the responses of every route of this service
+	SecurityHeaders SecurityHeaders `yaml:"security_headers"`
+
+	// Request body limits of every route of this service, routes can override them
+	RequestBody RequestBody `yaml:"request_body"`
+
+	// Rate limit shared by the routes of this service, routes can set their own
+	RateLimit RateLimit `yaml:"rate_limit"`
+
+	// Clients allowed to reach the routes of this service
+	IPFilter IPFilter `yaml:"ip_filter"`
+
+	// Authentication of every route of this service, routes can set their own
+	Auth Auth `yaml:"auth"`
+
+	// Authorization service asked about every request of this service, routes can set their own
+	ForwardAuth ForwardAuth `yaml:"forward_auth"`
+
+	// OpenID Connect login for every route of this service, routes can set their own
+	OIDC OIDC `yaml:"oidc"`
+
+	// Client certificates allowed on every route of this service, routes can set their own
+	ClientCert ClientCert `yaml:"client_cert"`
+
+	// WAF mode of this service, off, detect or block, inheriting the global mode when empty
+	WAFMode string `yaml:"waf_mode"`
+
+	// Error pages keyed by status code or "default", falling back to the global error pages
+	ErrorPages map[string]ErrorPage `yaml:"error_pages"`
+
+	// Replace upstream 5xx responses with the configured error page
+	InterceptErrors bool `yaml:"intercept_errors"`
+
+	// Directory served by a static service
+	Static Static `yaml:"static"`
+
+	// Protocol and timeouts of a stream service
+	Stream Stream `yaml:"stream"`
+}
+
+// Route is an inbound host of a service along with its route specific options.
+// It can be written as a plain URL string or as a mapping with the URL under the `url` key.
+type Route struct {
+	URL string `yaml:"url"`
+
+	// Regular expression matched against the whole host in place of the URL's host, which must be *
+	HostRegex string `yaml:"host_regex"`
+
+	// Narrows the route down to some requests of its host and path
+	Match RouteMatch `yaml:"match"`
+
+	// Name of the route used in logs and header variables, defaults to the service name
+	Name string `yaml:"name"`
+
+	// Header rules applied after the service's header rules
+	Headers HeaderRules `yaml:"headers"`
+
+	// Overrides the service's timeouts which are set here
+	Timeouts Timeouts `yaml:"timeouts"`
+
+	// Overrides the service's request body limits which are set here
+	RequestBody RequestBody `yaml:"request_body"`
+
+	// CORS policy of this route, replacing the service's policy
+	CORS CORS `yaml:"cors"`
+
+	// Rate limit of this route alone, replacing the service's rate limit
+	RateLimit RateLimit `yaml:"rate_limit"`
+
+	// Clients allowed to reach this route, checked after the service's filter
+	IPFilter IPFilter `yaml:"ip_filter"`
+
+	// Authentication of this route, replacing the service's authentication
+	Auth Auth `yaml:"auth"`
+
+	// Authorization service of this route, replacing the service's one
+	ForwardAuth ForwardAuth `yaml:"forward_auth"`
+
+	// OpenID Connect login of this route, replacing the service's one
+	OIDC OIDC `yaml:"oidc"`
+
+	// Client certificates allowed on this route, replacing the service's rules
+	ClientCert ClientCert `yaml:"client_cert"`
+
+	// Removes the matched path prefix before forwarding the request upstream
+	StripPrefix bool `yaml:"strip_prefix"`
+
+	// Prepended to the request path after stripping and rewriting
+	AddPrefix string `yaml:"add_prefix"`
+
+	// Regex based path rewrites, the first matching rule is applied
+	Rewrite []RewriteRule `yaml:"rewrite"`
+}
+
+// RewriteRule replaces the part of the path matched by Match with Replace.
+// Replace can refer to capture groups as $1 or ${name}.
+type RewriteRule struct {
+	Match   string `yaml:"match"`
+	Replace string `yaml:"replace"`
+}
+
+// Redirect redirects requests whose path matches the regex Match to To.
+// To can use captures of Match as $1 or ${name} and the variables ${host}, ${path} and ${scheme}.
+type Redirect struct {
+	Match     string `yaml:"match"`
+	To        string `yaml:"to"`
+	Status    int    `yaml:"status"`
+	DropQuery bool   `yaml:"drop_query"`
+}
+
+// HeaderRules are the header manipulations for requests sent upstream and responses sent back to the client
+type HeaderRules struct {
+	Request  []HeaderRule `yaml:"request"`
+	Response []HeaderRule `yaml:"response"`
+}
+
+// HeaderRule sets, adds, removes or renames a header.
+// Value can interpolate variables like ${client_ip}, ${route} or ${backend}.
+type HeaderRule struct {
+	Action string `yaml:"action"`
+	Name   string `yaml:"name"`
+	Value  string `yaml:"value"`
+	To     string `yaml:"to"`
+}
+
+// RouteMatch narrows a route down to requests with one of its methods and matching all of its conditions.
+// Conditions match an exact value, a regex found in the value, or the presence of the name when neither is set.
+type RouteMatch struct {
+	Methods []string         `yaml:"methods"`
+	Headers []MatchCondition `yaml:"headers"`
+	Query   []MatchCondition `yaml:"query"`
+	Cookies []MatchCondition `yaml:"cookies"`
+
+	// Routes of the same host and path with a higher priority are tried first, defaults to 0
+	Priority int `yaml:"priority"`
+}
+
+type MatchCondition struct {
+	Name  string `yaml:"name"`
+	Value string `yaml:"value"`
+	Regex string `yaml:"regex"`
+}
+
+// Key returns the matchers in a canonical form, routes of the same host and path must have different keys.
+// It is empty for routes without matchers.
+func (m RouteMatch) Key() string {
+	var parts []string
+	if len(m.Methods) > 0 {
+		methods := slices.Clone(m.Methods)
+		slices.Sort(methods)
+		parts = append(parts, "method="+strings.Join(methods, ","))
+	}
+	add := func(kind string, conditions []MatchCondition) {
+		for _, c := range conditions {
+			switch {
+			case c.Regex != "":
+				parts = append(parts, kind+":"+c.Name+"~"+c.Regex)
+			case c.Value != "":
+				parts = append(parts, kind+":"+c.Name+"="+c.Value)
+			default:
+				parts = append(parts, kind+":"+c.Name)
+			}
+		}
+	}
+	add("header", m.Headers)
+	add("query", m.Query)
+	add("cookie", m.Cookies)
+	slices.Sort(parts)
+	return strings.Join(parts, " ")
+}
+
+// Matcher creates the runtime matcher of a route, it is nil for routes without matchers
+func (m RouteMatch) Matcher() (*router.Matcher, error) {
+	conditions := func(cs []MatchCondition) []router.Condition {
+		var converted []router.Condition
+		for _, c := range cs {
+			converted = append(converted, router.Condition{Name: c.Name, Value: c.Value, Regex: c.Regex})
+		}
+		return converted
+	}
+	return router.NewMatcher(m.Methods, conditions(m.Headers), conditions(m.Query), conditions(m.Cookies))
+}
+
+// UnmarshalYAML allows a Route to be defined either as a URL string or as a mapping
+func (r *Route) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		r.URL = value.Value
+		return nil
+	}
+	type plain Route
+	return value.Decode((*plain)(r))
+}
+
+// Timeouts for requests proxied upstream, written as durations like "5s" or "500ms".
+// Zero values fall back to the defaults.
+type Timeouts struct {
+	Connect        time.Duration `yaml:"connect"`
+	TLSHandshake   time.Duration `yaml:"tls_handshake"`
+	ResponseHeader time.Duration `yaml:"response_header"`
+	// Total time allowed for a request including reading the response body
+	Request time.Duration `yaml:"request"`
+	// Time an idle upstream connection is kept open
+	Idle time.Duration `yaml:"idle"`
+}
+
+// Compression configures on the fly compression of responses
+type Compression struct {
+	Enabled bool `yaml:"enabled"`
+	// Encodings in order of preference, from br, zstd and gzip
+	Encodings []string `yaml:"encodings"`
+	// Content types to compress, like application/json or text/*
+	Types []string `yaml:"types"`
+	// Minimum response size in bytes
+	MinSize int64 `yaml:"min_size"`
+	// Compression level, interpreted per encoding, 0 uses the encoder default
+	Level int `yaml:"level"`
+}
+
+// RequestBody limits the size of request bodies and optionally buffers them before proxying
+type RequestBody struct {
+	// Maximum body size in bytes, 0 means unlimited or 10MB for buffered bodies
+	MaxSize int64 `yaml:"max_size"`
+	// Read the whole body before proxying, nil inherits the service setting
+	Buffer *bool `yaml:"buffer"`
+	// Bytes of a buffered body kept in memory before it is written to a temp file
+	BufferMemory int64 `yaml:"buffer_memory"`
+}
+
+// CORS lets browsers on other origins call a route. Minato answers preflights itself and adds the
+// CORS headers to responses in place of the upstream's. Empty AllowedOrigins disables CORS handling.
+type CORS struct {
+	// Exact origins, * for any origin, wildcards like https://*.example.com or patterns like regex:^https://.+\.dev$
+	AllowedOrigins []string `yaml:"allowed_origins"`
+
+	// Methods allowed in preflights, defaults to GET, HEAD and POST
+	AllowedMethods []string `yaml:"allowed_methods"`
+
+	// Request headers allowed in preflights, empty allows the headers the browser asks for
+	AllowedHeaders []string `yaml:"allowed_headers"`
+
+	// Response headers readable by scripts besides the safelisted ones
+	ExposedHeaders []string `yaml:"exposed_headers"`
+
+	AllowCredentials bool          `yaml:"allow_credentials"`
+	MaxAge           time.Duration `yaml:"max_age"`
+}
+
+// ClientCert authorizes requests by their verified client certificate and forwards its details upstream.
+// Subjects and SANs can be regular expressions prefixed with regex:.
+type ClientCert struct {
+	// Subjects like CN=partner,O=Partner Inc
+	AllowedSubjects []string `yaml:"allowed_subjects"`
+
+	// SANs with their type like DNS:api.example.com or URI:spiffe://example.com/partner
+	AllowedSANs []string `yaml:"allowed_sans"`
+
+	Headers ClientCertHeaders `yaml:"headers"`
+
+	// Cache responses although they can differ per client
+	AllowCache bool `yaml:"allow_cache"`
+}
+
+// Enabled reports if client certificates are checked or forwarded
+func (c ClientCert) Enabled() bool {
+	return len(c.AllowedSubjects) > 0 || len(c.AllowedSANs) > 0 || c.Headers != ClientCertHeaders{}
+}
+
+// ClientCertHeaders name the headers carrying the client certificate upstream
+type ClientCertHeaders struct {
+	Subject     string `yaml:"subject"`
+	SANs        string `yaml:"sans"`
+	Fingerprint string `yaml:"fingerprint"`
+
+	// URL encoded PEM of the certificate
+	PEM string `yaml:"pem"`
+}
+
+// SecurityHeaders adds security headers to responses, starting from the headers of Preset.
+// Values override the preset's, and "off" removes a header of the preset.
+type SecurityHeaders struct {
+	// basic or strict
+	Preset string `yaml:"preset"`
+
+	HSTS                  string `yaml:"hsts"`
+	ContentTypeOptions    string `yaml:"content_type_options"`
+	FrameOptions          string `yaml:"frame_options"`
+	ReferrerPolicy        string `yaml:"referrer_policy"`
+	ContentSecurityPolicy string `yaml:"content_security_policy"`
+
+	// Replace the values set by upstreams, by default they are kept
+	Override bool `yaml:"override"`
+}
+
+// Enabled reports if any security header is configured
+func (s SecurityHeaders) Enabled() bool {
+	return s.Preset != "" || len(s.Values()) > 0
+}
+
+// Values returns the configured header values by header name
+func (s SecurityHeaders) Values() map[string]string {
+	values := make(map[string]string)
+	for name, v := range map[string]string{
+		secheaders.HSTS:                  s.HSTS,
+		secheaders.ContentTypeOptions:    s.ContentTypeOptions,
+		secheaders.FrameOptions:          s.FrameOptions,
+		secheaders.ReferrerPolicy:        s.ReferrerPolicy,
+		secheaders.ContentSecurityPolicy: s.ContentSecurityPolicy,
+	} {
+		if v != "" {
+			values[name] = v
+		}
+	}
+	return values
+}
+
+// Static configures the files served by a static service
+type Static struct {
+	Root    string   `yaml:"root"`
+	Index   []string `yaml:"index"`
+	Listing bool     `yaml:"listing"`
+
+	// Serve the root index file for missing paths without a file extension
+	SPA bool `yaml:"spa"`
+
+	// Serve files and directories starting with a dot, they return 404 by default
+	Dotfiles bool `yaml:"dotfiles"`
+}
+
+// Stream configures a layer 4 service which forwards raw TCP connections or UDP datagrams
+type Stream struct {
+	// tcp or udp, upstreams use the same protocol as their scheme
+	Protocol       string        `yaml:"protocol"`
+	ConnectTimeout time.Duration `yaml:"connect_timeout"`
+	// Time a connection or UDP session is kept open without traffic
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+}
+
+// RequestID configures the unique ID assigned to every request
+type RequestID struct {
+	// Header carrying the ID upstream and back to the client
+	Header string `yaml:"header"`
+
+	// uuid or ulid
+	Format string `yaml:"format"`
+
+	// IPs and CIDRs of clients whose incoming request ID is kept
+	Trusted []string `yaml:"trusted"`
+}
+
+// Normalization sets how strictly requests are checked and normalized before routing.
+// The raw header checks of the level only run on http listeners, https listeners only get their paths normalized.
+type Normalization struct {
+	// off, normal or strict, defaults to normal
+	Level string `yaml:"level"`
+}
+
+// WAF evaluates the rules of RulesFile on the requests of every HTTP service.
+// The rules file is read again on every reload.
+type WAF struct {
+	RulesFile string `yaml:"rules_file"`
+
+	// block, detect to only log the requests which would be blocked, or off
+	Mode string `yaml:"mode"`
+
+	// Bytes of request bodies inspected by body conditions
+	BodyLimit int64 `yaml:"body_limit"`
+
+	// Header carrying the tags of the tag rules upstream
+	TagHeader string `yaml:"tag_header"`
+}
+
+// RateLimit allows each client Requests per Period with bursts of up to Burst requests.
+// Zero Requests disables the limit.
+type RateLimit struct {
+	Requests int           `yaml:"requests"`
+	Period   time.Duration `yaml:"period"`
+	Burst    int           `yaml:"burst"`
+
+	// What identifies a client: ip, header:<name> or claim:<name>
+	Key string `yaml:"key"`
+}
+
+// IPFilter allows and denies clients by IP or CIDR, inline or from list files with one entry per line.
+// Deny wins over allow and a non empty allow list denies everyone else.
+type IPFilter struct {
+	Allow     []string `yaml:"allow"`
+	Deny      []string `yaml:"deny"`
+	AllowFile string   `yaml:"allow_file"`
+	DenyFile  string   `yaml:"deny_file"`
+}
+
+// Auth authenticates requests with any of the configured methods
+type Auth struct {
+	Basic  BasicAuth  `yaml:"basic"`
+	APIKey APIKeyAuth `yaml:"api_key"`
+	JWT    JWTAuth    `yaml:"jwt"`
+
+	// Header carrying the authenticated user upstream
+	UserHeader string `yaml:"user_header"`
+
+	// Cache responses of the route even though they are authenticated.
+	// The cache is shared by all clients, so only allow this for responses which don't depend on the user.
+	AllowCache bool `yaml:"allow_cache"`
+}
+
+// BasicAuth checks HTTP Basic credentials against an htpasswd file with bcrypt hashes
+type BasicAuth struct {
+	Htpasswd string `yaml:"htpasswd"`
+	Realm    string `yaml:"realm"`
+}
+
+// APIKeyAuth checks a header against a file of keys, one per line and optionally named like name:key
+type APIKeyAuth struct {
+	File   string `yaml:"file"`
+	Header string `yaml:"header"`
+}
+
+// JWTAuth validates bearer tokens against the keys of a local JWKS file or a JWKS URL
+type JWTAuth struct {
+	JWKSFile string   `yaml:"jwks_file"`
+	JWKSURL  string   `yaml:"jwks_url"`
+	Issuer   string   `yaml:"issuer"`
+	Audience []string `yaml:"audience"`
+
+	// Claims which must have a value, list claims must contain it
+	RequiredClaims map[string]string `yaml:"required_claims"`
+
+	// Headers set upstream from claims, keyed by claim name
+	ForwardClaims map[string]string `yaml:"forward_claims"`
+
+	// Clock skew tolerated when checking exp and nbf
+	Leeway time.Duration `yaml:"leeway"`
+}
+
+// ForwardAuth sends a subrequest to an authorization service before a request is let through.
+// A 2xx response allows the request, any other response is returned to the client.
+type ForwardAuth struct {
+	URL string `yaml:"url"`
+
+	// Request headers sent to the authorization service, defaults to Authorization and Cookie
+	RequestHeaders []string `yaml:"request_headers"`
+
+	// Headers of an allowing response copied onto the upstream request
+	ResponseHeaders []string `yaml:"response_headers"`
+
+	Timeout time.Duration `yaml:"timeout"`
+
+	// Decisions are cached per credentials and request for this long, 0 disables caching
+	CacheTTL time.Duration `yaml:"cache_ttl"`
+
+	// Cache responses of the route even though they are authorized per user
+	AllowCache bool `yaml:"allow_cache"`
+}
+
+// OIDC logs browser users in with an OpenID Connect provider, keeping their session in an encrypted cookie
+type OIDC struct {
+	Issuer       string   `yaml:"issuer"`
+	ClientID     string   `yaml:"client_id"`
+	ClientSecret string   `yaml:"client_secret"`
+	Scopes       []string `yaml:"scopes"`
+
+	// Absolute URL of the callback, which must be on a host of the service or route
+	RedirectURL string `yaml:"redirect_url"`
+
+	// Encrypts the session cookie, at least 32 characters
+	CookieSecret    string        `yaml:"cookie_secret"`
+	CookieName      string        `yaml:"cookie_name"`
+	SessionLifetime time.Duration `yaml:"session_lifetime"`
+
+	// Path which logs the user out, and where the IdP sends them afterwards
+	LogoutPath            string `yaml:"logout_path"`
+	PostLogoutRedirectURL string `yaml:"post_logout_redirect_url"`
+
+	// Users need one of these groups, read from GroupsClaim
+	AllowedGroups []string `yaml:"allowed_groups"`
+	GroupsClaim   string   `yaml:"groups_claim"`
+
+	// Headers set upstream from ID token claims, keyed by claim name
+	ForwardClaims map[string]string `yaml:"forward_claims"`
+
+	// Cache responses of the route even though they are served per user
+	AllowCache bool `yaml:"allow_cache"`
+}
+
+// Enabled reports if any authentication method is configured
+func (a Auth) Enabled() bool {
+	return a.Basic.Htpasswd != "" || a.APIKey.File != "" || a.JWT.JWKSFile != "" || a.JWT.JWKSURL != ""
+}
+
+// ErrorPage is an error page template, the JSON variant is sent to clients which prefer JSON
+type ErrorPage struct {
+	HTML string `yaml:"html"`
+	JSON string `yaml:"json"`
+}
+
+// Listener holds the settings of the HTTP server running on a port
+type Listener struct {
+	Port              int           `yaml:"port"`
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	ReadTimeout       time.Duration `yaml:"read_timeout"`
+	WriteTimeout      time.Duration `yaml:"write_timeout"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout"`
+
+	// Maximum size of request headers in bytes, 0 uses the default of 1MB
+	MaxHeaderBytes int `yaml:"max_header_bytes"`
+
+	// Unix socket served along with the port, with its permissions in octal like "0660"
+	Socket     string `yaml:"socket"`
+	SocketMode string `yaml:"socket_mode"`
+
+	// Clients allowed to send requests to this listener, checked before routing
+	IPFilter IPFilter `yaml:"ip_filter"`
+
+	// Serves https instead of plain http when a certificate is set
+	TLS TLS `yaml:"tls"`
+
+	// Handles the requests which match no route, they get a 404 otherwise
+	Default ListenerDefault `yaml:"default"`
+}
+
+// ListenerDefault handles the requests of a listener which match no route, either with a service
+// whose routes are then matched by path alone, or with a fixed response
+type ListenerDefault struct {
+	Service string `yaml:"service"`
+
+	Status      int    `yaml:"status"`
+	Body        string `yaml:"body"`
+	ContentType string `yaml:"content_type"`
+}
+
+// TLS is the certificate of a listener and how it verifies client certificates
+type TLS struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+
+	// Client certificate verification of every host of the listener
+	ClientAuth ClientAuth `yaml:"client_auth"`
+
+	// Client certificate verification of hosts, chosen by the server name the client asks for
+	Hosts []TLSHost `yaml:"hosts"`
+}
+
+// Enabled reports if the listener serves https
+func (t TLS) Enabled() bool {
+	return t.CertFile != ""
+}
+
+type TLSHost struct {
+	Names      []string   `yaml:"names"`
+	ClientAuth ClientAuth `yaml:"client_auth"`
+}
+
+// ClientAuth verifies client certificates against the CAs of CAFile, rejecting the ones revoked in CRLFile
+type ClientAuth struct {
+	// none, optional or require, defaults to none
+	Mode    string `yaml:"mode"`
+	CAFile  string `yaml:"ca_file"`
+	CRLFile string `yaml:"crl_file"`
+}
+
+// HealthCheck configures how often and how patiently backends are checked
+type HealthCheck struct {
+	Interval    time.Duration `yaml:"interval"`
+	TCPTimeout  time.Duration `yaml:"tcp_timeout"`
+	HTTPTimeout time.Duration `yaml:"http_timeout"`
 }
 
 type Cache struct {
@@ -25,6 +636,20 @@ type Cache struct {
 
 // config.yaml file is parsed to Config struct
 type Config struct {
-	Cache    Cache     `yaml:"cache"`
-	Services []Service `yaml:"services"`
+	Cache       Cache       `yaml:"cache"`
+	HealthCheck HealthCheck `yaml:"health_check"`
+	Listeners   []Listener  `yaml:"listeners"`
+	Services    []Service   `yaml:"services"`
+
+	// Error pages for requests which don't match a service and for services without their own
+	ErrorPages map[string]ErrorPage `yaml:"error_pages"`
+
+	RequestID RequestID `yaml:"request_id"`
+
+	// Proxies whose X-Forwarded-For is used to find the real client IP
+	TrustedProxies []string `yaml:"trusted_proxies"`
+
+	WAF WAF `yaml:"waf"`
+
+	Normalization Normalization `yaml:"normalization"`
 }
@@ -0,0 +1,881 @@
+package config
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kunalvirwal/minato/internal/auth"
+	"github.com/kunalvirwal/minato/internal/cors"
+	"github.com/kunalvirwal/minato/internal/errorpage"
+	"github.com/kunalvirwal/minato/internal/ipfilter"
+	"github.com/kunalvirwal/minato/internal/mtls"
+	"github.com/kunalvirwal/minato/internal/normalize"
+	"github.com/kunalvirwal/minato/internal/oidc"
+	"github.com/kunalvirwal/minato/internal/proxy"
+	"github.com/kunalvirwal/minato/internal/ratelimit"
+	"github.com/kunalvirwal/minato/internal/redirect"
+	"github.com/kunalvirwal/minato/internal/requestid"
+	"github.com/kunalvirwal/minato/internal/router"
+	"github.com/kunalvirwal/minato/internal/secheaders"
+	"github.com/kunalvirwal/minato/internal/static"
+	"github.com/kunalvirwal/minato/internal/stream"
+	"github.com/kunalvirwal/minato/internal/waf"
+)
+
+// Defaults for optional settings
+const (
+	DefaultHealthCheckInterval    = 10 * time.Second
+	DefaultHealthCheckTCPTimeout  = 1 * time.Second
+	DefaultHealthCheckHTTPTimeout = 5 * time.Second
+	DefaultReadHeaderTimeout      = 10 * time.Second
+	DefaultIdleTimeout            = 120 * time.Second
+	DefaultSocketMode             = "0660"
+)
+
+// DefaultListener returns the settings used for a port which has no listener config
+func DefaultListener(port int) Listener {
+	return Listener{
+		Port:              port,
+		ReadHeaderTimeout: DefaultReadHeaderTimeout,
+		IdleTimeout:       DefaultIdleTimeout,
+	}
+}
+
+// validateRewrite validates and normalises the path rewriting options of a route
+func validateRewrite(route *Route, svcName string) error {
+	if route.AddPrefix != "" {
+		// prefix must start with a slash and must not end with one
+		if !strings.HasPrefix(route.AddPrefix, "/") {
+			route.AddPrefix = "/" + route.AddPrefix
+		}
+		route.AddPrefix = strings.TrimRight(route.AddPrefix, "/")
+	}
+
+	for k, rule := range route.Rewrite {
+		if rule.Match == "" {
+			return fmt.Errorf("service '%s': host '%s' has rewrite[%d] with no match pattern", svcName, route.URL, k)
+		}
+		if _, err := regexp.Compile(rule.Match); err != nil {
+			return fmt.Errorf("service '%s': host '%s' has invalid rewrite[%d] pattern: %v", svcName, route.URL, k, err)
+		}
+	}
+	return nil
+}
+
+// validateRedirects validates the redirect rules of a service and defaults their status to 301
+func validateRedirects(redirects []Redirect, svcName string) error {
+	for k, rd := range redirects {
+		if rd.To == "" {
+			return fmt.Errorf("service '%s': redirect[%d] has no target", svcName, k)
+		}
+
+		var re *regexp.Regexp
+		if rd.Match != "" {
+			var err error
+			if re, err = regexp.Compile(rd.Match); err != nil {
+				return fmt.Errorf("service '%s': redirect[%d] has invalid match pattern: %v", svcName, k, err)
+			}
+		}
+		if err := redirect.ValidateTarget(rd.To, re); err != nil {
+			return fmt.Errorf("service '%s': redirect[%d] has invalid target: %v", svcName, k, err)
+		}
+
+		if rd.Status == 0 {
+			redirects[k].Status = http.StatusMovedPermanently
+		} else if !slices.Contains(redirect.AllowedStatus, rd.Status) {
+			return fmt.Errorf("service '%s': redirect[%d] has invalid status %d, can use 301, 302, 307 or 308", svcName, k, rd.Status)
+		}
+	}
+	return nil
+}
+
+// validateHeaderRules validates the actions, names and value templates of header rules
+func validateHeaderRules(rules HeaderRules, scope string) error {
+	check := func(list []HeaderRule, direction string) error {
+		for k, rule := range list {
+			if rule.Name == "" {
+				return fmt.Errorf("%s: %s header rule[%d] has no header name", scope, direction, k)
+			}
+			switch rule.Action {
+			case proxy.HeaderSet, proxy.HeaderAdd:
+				if _, err := proxy.ParseTemplate(rule.Value); err != nil {
+					return fmt.Errorf("%s: %s header rule[%d] has invalid value: %v", scope, direction, k, err)
+				}
+			case proxy.HeaderRemove:
+			case proxy.HeaderRename:
+				if rule.To == "" {
+					return fmt.Errorf("%s: %s header rule[%d] renames '%s' without a new name", scope, direction, k, rule.Name)
+				}
+			default:
+				return fmt.Errorf("%s: %s header rule[%d] has invalid action '%s', can use set, add, remove or rename", scope, direction, k, rule.Action)
+			}
+		}
+		return nil
+	}
+
+	if err := check(rules.Request, "request"); err != nil {
+		return err
+	}
+	return check(rules.Response, "response")
+}
+
+// validateTimeouts checks that no timeout is negative
+func validateTimeouts(t Timeouts, scope string) error {
+	if t.Connect < 0 || t.TLSHandshake < 0 || t.ResponseHeader < 0 || t.Request < 0 || t.Idle < 0 {
+		return fmt.Errorf("%s: timeouts can not be negative", scope)
+	}
+	return nil
+}
+
+// validateHealthCheck defaults the unset health check settings
+func validateHealthCheck(hc *HealthCheck) error {
+	if hc.Interval < 0 || hc.TCPTimeout < 0 || hc.HTTPTimeout < 0 {
+		return errors.New("Health check interval and timeouts can not be negative")
+	}
+	if hc.Interval == 0 {
+		hc.Interval = DefaultHealthCheckInterval
+	}
+	if hc.TCPTimeout == 0 {
+		hc.TCPTimeout = DefaultHealthCheckTCPTimeout
+	}
+	if hc.HTTPTimeout == 0 {
+		hc.HTTPTimeout = DefaultHealthCheckHTTPTimeout
+	}
+	return nil
+}
+
+// validateListeners checks that every listener belongs to a port used by a service and defaults its timeouts
+func validateListeners(cfg *Config) error {
+	ports := make(map[int]bool)
+	for _, service := range cfg.Services {
+		// Listener settings only apply to HTTP servers
+		if service.Type != ServiceStream {
+			ports[service.Port] = true
+		}
+	}
+
+	seen := make(map[int]bool)
+	sockets := make(map[string]bool)
+	for i, ln := range cfg.Listeners {
+		if !ports[ln.Port] {
+			return fmt.Errorf("Listener at index %d is on port %d which has no services", i, ln.Port)
+		}
+		if seen[ln.Port] {
+			return fmt.Errorf("Duplicate listener found for port %d", ln.Port)
+		}
+		seen[ln.Port] = true
+
+		if ln.ReadHeaderTimeout < 0 || ln.ReadTimeout < 0 || ln.WriteTimeout < 0 || ln.IdleTimeout < 0 {
+			return fmt.Errorf("Listener on port %d has negative timeouts", ln.Port)
+		}
+		if ln.MaxHeaderBytes < 0 {
+			return fmt.Errorf("Listener on port %d has negative max_header_bytes", ln.Port)
+		}
+		if err := validateIPFilter(ln.IPFilter, fmt.Sprintf("Listener on port %d", ln.Port)); err != nil {
+			return err
+		}
+		if err := validateTLS(&cfg.Listeners[i].TLS, fmt.Sprintf("Listener on port %d", ln.Port)); err != nil {
+			return err
+		}
+		if err := validateListenerDefault(cfg, &cfg.Listeners[i]); err != nil {
+			return err
+		}
+		if ln.ReadHeaderTimeout == 0 {
+			cfg.Listeners[i].ReadHeaderTimeout = DefaultReadHeaderTimeout
+		}
+		if ln.IdleTimeout == 0 {
+			cfg.Listeners[i].IdleTimeout = DefaultIdleTimeout
+		}
+
+		if ln.Socket == "" {
+			continue
+		}
+		if sockets[ln.Socket] {
+			return fmt.Errorf("Duplicate listener socket found: %s", ln.Socket)
+		}
+		sockets[ln.Socket] = true
+		if ln.SocketMode == "" {
+			cfg.Listeners[i].SocketMode = DefaultSocketMode
+		}
+		if mode, err := strconv.ParseUint(cfg.Listeners[i].SocketMode, 8, 32); err != nil || mode > 0o777 {
+			return fmt.Errorf("Listener on port %d has invalid socket_mode '%s', must be octal like 0660", ln.Port, ln.SocketMode)
+		}
+	}
+	return nil
+}
+
+// validateListenerDefault checks that the default of a listener is a service on its port or a fixed response
+func validateListenerDefault(cfg *Config, ln *Listener) error {
+	d := &ln.Default
+	if d.Service == "" {
+		if d.Status == 0 && (d.Body != "" || d.ContentType != "") {
+			return fmt.Errorf("Listener on port %d: default response has no status", ln.Port)
+		}
+		if d.Status != 0 && (d.Status < 100 || d.Status > 599) {
+			return fmt.Errorf("Listener on port %d: default response has invalid status %d", ln.Port, d.Status)
+		}
+		if d.Status != 0 && d.ContentType == "" {
+			d.ContentType = "text/plain; charset=utf-8"
+		}
+		return nil
+	}
+	if d.Status != 0 || d.Body != "" || d.ContentType != "" {
+		return fmt.Errorf("Listener on port %d: default can have either a service or a response", ln.Port)
+	}
+	i := slices.IndexFunc(cfg.Services, func(s Service) bool { return s.Name == d.Service })
+	if i < 0 {
+		return fmt.Errorf("Listener on port %d: default service '%s' not found", ln.Port, d.Service)
+	}
+	if cfg.Services[i].Port != ln.Port || cfg.Services[i].Type == ServiceStream {
+		return fmt.Errorf("Listener on port %d: default service '%s' must be an HTTP service on the same port", ln.Port, d.Service)
+	}
+	return nil
+}
+
+// validateCompression checks the encodings and defaults the unset compression settings
+func validateCompression(c *Compression, svcName string) error {
+	if !c.Enabled {
+		return nil
+	}
+
+	if len(c.Encodings) == 0 {
+		c.Encodings = slices.Clone(proxy.DefaultEncodings)
+	}
+	for _, enc := range c.Encodings {
+		if !slices.Contains(proxy.DefaultEncodings, enc) {
+			return fmt.Errorf("service '%s': invalid compression encoding '%s', can use br, zstd or gzip", svcName, enc)
+		}
+	}
+
+	if len(c.Types) == 0 {
+		c.Types = slices.Clone(proxy.DefaultCompressibleTypes)
+	}
+	for k, t := range c.Types {
+		c.Types[k] = strings.ToLower(strings.TrimSpace(t))
+	}
+
+	if c.MinSize < 0 {
+		return fmt.Errorf("service '%s': compression min_size can not be negative", svcName)
+	}
+	if c.MinSize == 0 {
+		c.MinSize = proxy.DefaultCompressionMinSize
+	}
+
+	if c.Level < 0 || c.Level > 22 {
+		return fmt.Errorf("service '%s': compression level must be between 0 and 22", svcName)
+	}
+	return nil
+}
+
+// validateCORS checks the origins of a CORS policy and defaults its methods
+func validateCORS(c *CORS, scope string) error {
+	if len(c.AllowedOrigins) == 0 {
+		return nil
+	}
+	if c.MaxAge < 0 {
+		return fmt.Errorf("%s: cors max_age can not be negative", scope)
+	}
+	if len(c.AllowedMethods) == 0 {
+		c.AllowedMethods = slices.Clone(cors.DefaultMethods)
+	}
+	for k, m := range c.AllowedMethods {
+		c.AllowedMethods[k] = strings.ToUpper(m)
+	}
+	if _, err := cors.New(c.AllowedOrigins, c.AllowedMethods, c.AllowedHeaders, c.ExposedHeaders, c.AllowCredentials, c.MaxAge); err != nil {
+		return fmt.Errorf("%s: cors: %v", scope, err)
+	}
+	return nil
+}
+
+// validateHost checks the host of a route URL and returns it in the form routes are told apart by.
+// Hosts can be exact, wildcards like *.example.com, the catch-all * or * along with a regex.
+func validateHost(host string, regex string) (string, error) {
+	host = strings.ToLower(host)
+	if regex != "" {
+		if host != router.CatchAll {
+			return "", errors.New("the URL of a route with host_regex must have * as host")
+		}
+		if _, err := router.CompileHost(regex); err != nil {
+			return "", fmt.Errorf("invalid host_regex: %v", err)
+		}
+		return "regex:" + regex, nil
+	}
+	if host == router.CatchAll {
+		return host, nil
+	}
+	if strings.Contains(strings.TrimPrefix(host, "*."), "*") || host == "*." {
+		return "", errors.New("* can only be the whole host or its first label like *.example.com")
+	}
+	return host, nil
+}
+
+// hostRoute is the host, port and path prefix of a route, collected to compare regex hosts with the other hosts
+type hostRoute struct {
+	service string
+	port    int
+	path    string
+	host    string
+	regex   string
+}
+
+// Labels tried in place of the * of a wildcard host to find regex hosts matching its subdomains
+var wildcardSamples = []string{"a", "0", "www", "a-0"}
+
+// validateRegexHosts rejects regex hosts matching an exact or wildcard host with the same port and path prefix.
+// Exact and wildcard hosts are matched first, so such a regex would only take part of the hosts it describes.
+func validateRegexHosts(routes []hostRoute) error {
+	for _, rr := range routes {
+		if rr.regex == "" {
+			continue
+		}
+		pattern, _ := router.CompileHost(rr.regex)
+		for _, r := range routes {
+			if r.regex != "" || r.host == router.CatchAll || r.port != rr.port || r.path != rr.path {
+				continue
+			}
+			samples := []string{r.host}
+			if router.IsWildcard(r.host) {
+				samples = samples[:0]
+				for _, label := range wildcardSamples {
+					samples = append(samples, label+r.host[1:])
+				}
+			}
+			for _, host := range samples {
+				if pattern.MatchString(host) {
+					return fmt.Errorf("service '%s': host_regex '%s' overlaps host '%s' of service '%s' on port %d with path '%s', which is matched first", rr.service, rr.regex, r.host, r.service, r.port, r.path)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// validateRouteMatch checks the matchers of a route, upper casing methods and canonicalizing header names
+func validateRouteMatch(m *RouteMatch, scope string) error {
+	for k, method := range m.Methods {
+		method = strings.ToUpper(method)
+		if method == "" || strings.ContainsAny(method, " \t") {
+			return fmt.Errorf("%s: match: invalid method '%s'", scope, method)
+		}
+		m.Methods[k] = method
+	}
+	for k := range m.Headers {
+		m.Headers[k].Name = http.CanonicalHeaderKey(m.Headers[k].Name)
+	}
+	if _, err := m.Matcher(); err != nil {
+		return fmt.Errorf("%s: match: %v", scope, err)
+	}
+	return nil
+}
+
+// validateUpstreamKey checks that the upstream_key of a service names a capture of one of its hosts
+func validateUpstreamKey(service Service) error {
+	if service.UpstreamKey == "" {
+		for j, upstream := range service.Upstreams {
+			if len(upstream.Keys) > 0 {
+				return fmt.Errorf("service '%s': upstream[%d] has keys but the service has no upstream_key", service.Name, j)
+			}
+		}
+		return nil
+	}
+
+	keyed := slices.ContainsFunc(service.Upstreams, func(u Upstream) bool { return len(u.Keys) > 0 })
+	if !keyed {
+		return fmt.Errorf("service '%s': upstream_key is set but no upstream has keys", service.Name)
+	}
+	group, numbered := strconv.Atoi(service.UpstreamKey)
+	captured := slices.ContainsFunc(service.Hosts, func(route Route) bool {
+		if route.HostRegex == "" {
+			parsed, _ := url.Parse(route.URL)
+			return router.IsWildcard(parsed.Host) && numbered == nil && group == 1
+		}
+		// Patterns are checked by validateHost before
+		pattern, _ := router.CompileHost(route.HostRegex)
+		if numbered == nil {
+			return group >= 1 && group <= pattern.NumSubexp()
+		}
+		return pattern.SubexpIndex(service.UpstreamKey) > 0
+	})
+	if !captured {
+		return fmt.Errorf("service '%s': upstream_key '%s' is not captured by any wildcard or regex host", service.Name, service.UpstreamKey)
+	}
+	return nil
+}
+
+// validateTLS loads the certificate and client CAs of a listener, defaulting client certificate modes to none
+func validateTLS(t *TLS, scope string) error {
+	if !t.Enabled() {
+		if t.KeyFile != "" || t.ClientAuth != (ClientAuth{}) || len(t.Hosts) > 0 {
+			return fmt.Errorf("%s: tls has no cert_file", scope)
+		}
+		return nil
+	}
+	if t.KeyFile == "" {
+		return fmt.Errorf("%s: tls has no key_file", scope)
+	}
+	if _, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile); err != nil {
+		return fmt.Errorf("%s: tls: %v", scope, err)
+	}
+	if err := validateClientAuth(&t.ClientAuth, scope+": tls: client_auth"); err != nil {
+		return err
+	}
+
+	names := make(map[string]bool)
+	for k := range t.Hosts {
+		host := &t.Hosts[k]
+		if len(host.Names) == 0 {
+			return fmt.Errorf("%s: tls: hosts[%d] has no names", scope, k)
+		}
+		for j, name := range host.Names {
+			name = strings.ToLower(name)
+			if names[name] {
+				return fmt.Errorf("%s: tls: host '%s' is listed twice", scope, name)
+			}
+			names[name] = true
+			host.Names[j] = name
+		}
+		if err := validateClientAuth(&host.ClientAuth, fmt.Sprintf("%s: tls: hosts[%d]: client_auth", scope, k)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateClientAuth(a *ClientAuth, scope string) error {
+	if a.Mode == "" {
+		a.Mode = mtls.ModeNone
+	}
+	if a.Mode == mtls.ModeNone && (a.CAFile != "" || a.CRLFile != "") {
+		return fmt.Errorf("%s: ca_file is set but mode is none, can use optional or require", scope)
+	}
+	if _, err := mtls.LoadClientAuth(a.Mode, a.CAFile, a.CRLFile); err != nil {
+		return fmt.Errorf("%s: %v", scope, err)
+	}
+	return nil
+}
+
+// validateClientCert checks the client certificate rules of a service or route and canonicalizes its header names
+func validateClientCert(c *ClientCert, scope string) error {
+	if !c.Enabled() {
+		return nil
+	}
+	for _, name := range []*string{&c.Headers.Subject, &c.Headers.SANs, &c.Headers.Fingerprint, &c.Headers.PEM} {
+		if *name == "" {
+			continue
+		}
+		*name = http.CanonicalHeaderKey(*name)
+		if strings.ContainsAny(*name, " :\t") {
+			return fmt.Errorf("%s: client_cert: invalid header '%s'", scope, *name)
+		}
+	}
+	if _, err := mtls.NewPolicy(c.AllowedSubjects, c.AllowedSANs, mtls.Headers{}, false); err != nil {
+		return fmt.Errorf("%s: client_cert: %v", scope, err)
+	}
+	return nil
+}
+
+// validateSecurityHeaders checks the preset and header values of a security header profile
+func validateSecurityHeaders(sh SecurityHeaders, scope string) error {
+	if !sh.Enabled() {
+		return nil
+	}
+	if _, err := secheaders.New(sh.Preset, sh.Values(), sh.Override); err != nil {
+		return fmt.Errorf("%s: security_headers: %v", scope, err)
+	}
+	return nil
+}
+
+// validateRequestBody checks that the body limits are not negative
+func validateRequestBody(rb RequestBody, scope string) error {
+	if rb.MaxSize < 0 || rb.BufferMemory < 0 {
+		return fmt.Errorf("%s: request_body sizes can not be negative", scope)
+	}
+	return nil
+}
+
+// validateClaimKey checks that a rate limit keyed by a claim has a JWT policy verifying the claim
+func validateClaimKey(rl RateLimit, a Auth, scope string) error {
+	if rl.Requests == 0 || !strings.HasPrefix(rl.Key, ratelimit.KeyClaim+":") {
+		return nil
+	}
+	if a.JWT.JWKSFile == "" && a.JWT.JWKSURL == "" {
+		return fmt.Errorf("%s: rate_limit key '%s' needs auth.jwt to verify the claim", scope, rl.Key)
+	}
+	return nil
+}
+
+// validateRateLimit checks a rate limit and defaults its period, burst and key
+func validateRateLimit(rl *RateLimit, scope string) error {
+	if rl.Requests < 0 || rl.Period < 0 || rl.Burst < 0 {
+		return fmt.Errorf("%s: rate_limit values can not be negative", scope)
+	}
+	if rl.Requests == 0 {
+		return nil
+	}
+	if rl.Period == 0 {
+		rl.Period = time.Second
+	}
+	if rl.Burst == 0 {
+		rl.Burst = rl.Requests
+	}
+	if rl.Key == "" {
+		rl.Key = ratelimit.KeyIP
+	}
+	if !ratelimit.ValidKey(rl.Key) {
+		return fmt.Errorf("%s: invalid rate_limit key '%s', can use ip, header:<name> or claim:<name>", scope, rl.Key)
+	}
+	return nil
+}
+
+// validateIPFilter checks that the entries and list files of an IP filter parse
+func validateIPFilter(f IPFilter, scope string) error {
+	if _, err := ipfilter.LoadList(f.Allow, f.AllowFile); err != nil {
+		return fmt.Errorf("%s: ip_filter allow: %v", scope, err)
+	}
+	if _, err := ipfilter.LoadList(f.Deny, f.DenyFile); err != nil {
+		return fmt.Errorf("%s: ip_filter deny: %v", scope, err)
+	}
+	return nil
+}
+
+// validateAuth checks that the credential files of an auth policy load and defaults its realm and headers
+func validateAuth(a *Auth, scope string) error {
+	if !a.Enabled() {
+		return nil
+	}
+	if a.Basic.Htpasswd != "" {
+		if a.Basic.Realm == "" {
+			a.Basic.Realm = auth.DefaultRealm
+		}
+		if _, err := auth.LoadHtpasswd(a.Basic.Htpasswd, a.Basic.Realm); err != nil {
+			return fmt.Errorf("%s: auth basic: %v", scope, err)
+		}
+	}
+	if a.APIKey.File != "" {
+		if a.APIKey.Header == "" {
+			a.APIKey.Header = auth.DefaultAPIKeyHeader
+		}
+		a.APIKey.Header = http.CanonicalHeaderKey(a.APIKey.Header)
+		if _, err := auth.LoadAPIKeys(a.APIKey.File, a.APIKey.Header); err != nil {
+			return fmt.Errorf("%s: auth api_key: %v", scope, err)
+		}
+	}
+
+	jwt := &a.JWT
+	if jwt.JWKSFile != "" && jwt.JWKSURL != "" {
+		return fmt.Errorf("%s: auth jwt can use either jwks_file or jwks_url", scope)
+	}
+	if jwt.JWKSFile != "" {
+		if _, err := auth.LoadJWKSFile(jwt.JWKSFile); err != nil {
+			return fmt.Errorf("%s: auth jwt: %v", scope, err)
+		}
+	}
+	if jwt.JWKSURL != "" {
+		parsed, err := url.Parse(jwt.JWKSURL)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("%s: auth jwt has invalid jwks_url '%s'", scope, jwt.JWKSURL)
+		}
+	}
+	if jwt.Leeway < 0 {
+		return fmt.Errorf("%s: auth jwt leeway can not be negative", scope)
+	}
+	for claim, header := range jwt.ForwardClaims {
+		if header == "" || strings.ContainsAny(header, " :\t") {
+			return fmt.Errorf("%s: auth jwt forwards claim '%s' to invalid header '%s'", scope, claim, header)
+		}
+		jwt.ForwardClaims[claim] = http.CanonicalHeaderKey(header)
+	}
+
+	if a.UserHeader != "" {
+		if strings.ContainsAny(a.UserHeader, " :\t") {
+			return fmt.Errorf("%s: auth has invalid user_header '%s'", scope, a.UserHeader)
+		}
+		a.UserHeader = http.CanonicalHeaderKey(a.UserHeader)
+	}
+	return nil
+}
+
+// validateForwardAuth checks the URL and headers of a forward auth and defaults its timeout and request headers
+func validateForwardAuth(f *ForwardAuth, scope string) error {
+	if f.URL == "" {
+		return nil
+	}
+	parsed, err := url.Parse(f.URL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("%s: forward_auth has invalid url '%s'", scope, f.URL)
+	}
+	if f.Timeout < 0 || f.CacheTTL < 0 {
+		return fmt.Errorf("%s: forward_auth timeout and cache_ttl can not be negative", scope)
+	}
+	if f.Timeout == 0 {
+		f.Timeout = auth.DefaultForwardTimeout
+	}
+	if len(f.RequestHeaders) == 0 {
+		f.RequestHeaders = slices.Clone(auth.DefaultForwardRequestHeaders)
+	}
+	for _, list := range [][]string{f.RequestHeaders, f.ResponseHeaders} {
+		for k, h := range list {
+			if h == "" || strings.ContainsAny(h, " :\t") {
+				return fmt.Errorf("%s: forward_auth has invalid header '%s'", scope, h)
+			}
+			list[k] = http.CanonicalHeaderKey(h)
+		}
+	}
+	return nil
+}
+
+// validateOIDC checks the provider and callback of an OIDC login and defaults its optional settings.
+// hosts are the URLs of the routes the login applies to, one of them must serve the callback.
+func validateOIDC(o *OIDC, hosts []string, scope string) error {
+	if o.Issuer == "" {
+		return nil
+	}
+	if parsed, err := url.Parse(o.Issuer); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("%s: oidc has invalid issuer '%s'", scope, o.Issuer)
+	}
+	if o.ClientID == "" {
+		return fmt.Errorf("%s: oidc client_id is required", scope)
+	}
+	if len(o.CookieSecret) < 32 {
+		return fmt.Errorf("%s: oidc cookie_secret must be at least 32 characters", scope)
+	}
+
+	redirectURL, err := url.Parse(o.RedirectURL)
+	if err != nil || (redirectURL.Scheme != "http" && redirectURL.Scheme != "https") || redirectURL.Host == "" || redirectURL.Path == "" {
+		return fmt.Errorf("%s: oidc has invalid redirect_url '%s'", scope, o.RedirectURL)
+	}
+	served := slices.ContainsFunc(hosts, func(host string) bool {
+		parsed, _ := url.Parse(host)
+		return parsed.Hostname() == redirectURL.Hostname() && strings.HasPrefix(redirectURL.Path, parsed.Path)
+	})
+	if !served {
+		return fmt.Errorf("%s: oidc redirect_url '%s' is not served by its hosts", scope, o.RedirectURL)
+	}
+
+	if o.LogoutPath != "" && !strings.HasPrefix(o.LogoutPath, "/") {
+		return fmt.Errorf("%s: oidc logout_path must start with /", scope)
+	}
+	if o.SessionLifetime < 0 {
+		return fmt.Errorf("%s: oidc session_lifetime can not be negative", scope)
+	}
+	if o.SessionLifetime == 0 {
+		o.SessionLifetime = oidc.DefaultSessionLifetime
+	}
+	if o.CookieName == "" {
+		o.CookieName = oidc.DefaultCookieName
+	}
+	if len(o.Scopes) == 0 {
+		o.Scopes = slices.Clone(oidc.DefaultScopes)
+	}
+	if !slices.Contains(o.Scopes, "openid") {
+		return fmt.Errorf("%s: oidc scopes must include openid", scope)
+	}
+	if o.GroupsClaim == "" {
+		o.GroupsClaim = oidc.DefaultGroupsClaim
+	}
+	if len(o.ForwardClaims) == 0 {
+		o.ForwardClaims = map[string]string{"sub": "X-Auth-User", "email": "X-Auth-Email"}
+	}
+	for claim, header := range o.ForwardClaims {
+		if header == "" || strings.ContainsAny(header, " :\t") {
+			return fmt.Errorf("%s: oidc forwards claim '%s' to invalid header '%s'", scope, claim, header)
+		}
+		o.ForwardClaims[claim] = http.CanonicalHeaderKey(header)
+	}
+	return nil
+}
+
+// validateErrorPages checks the status keys of error pages and that their templates parse
+func validateErrorPages(pages map[string]ErrorPage, scope string) error {
+	for key, page := range pages {
+		if key != errorpage.DefaultKey {
+			status, err := strconv.Atoi(key)
+			if err != nil || status < 400 || status > 599 {
+				return fmt.Errorf("%s: invalid key '%s', must be a 4xx/5xx status code or default", scope, key)
+			}
+		}
+		if page.HTML == "" && page.JSON == "" {
+			return fmt.Errorf("%s: page for '%s' has neither a html nor a json template", scope, key)
+		}
+		if _, err := errorpage.LoadPage(page.HTML, page.JSON); err != nil {
+			return fmt.Errorf("%s: page for '%s' can not be loaded: %v", scope, key, err)
+		}
+	}
+	return nil
+}
+
+// validateStatic checks the root directory of a static service and defaults its index files
+func validateStatic(st *Static, name string) error {
+	if st.Root == "" {
+		return fmt.Errorf("service '%s': static root is required", name)
+	}
+	info, err := os.Stat(st.Root)
+	if err != nil {
+		return fmt.Errorf("service '%s': static root: %v", name, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("service '%s': static root '%s' is not a directory", name, st.Root)
+	}
+	// Symlinks of served files are checked against the resolved root
+	if st.Root, err = filepath.EvalSymlinks(st.Root); err != nil {
+		return fmt.Errorf("service '%s': static root: %v", name, err)
+	}
+
+	if len(st.Index) == 0 {
+		st.Index = []string{static.DefaultIndex}
+	}
+	for _, index := range st.Index {
+		if index == "" || strings.ContainsAny(index, `/\`) || index == "." || index == ".." {
+			return fmt.Errorf("service '%s': invalid static index file '%s'", name, index)
+		}
+	}
+	return nil
+}
+
+// validateStream checks the upstreams of a stream service and defaults its settings
+func validateStream(svc *Service) error {
+	st := &svc.Stream
+	if st.Protocol == "" {
+		st.Protocol = stream.TCP
+	}
+	if st.Protocol != stream.TCP && st.Protocol != stream.UDP {
+		return fmt.Errorf("service '%s': invalid stream protocol '%s', can use tcp or udp", svc.Name, st.Protocol)
+	}
+	if st.ConnectTimeout < 0 || st.IdleTimeout < 0 {
+		return fmt.Errorf("service '%s': stream timeouts can not be negative", svc.Name)
+	}
+	if st.ConnectTimeout == 0 {
+		st.ConnectTimeout = stream.DefaultConnectTimeout
+	}
+	// UDP has no connection close, so sessions always end when idle
+	if st.Protocol == stream.UDP && st.IdleTimeout == 0 {
+		st.IdleTimeout = stream.DefaultUDPIdleTimeout
+	}
+
+	if len(svc.Hosts) != 0 {
+		return fmt.Errorf("Stream service %s can not have hosts, it listens on listen_port only", svc.Name)
+	}
+	if len(svc.Upstreams) == 0 {
+		return fmt.Errorf("No upstreams defined for service %s", svc.Name)
+	}
+
+	upstreamHosts := make(map[string]bool)
+	for j, upstream := range svc.Upstreams {
+		parsed, err := url.Parse(upstream.Host)
+		if err != nil || parsed.Scheme != st.Protocol || parsed.Port() == "" || (parsed.Path != "" && parsed.Path != "/") {
+			return fmt.Errorf("service '%s': upstream[%d] has invalid address '%s', must be like %s://host:port", svc.Name, j, upstream.Host, st.Protocol)
+		}
+		if upstreamHosts[parsed.Host] {
+			return fmt.Errorf("Duplicate upstream host %s found in service %s", upstream.Host, svc.Name)
+		}
+		upstreamHosts[parsed.Host] = true
+		svc.Upstreams[j].Host = parsed.Scheme + "://" + parsed.Host
+	}
+	return nil
+}
+
+// validateStreamPorts checks that stream services don't share a port with other services of the same protocol.
+// HTTP services use TCP ports.
+func validateStreamPorts(cfg *Config) error {
+	owners := make(map[string]string)
+	for _, service := range cfg.Services {
+		protocol := stream.TCP
+		if service.Type == ServiceStream {
+			protocol = service.Stream.Protocol
+		}
+		key := fmt.Sprintf("%s/%d", protocol, service.Port)
+		owner, used := owners[key]
+		if used && (service.Type == ServiceStream || owner != "") {
+			if owner == "" {
+				owner = "HTTP services"
+			}
+			return fmt.Errorf("Stream service %s can not share %s port %d with %s", service.Name, protocol, service.Port, owner)
+		}
+		if service.Type == ServiceStream {
+			owners[key] = "service " + service.Name
+		} else if !used {
+			owners[key] = ""
+		}
+	}
+	return nil
+}
+
+// validateRequestID checks the request ID settings and defaults the header and format
+func validateRequestID(rid *RequestID) error {
+	if rid.Header == "" {
+		rid.Header = requestid.DefaultHeader
+	}
+	rid.Header = http.CanonicalHeaderKey(rid.Header)
+	if strings.ContainsAny(rid.Header, " :\t") {
+		return fmt.Errorf("request_id: invalid header '%s'", rid.Header)
+	}
+
+	if rid.Format == "" {
+		rid.Format = requestid.FormatUUID
+	}
+	if rid.Format != requestid.FormatUUID && rid.Format != requestid.FormatULID {
+		return fmt.Errorf("request_id: invalid format '%s', can use uuid or ulid", rid.Format)
+	}
+
+	if _, err := ipfilter.ParseNetworks(rid.Trusted); err != nil {
+		return fmt.Errorf("request_id: trusted: %v", err)
+	}
+	return nil
+}
+
+// validateNormalization defaults the normalization level to normal
+func validateNormalization(n *Normalization) error {
+	if n.Level == "" {
+		n.Level = normalize.LevelNormal
+	}
+	if !normalize.ValidLevel(n.Level) {
+		return fmt.Errorf("normalization: invalid level '%s', can use off, normal or strict", n.Level)
+	}
+	return nil
+}
+
+// validateWAF checks the WAF settings and its rules file, defaulting the mode, body limit and tag header
+func validateWAF(w *WAF) error {
+	if w.Mode == "" {
+		w.Mode = waf.ModeBlock
+	}
+	if !validWAFMode(w.Mode) {
+		return fmt.Errorf("waf: invalid mode '%s', can use block, detect or off", w.Mode)
+	}
+	if w.BodyLimit < 0 {
+		return errors.New("waf: body_limit can not be negative")
+	}
+	if w.BodyLimit == 0 {
+		w.BodyLimit = waf.DefaultBodyLimit
+	}
+	if w.TagHeader == "" {
+		w.TagHeader = waf.DefaultTagHeader
+	}
+	w.TagHeader = http.CanonicalHeaderKey(w.TagHeader)
+	if strings.ContainsAny(w.TagHeader, " :\t") {
+		return fmt.Errorf("waf: invalid tag_header '%s'", w.TagHeader)
+	}
+
+	// The WAF is disabled without a rules file
+	if w.RulesFile == "" {
+		return nil
+	}
+	if _, err := waf.LoadRules(w.RulesFile); err != nil {
+		return fmt.Errorf("waf: %v", err)
+	}
+	return nil
+}
+
+func validWAFMode(mode string) bool {
+	return mode == waf.ModeBlock || mode == waf.ModeDetect || mode == waf.ModeOff
+}
@@ -0,0 +1,181 @@
+package cors
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RegexPrefix marks an allowed origin as a regular expression matched against the whole origin
+const RegexPrefix = "regex:"
+
+// Methods allowed when none are configured
+var DefaultMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+
+// Policy answers CORS preflights and decorates the responses of a route
+type Policy struct {
+	// Any origin is allowed
+	anyOrigin bool
+	origins   map[string]bool
+	patterns  []*regexp.Regexp
+
+	Methods []string
+
+	// Request headers allowed in preflights, nil allows the requested headers
+	Headers []string
+
+	ExposedHeaders []string
+	Credentials    bool
+	MaxAge         time.Duration
+}
+
+// New creates a policy. Origins are exact origins, * for any origin, wildcards like https://*.example.com
+// or regular expressions prefixed with regex:.
+func New(origins []string, methods []string, headers []string, exposed []string, credentials bool, maxAge time.Duration) (*Policy, error) {
+	p := &Policy{
+		origins:        make(map[string]bool),
+		Methods:        methods,
+		Headers:        headers,
+		ExposedHeaders: exposed,
+		Credentials:    credentials,
+		MaxAge:         maxAge,
+	}
+	for _, origin := range origins {
+		switch {
+		case origin == "*":
+			// Echoing every origin with credentials would let any site read the user's responses
+			if credentials {
+				return nil, errors.New("the * origin can't allow credentials, list the origins or patterns instead")
+			}
+			p.anyOrigin = true
+		case strings.HasPrefix(origin, RegexPrefix):
+			re, err := regexp.Compile("^(?:" + strings.TrimPrefix(origin, RegexPrefix) + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("invalid origin pattern '%s': %v", origin, err)
+			}
+			p.patterns = append(p.patterns, re)
+		case strings.Contains(origin, "*"):
+			// Each * stands for one or more DNS labels
+			pattern := strings.ReplaceAll(regexp.QuoteMeta(strings.ToLower(origin)), `\*`, `[a-z0-9-]+(?:\.[a-z0-9-]+)*`)
+			p.patterns = append(p.patterns, regexp.MustCompile("^"+pattern+"$"))
+		default:
+			p.origins[strings.ToLower(origin)] = true
+		}
+	}
+	return p, nil
+}
+
+// IsPreflight reports if a request is a CORS preflight rather than an actual OPTIONS request
+func IsPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions && r.Header.Get("Origin") != "" && r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// AllowedOrigin reports if an origin may read the responses of the route
+func (p *Policy) AllowedOrigin(origin string) bool {
+	if origin == "" {
+		return false
+	}
+	if p.anyOrigin {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	if p.origins[origin] {
+		return true
+	}
+	return slices.ContainsFunc(p.patterns, func(re *regexp.Regexp) bool { return re.MatchString(origin) })
+}
+
+// Preflight sets the headers answering a preflight, returns false if the origin, method or headers are not allowed
+func (p *Policy) Preflight(h http.Header, r *http.Request) bool {
+	h.Add("Vary", "Origin")
+	h.Add("Vary", "Access-Control-Request-Method")
+	h.Add("Vary", "Access-Control-Request-Headers")
+
+	origin := r.Header.Get("Origin")
+	if !p.AllowedOrigin(origin) {
+		return false
+	}
+	method := r.Header.Get("Access-Control-Request-Method")
+	if !slices.Contains(p.Methods, method) {
+		return false
+	}
+
+	var requested []string
+	for _, v := range r.Header.Values("Access-Control-Request-Headers") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				requested = append(requested, name)
+			}
+		}
+	}
+	if p.Headers != nil && !slices.Contains(p.Headers, "*") {
+		for _, name := range requested {
+			if !slices.ContainsFunc(p.Headers, func(allowed string) bool { return strings.EqualFold(allowed, name) }) {
+				return false
+			}
+		}
+	}
+
+	p.setOrigin(h, origin)
+	h.Set("Access-Control-Allow-Methods", strings.Join(p.Methods, ", "))
+	if len(requested) > 0 {
+		h.Set("Access-Control-Allow-Headers", strings.Join(requested, ", "))
+	}
+	if p.MaxAge > 0 {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(int(p.MaxAge.Seconds())))
+	}
+	return true
+}
+
+// Prepare removes the CORS headers an upstream set on a response and marks it as varying by Origin.
+// The policy's own headers are added per request with Decorate, so cached responses don't carry another origin's headers.
+func (p *Policy) Prepare(h http.Header) {
+	if p == nil {
+		return
+	}
+	for k := range h {
+		if strings.HasPrefix(k, "Access-Control-") {
+			delete(h, k)
+		}
+	}
+	for _, v := range h.Values("Vary") {
+		for _, field := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(field), "Origin") {
+				return
+			}
+		}
+	}
+	h.Add("Vary", "Origin")
+}
+
+// Decorate adds the CORS headers for the request's origin to a response, nothing for origins which are not allowed
+func (p *Policy) Decorate(h http.Header, r *http.Request) {
+	if p == nil {
+		return
+	}
+	origin := r.Header.Get("Origin")
+	if !p.AllowedOrigin(origin) {
+		return
+	}
+	p.setOrigin(h, origin)
+	if len(p.ExposedHeaders) > 0 {
+		h.Set("Access-Control-Expose-Headers", strings.Join(p.ExposedHeaders, ", "))
+	}
+}
+
+// setOrigin allows the origin, policies allowing any origin never allow credentials
+func (p *Policy) setOrigin(h http.Header, origin string) {
+	if p.anyOrigin {
+		h.Set("Access-Control-Allow-Origin", "*")
+		return
+	}
+	h.Set("Access-Control-Allow-Origin", origin)
+	if p.Credentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
@@ -0,0 +1,153 @@
+package errorpage
+
+import (
+	"bytes"
+	"encoding/json"
+	htmltemplate "html/template"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+
+	"github.com/kunalvirwal/minato/internal/utils"
+)
+
+// DefaultKey is the key of the page used for statuses without their own page
+const DefaultKey = "default"
+
+// Data is passed to error page templates
+type Data struct {
+	Status     int
+	StatusText string
+	Message    string
+	Service    string
+	Host       string
+	Path       string
+}
+
+// Page is an error page template with HTML and JSON variants, either can be nil
+type Page struct {
+	HTML *htmltemplate.Template
+	JSON *texttemplate.Template
+}
+
+// Pages are the error pages of a scope, falling back to the pages of the parent scope
+type Pages struct {
+	// Pages keyed by status code or DefaultKey
+	Pages  map[string]*Page
+	Parent *Pages
+}
+
+// LoadPage parses the HTML and JSON templates of a page, empty file names are skipped.
+// JSON templates can use {{json .Message}} to quote values.
+func LoadPage(htmlFile string, jsonFile string) (*Page, error) {
+	page := &Page{}
+	if htmlFile != "" {
+		content, err := os.ReadFile(htmlFile)
+		if err != nil {
+			return nil, err
+		}
+		if page.HTML, err = htmltemplate.New(htmlFile).Parse(string(content)); err != nil {
+			return nil, err
+		}
+	}
+	if jsonFile != "" {
+		content, err := os.ReadFile(jsonFile)
+		if err != nil {
+			return nil, err
+		}
+		funcs := texttemplate.FuncMap{"json": jsonString}
+		if page.JSON, err = texttemplate.New(jsonFile).Funcs(funcs).Parse(string(content)); err != nil {
+			return nil, err
+		}
+	}
+	return page, nil
+}
+
+// Has reports if a page is configured for the status in this scope or a parent scope
+func (p *Pages) Has(status int) bool {
+	for scope := p; scope != nil; scope = scope.Parent {
+		if _, ok := scope.Pages[strconv.Itoa(status)]; ok {
+			return true
+		}
+		if _, ok := scope.Pages[DefaultKey]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Write sends the error page for status, picking the JSON or HTML variant from the Accept header.
+// Without a matching page it falls back to a plain text error like http.Error.
+func (p *Pages) Write(w http.ResponseWriter, r *http.Request, status int, msg string, service string) {
+	data := Data{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Message:    msg,
+		Service:    service,
+		Host:       r.Host,
+		Path:       r.URL.Path,
+	}
+
+	wantsJSON := prefersJSON(r.Header.Get("Accept"))
+	for _, page := range p.lookup(status) {
+		var body bytes.Buffer
+		var contentType string
+		var err error
+
+		switch {
+		case page.JSON != nil && (wantsJSON || page.HTML == nil):
+			contentType = "application/json; charset=utf-8"
+			err = page.JSON.Execute(&body, data)
+		case page.HTML != nil:
+			contentType = "text/html; charset=utf-8"
+			err = page.HTML.Execute(&body, data)
+		default:
+			continue
+		}
+		if err != nil {
+			utils.LogRequestError(r, "Error rendering error page: "+err.Error())
+			break
+		}
+
+		w.Header().Del("Content-Length")
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(status)
+		w.Write(body.Bytes())
+		return
+	}
+
+	http.Error(w, msg, status)
+}
+
+// lookup lists the candidate pages for a status, most specific first
+func (p *Pages) lookup(status int) []*Page {
+	var pages []*Page
+	key := strconv.Itoa(status)
+	for scope := p; scope != nil; scope = scope.Parent {
+		if page, ok := scope.Pages[key]; ok {
+			pages = append(pages, page)
+		}
+		if page, ok := scope.Pages[DefaultKey]; ok {
+			pages = append(pages, page)
+		}
+	}
+	return pages
+}
+
+// prefersJSON reports if the client asked for JSON ahead of HTML
+func prefersJSON(accept string) bool {
+	jsonAt := strings.Index(accept, "json")
+	if jsonAt == -1 {
+		return false
+	}
+	htmlAt := strings.Index(accept, "html")
+	return htmlAt == -1 || jsonAt < htmlAt
+}
+
+func jsonString(v any) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
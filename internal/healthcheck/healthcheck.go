@@ -7,39 +7,66 @@ import (
 	"time"
 
 	"github.com/kunalvirwal/minato/internal/backend"
+	"github.com/kunalvirwal/minato/internal/config"
 	"github.com/kunalvirwal/minato/internal/state"
+	"github.com/kunalvirwal/minato/internal/stream"
 	"github.com/kunalvirwal/minato/internal/utils"
 )
 
 func StartHealthchecks() {
-	ticker := time.NewTicker(10 * time.Second)
+	interval := state.RuntimeCfg.Config.Load().HealthCheck.Interval
+	ticker := time.NewTicker(interval)
 
 	// Initial healthcheck run
-	state.RuntimeCfg.Mu.RLock()
-	for key, backend := range state.RuntimeCfg.BackendRegistry {
-		go runHealthCheck(key, backend)
-	}
-	state.RuntimeCfg.Mu.RUnlock()
+	runHealthChecks()
 
 	// Periodic healthcheck runs
 	for range ticker.C {
-		state.RuntimeCfg.Mu.RLock()
-		for key, backend := range state.RuntimeCfg.BackendRegistry {
-			go runHealthCheck(key, backend)
+		runHealthChecks()
+
+		// Pick up interval changes from config reloads
+		if latest := state.RuntimeCfg.Config.Load().HealthCheck.Interval; latest != interval {
+			interval = latest
+			ticker.Reset(interval)
 		}
-		state.RuntimeCfg.Mu.RUnlock()
 	}
 
 }
 
-func runHealthCheck(key state.BackendKey, backend *backend.Backend) {
+// runHealthChecks checks every registered backend concurrently
+func runHealthChecks() {
+	settings := state.RuntimeCfg.Config.Load().HealthCheck
+
+	state.RuntimeCfg.Mu.RLock()
+	for key, backend := range state.RuntimeCfg.BackendRegistry {
+		go runHealthCheck(key, backend, settings)
+	}
+	state.RuntimeCfg.Mu.RUnlock()
+}
+
+func runHealthCheck(key state.BackendKey, backend *backend.Backend, settings config.HealthCheck) {
+	// UDP has no handshake to check, so UDP upstreams are always considered healthy
+	if key.Protocol == stream.UDP {
+		return
+	}
+
 	// Fast TCP check
-	TCPconnectionTimeout := 1 * time.Second
-	HTTPconnectionTimeout := 5 * time.Second
-	health_url := "http://" + backend.Address() + key.Health_uri
+	TCPconnectionTimeout := settings.TCPTimeout
+	HTTPconnectionTimeout := settings.HTTPTimeout
+
+	// Stream upstreams have no proxy and no health endpoint, unix socket upstreams are dialed at their socket path
+	network, address := "tcp", backend.Config.URL.Host
+	health_url := ""
+	if key.Protocol == "" {
+		health_url = "http://" + backend.Address() + key.Health_uri
+		if socketPath := backend.Config.Proxy.SocketPath; socketPath != "" {
+			network, address = "unix", socketPath
+			health_url = "http://localhost" + key.Health_uri
+		}
+	}
 
 	// TCP test happens to host:port, it is a layer 4 protocol so it doesn't need http
-	conn, err := net.DialTimeout("tcp", backend.Config.URL.Host, TCPconnectionTimeout)
+	conn, err := net.DialTimeout(network, address, TCPconnectionTimeout)
 	if err != nil {
 		if backend.IsAlive() {
 			// utils.LogCustom(utils.Red, "Healthcheck-test", fmt.Sprintf("TCP Healthcheck failed on %v", key.Address))
@@ -50,22 +77,27 @@ func runHealthCheck(key state.BackendKey, backend *backend.Backend) {
 	}
 	conn.Close()
 
-	// HTTP health endpoint test
-	client := &http.Client{
-		Timeout: HTTPconnectionTimeout,
-	}
-	res, err := client.Get(health_url)
-	if err != nil || res.StatusCode != http.StatusOK {
-		// utils.LogCustom(utils.Red, "Healthcheck-test", fmt.Sprintf("HTTP Healthcheck failed on %v", key.Address))
-		if backend.IsAlive() {
-			backend.SetHealth(false)
-			utils.LogCustom(utils.Red, "Healthcheck", fmt.Sprintf("%v failing healthchecks", key.Address))
+	// HTTP health endpoint test, stream upstreams only get the TCP check
+	if key.Protocol == "" {
+		client := &http.Client{
+			Timeout: HTTPconnectionTimeout,
 		}
-		return
+		// The upstream's own transport knows how to reach its socket
+		if backend.Config.Proxy.SocketPath != "" {
+			client.Transport = backend.Config.Proxy.Transport
+		}
+		res, err := client.Get(health_url)
+		if err != nil || res.StatusCode != http.StatusOK {
+			// utils.LogCustom(utils.Red, "Healthcheck-test", fmt.Sprintf("HTTP Healthcheck failed on %v", key.Address))
+			if backend.IsAlive() {
+				backend.SetHealth(false)
+				utils.LogCustom(utils.Red, "Healthcheck", fmt.Sprintf("%v failing healthchecks", key.Address))
+			}
+			return
+		}
+		res.Body.Close()
 	}
 
-	defer res.Body.Close()
-
 	if !backend.IsAlive() {
 		backend.SetHealth(true)
 		utils.LogCustom(utils.Green, "Healthcheck", fmt.Sprintf("%v is now online", key.Address))
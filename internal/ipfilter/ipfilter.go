@@ -0,0 +1,212 @@
+package ipfilter
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+type ctxKey struct{}
+
+type trustedKey struct{}
+
+// Trie is a binary prefix trie of networks, matching an IP costs at most one step per address bit.
+// IPv4 networks are stored as IPv4-mapped IPv6 networks.
+type Trie struct {
+	root node
+	size int
+}
+
+type node struct {
+	child [2]*node
+
+	// A network ends here, so it covers everything below
+	end bool
+}
+
+// NewTrie builds a trie of networks
+func NewTrie(networks []*net.IPNet) *Trie {
+	t := &Trie{}
+	for _, n := range networks {
+		t.Insert(n)
+	}
+	return t
+}
+
+// Insert adds a network to the trie
+func (t *Trie) Insert(n *net.IPNet) {
+	ip := n.IP.To16()
+	ones, bits := n.Mask.Size()
+	if bits == 32 {
+		ones += 96
+	}
+
+	cur := &t.root
+	for i := 0; i < ones; i++ {
+		// Already covered by a shorter prefix
+		if cur.end {
+			return
+		}
+		b := bit(ip, i)
+		if cur.child[b] == nil {
+			cur.child[b] = &node{}
+		}
+		cur = cur.child[b]
+	}
+	cur.end = true
+	// Longer prefixes below are covered by this one now
+	cur.child = [2]*node{}
+	t.size++
+}
+
+// Contains reports if ip is in any network of the trie, a nil trie contains nothing
+func (t *Trie) Contains(ip net.IP) bool {
+	if t == nil {
+		return false
+	}
+	ip = ip.To16()
+	if ip == nil {
+		return false
+	}
+	cur := &t.root
+	for i := 0; i < 128; i++ {
+		if cur.end {
+			return true
+		}
+		cur = cur.child[bit(ip, i)]
+		if cur == nil {
+			return false
+		}
+	}
+	return cur.end
+}
+
+// Empty reports if the trie has no networks
+func (t *Trie) Empty() bool {
+	return t == nil || t.size == 0
+}
+
+func bit(ip net.IP, i int) byte {
+	return ip[i/8] >> (7 - i%8) & 1
+}
+
+// Filter allows or denies clients by IP. Deny wins over allow, and a non empty allow list denies everyone else.
+type Filter struct {
+	Allow *Trie
+	Deny  *Trie
+}
+
+// Allowed reports if the filter lets ip through, a nil filter allows everyone
+func (f *Filter) Allowed(ip net.IP) bool {
+	if f == nil {
+		return true
+	}
+	// Clients without an IP, like on unix sockets, can only be let through by the absence of an allow list
+	if ip == nil {
+		return f.Allow.Empty()
+	}
+	if f.Deny.Contains(ip) {
+		return false
+	}
+	return f.Allow.Empty() || f.Allow.Contains(ip)
+}
+
+// ParseNetworks parses IPs and CIDRs, single IPs match only themselves
+func ParseNetworks(entries []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP '%s'", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR '%s'", entry)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// LoadList parses the inline entries and the entries of a list file, which has one IP or CIDR per line.
+// Blank lines and text after # are ignored.
+func LoadList(entries []string, file string) ([]*net.IPNet, error) {
+	all := entries
+	if file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line, _, _ := strings.Cut(scanner.Text(), "#")
+			if line = strings.TrimSpace(line); line != "" {
+				all = append(all, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return ParseNetworks(all)
+}
+
+// ResolveClientIP finds the real client IP of a request and attaches it to the request's context, along with
+// whether the peer is a trusted proxy. When it is, X-Forwarded-For is read from the right and the first untrusted
+// address is the client.
+func ResolveClientIP(r *http.Request, trusted *Trie) *http.Request {
+	ip := peerIP(r)
+	fromProxy := ip != nil && trusted.Contains(ip)
+	if fromProxy {
+		xff := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+		for i := len(xff) - 1; i >= 0; i-- {
+			hop := net.ParseIP(strings.TrimSpace(xff[i]))
+			if hop == nil {
+				break
+			}
+			ip = hop
+			if !trusted.Contains(hop) {
+				break
+			}
+		}
+	}
+	ctx := context.WithValue(r.Context(), ctxKey{}, ip)
+	return r.WithContext(context.WithValue(ctx, trustedKey{}, fromProxy))
+}
+
+// FromTrustedProxy reports if the request came from a trusted proxy, whose X-Forwarded-* headers can be believed
+func FromTrustedProxy(r *http.Request) bool {
+	trusted, _ := r.Context().Value(trustedKey{}).(bool)
+	return trusted
+}
+
+// ClientIP returns the client IP resolved for a request, falling back to the peer's IP
+func ClientIP(r *http.Request) net.IP {
+	if ip, ok := r.Context().Value(ctxKey{}).(net.IP); ok {
+		return ip
+	}
+	return peerIP(r)
+}
+
+// peerIP returns the IP of the connection's remote end, nil for unix sockets
+func peerIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
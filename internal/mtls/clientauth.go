@@ -0,0 +1,144 @@
+package mtls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Client certificate modes
+const (
+	ModeNone     = "none"
+	ModeOptional = "optional"
+	ModeRequire  = "require"
+)
+
+// ClientAuth verifies client certificates against a CA bundle, and against a CRL if one is given
+type ClientAuth struct {
+	Mode string
+	CAs  *x509.CertPool
+
+	// Serial numbers of revoked certificates by the raw subject of their issuer
+	revoked map[string]map[string]bool
+}
+
+// ValidMode reports if a client certificate mode exists
+func ValidMode(mode string) bool {
+	return mode == ModeNone || mode == ModeOptional || mode == ModeRequire
+}
+
+// LoadClientAuth loads the CA bundle and CRL file of a mode, returns nil for ModeNone
+func LoadClientAuth(mode string, caFile string, crlFile string) (*ClientAuth, error) {
+	if mode == ModeNone {
+		return nil, nil
+	}
+	if !ValidMode(mode) {
+		return nil, fmt.Errorf("invalid mode '%s', can use none, optional or require", mode)
+	}
+	if caFile == "" {
+		return nil, errors.New("no ca_file defined")
+	}
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	var cas []*x509.Certificate
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", caFile, err)
+		}
+		cas = append(cas, cert)
+	}
+	if len(cas) == 0 {
+		return nil, fmt.Errorf("%s: no certificates found", caFile)
+	}
+
+	a := &ClientAuth{Mode: mode, CAs: x509.NewCertPool(), revoked: make(map[string]map[string]bool)}
+	for _, ca := range cas {
+		a.CAs.AddCert(ca)
+	}
+	if crlFile != "" {
+		if err := a.loadCRL(crlFile, cas); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// loadCRL reads the revocation lists of a file, each must be signed by one of the CAs
+func (a *ClientAuth) loadCRL(file string, cas []*x509.Certificate) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var lists [][]byte
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "X509 CRL" {
+			lists = append(lists, block.Bytes)
+		}
+	}
+	// A file without PEM blocks holds a single DER encoded list
+	if len(lists) == 0 {
+		lists = append(lists, data)
+	}
+
+	for _, der := range lists {
+		crl, err := x509.ParseRevocationList(der)
+		if err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+		signed := false
+		for _, ca := range cas {
+			if string(ca.RawSubject) == string(crl.RawIssuer) && crl.CheckSignatureFrom(ca) == nil {
+				signed = true
+				break
+			}
+		}
+		if !signed {
+			return fmt.Errorf("%s: revocation list of '%s' is not signed by a CA of the bundle", file, crl.Issuer)
+		}
+		serials := a.revoked[string(crl.RawIssuer)]
+		if serials == nil {
+			serials = make(map[string]bool)
+			a.revoked[string(crl.RawIssuer)] = serials
+		}
+		for _, entry := range crl.RevokedCertificateEntries {
+			serials[entry.SerialNumber.String()] = true
+		}
+	}
+	return nil
+}
+
+// apply sets up the client certificate verification of a TLS config
+func (a *ClientAuth) apply(cfg *tls.Config) {
+	if a == nil {
+		return
+	}
+	cfg.ClientCAs = a.CAs
+	cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	if a.Mode == ModeRequire {
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	if len(a.revoked) > 0 {
+		cfg.VerifyConnection = a.checkRevoked
+	}
+}
+
+// checkRevoked fails handshakes of clients whose certificate, or an intermediate of it, is revoked
+func (a *ClientAuth) checkRevoked(cs tls.ConnectionState) error {
+	for _, chain := range cs.VerifiedChains {
+		for _, cert := range chain {
+			if a.revoked[string(cert.RawIssuer)][cert.SerialNumber.String()] {
+				return fmt.Errorf("client certificate '%s' is revoked", cert.Subject)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package mtls
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+)
+
+// Listener holds the TLS settings of a listener. Handshakes look them up in the latest config,
+// so certificates, CA bundles and CRLs are reloaded without restarting the listener.
+type Listener struct {
+	// Client certificate verification of the listener, nil if it asks for no certificates
+	ClientAuth *ClientAuth
+
+	// Client certificate verification by server name, replacing the listener's
+	Hosts map[string]*ClientAuth
+
+	configs map[*ClientAuth]*tls.Config
+}
+
+// NewListener loads the certificate of a listener and prepares the TLS config of every client certificate setting
+func NewListener(certFile string, keyFile string, clientAuth *ClientAuth, hosts map[string]*ClientAuth) (*Listener, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	l := &Listener{ClientAuth: clientAuth, Hosts: make(map[string]*ClientAuth), configs: make(map[*ClientAuth]*tls.Config)}
+	for name, a := range hosts {
+		l.Hosts[strings.ToLower(name)] = a
+	}
+	l.addConfig(cert, clientAuth)
+	for _, a := range l.Hosts {
+		l.addConfig(cert, a)
+	}
+	return l, nil
+}
+
+// addConfig prepares the TLS config used for a client certificate setting
+func (l *Listener) addConfig(cert tls.Certificate, a *ClientAuth) {
+	if _, ok := l.configs[a]; ok {
+		return
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+	a.apply(cfg)
+	l.configs[a] = cfg
+}
+
+// clientAuthFor returns the client certificate verification of a server name
+func (l *Listener) clientAuthFor(name string) *ClientAuth {
+	if a, ok := l.Hosts[strings.ToLower(strings.TrimSuffix(name, "."))]; ok {
+		return a
+	}
+	return l.ClientAuth
+}
+
+// ConfigForClient returns the TLS config for the server name a client asks for
+func (l *Listener) ConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	return l.configs[l.clientAuthFor(hello.ServerName)], nil
+}
+
+// SameClientAuth reports if a request for host may be served on a connection set up for serverName.
+// Otherwise a client could pass the handshake of a host without client certificates and then ask for another host.
+func (l *Listener) SameClientAuth(serverName string, host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return l.clientAuthFor(serverName) == l.clientAuthFor(host)
+}
@@ -0,0 +1,175 @@
+package mtls
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// RegexPrefix marks an allowed subject or SAN as a regular expression matched against the whole value
+const RegexPrefix = "regex:"
+
+var (
+	ErrNoCertificate = errors.New("no verified client certificate")
+	ErrNotAllowed    = errors.New("client certificate is not allowed")
+)
+
+// Headers name the request headers carrying the details of the client certificate upstream, empty names are not sent
+type Headers struct {
+	Subject     string
+	SANs        string
+	Fingerprint string
+
+	// URL encoded PEM of the certificate
+	PEM string
+}
+
+// Policy authorizes the requests of a route by their verified client certificate and forwards its details
+type Policy struct {
+	subjects *matcher
+	sans     *matcher
+
+	Headers Headers
+
+	// Responses may be cached although they can differ per client certificate
+	AllowCache bool
+}
+
+// NewPolicy creates a policy. Subjects are written like CN=partner,O=Partner Inc and SANs with their type like
+// DNS:api.example.com, URI:spiffe://example.com/partner, IP:10.0.0.1 or email:ops@example.com.
+// A certificate is allowed if it matches any subject or any SAN, without either every verified certificate is allowed.
+func NewPolicy(subjects []string, sans []string, headers Headers, allowCache bool) (*Policy, error) {
+	p := &Policy{Headers: headers, AllowCache: allowCache}
+	var err error
+	if p.subjects, err = newMatcher(subjects); err != nil {
+		return nil, fmt.Errorf("allowed_subjects: %v", err)
+	}
+	if p.sans, err = newMatcher(sans); err != nil {
+		return nil, fmt.Errorf("allowed_sans: %v", err)
+	}
+	return p, nil
+}
+
+// Authorize checks the verified client certificate of a request against the allowed subjects and SANs
+func (p *Policy) Authorize(r *http.Request) error {
+	if p.subjects == nil && p.sans == nil {
+		return nil
+	}
+	cert := Certificate(r)
+	if cert == nil {
+		return ErrNoCertificate
+	}
+	if p.subjects.match(cert.Subject.String()) {
+		return nil
+	}
+	for _, san := range SANs(cert) {
+		if p.sans.match(san) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrNotAllowed, cert.Subject)
+}
+
+// Forward replaces the certificate headers of a request with the details of its verified client certificate
+func (p *Policy) Forward(r *http.Request) {
+	h := p.Headers
+	for _, name := range []string{h.Subject, h.SANs, h.Fingerprint, h.PEM} {
+		if name != "" {
+			r.Header.Del(name)
+		}
+	}
+	cert := Certificate(r)
+	if cert == nil {
+		return
+	}
+	set := func(name string, value string) {
+		// Names in certificates can hold anything, values which would break the header are left out
+		if name != "" && value != "" && !strings.ContainsAny(value, "\r\n") {
+			r.Header.Set(name, value)
+		}
+	}
+	set(h.Subject, cert.Subject.String())
+	set(h.SANs, strings.Join(SANs(cert), ","))
+	if h.Fingerprint != "" {
+		sum := sha256.Sum256(cert.Raw)
+		set(h.Fingerprint, hex.EncodeToString(sum[:]))
+	}
+	if h.PEM != "" {
+		block := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+		set(h.PEM, url.QueryEscape(string(block)))
+	}
+}
+
+// Certificate returns the verified client certificate of a request, nil if it has none
+func Certificate(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// SANs returns the subject alternative names of a certificate prefixed with their type
+func SANs(cert *x509.Certificate) []string {
+	var sans []string
+	for _, name := range cert.DNSNames {
+		sans = append(sans, "DNS:"+name)
+	}
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, "IP:"+ip.String())
+	}
+	for _, email := range cert.EmailAddresses {
+		sans = append(sans, "email:"+email)
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, "URI:"+uri.String())
+	}
+	return sans
+}
+
+// matcher matches values exactly or against regular expressions
+type matcher struct {
+	exact    map[string]bool
+	patterns []*regexp.Regexp
+}
+
+// newMatcher returns nil if there are no values
+func newMatcher(values []string) (*matcher, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	m := &matcher{exact: make(map[string]bool)}
+	for _, v := range values {
+		if !strings.HasPrefix(v, RegexPrefix) {
+			m.exact[v] = true
+			continue
+		}
+		re, err := regexp.Compile("^(?:" + strings.TrimPrefix(v, RegexPrefix) + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern '%s': %v", v, err)
+		}
+		m.patterns = append(m.patterns, re)
+	}
+	return m, nil
+}
+
+func (m *matcher) match(v string) bool {
+	if m == nil {
+		return false
+	}
+	if m.exact[v] {
+		return true
+	}
+	for _, re := range m.patterns {
+		if re.MatchString(v) {
+			return true
+		}
+	}
+	return false
+}
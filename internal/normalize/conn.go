@@ -0,0 +1,379 @@
+package normalize
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/kunalvirwal/minato/internal/utils"
+)
+
+// Header blocks larger than this are left for the HTTP server to reject
+const maxHeaderBlock = 1<<20 + 4096
+
+// Longest chunk size or trailer line checked
+const maxChunkLine = 4096
+
+// Sent to the HTTP server in place of a rejected request, it answers it with a 400 and closes the connection.
+// The connection isn't ended right away, as the server would take that for the client leaving and cancel the requests before.
+var rejectedRequest = []byte("rejected\r\n\r\n")
+
+// What the connection is reading
+const (
+	stateHead = iota
+	stateBody
+	stateChunkSize
+	stateChunkData
+	stateChunkEnd
+	stateTrailer
+	// Bytes are passed on unchecked once the framing can't be followed
+	statePass
+	// Bytes after a rejected request are dropped
+	stateDiscard
+)
+
+// Listener checks the header block of every request on its connections before the HTTP server parses it.
+// The server drops Content-Length when Transfer-Encoding is set and folds obsolete line folding silently,
+// so ambiguous requests can only be told apart in their raw form.
+type Listener struct {
+	net.Listener
+
+	// Returns the current level, read for every new connection
+	Level func() string
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	level := l.Level()
+	if level == LevelOff {
+		return c, nil
+	}
+	return &conn{Conn: c, strict: level == LevelStrict}, nil
+}
+
+// conn follows the framing of the requests it reads, so it knows where every header block starts
+type conn struct {
+	net.Conn
+	strict bool
+
+	state int
+
+	// Bytes of the body or chunk left to read
+	remaining int64
+
+	// Bytes checked and ready for the server
+	ready []byte
+
+	// Header block or line being received, and where its last line starts
+	pending   []byte
+	lineStart int
+
+	buf [4096]byte
+	err error
+}
+
+func (c *conn) Read(p []byte) (int, error) {
+	for len(c.ready) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+		n, err := c.Conn.Read(c.buf[:])
+		c.feed(c.buf[:n])
+		if err != nil {
+			// Deadlines are used by the server to interrupt reads, so the state is kept for the next read
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				if len(c.ready) > 0 {
+					break
+				}
+				return 0, err
+			}
+			// Whatever is left is handed over for the server to deal with
+			c.ready = append(c.ready, c.pending...)
+			c.pending = nil
+			if c.err == nil {
+				c.err = err
+			}
+		}
+	}
+	n := copy(p, c.ready)
+	c.ready = c.ready[n:]
+	return n, nil
+}
+
+// ReadFrom lets responses use the sendfile support of the underlying connection
+func (c *conn) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(c.Conn, r)
+}
+
+// CloseWrite lets the server close its side of the connection gracefully
+func (c *conn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// feed moves read bytes through the framing, header blocks are held back until they are checked
+func (c *conn) feed(b []byte) {
+	for len(b) > 0 && c.err == nil {
+		switch c.state {
+		case statePass:
+			c.ready = append(c.ready, b...)
+			return
+		case stateDiscard:
+			return
+		case stateBody, stateChunkData:
+			n := min(int64(len(b)), c.remaining)
+			c.ready = append(c.ready, b[:n]...)
+			b = b[n:]
+			c.remaining -= n
+			if c.remaining == 0 {
+				if c.state == stateBody {
+					c.state = stateHead
+				} else {
+					c.state = stateChunkEnd
+				}
+			}
+		default:
+			i := bytes.IndexByte(b, '\n')
+			if i < 0 {
+				c.pending = append(c.pending, b...)
+				b = nil
+			} else {
+				c.pending = append(c.pending, b[:i+1]...)
+				b = b[i+1:]
+				c.line()
+			}
+			limit := maxChunkLine
+			if c.state == stateHead {
+				limit = maxHeaderBlock
+			}
+			if len(c.pending) > limit {
+				c.ready = append(c.ready, c.pending...)
+				c.pending, c.lineStart = nil, 0
+				c.state = statePass
+			}
+		}
+	}
+}
+
+// line handles the line completed at the end of pending
+func (c *conn) line() {
+	line := c.pending[c.lineStart:]
+	empty := len(line) == 1 || (len(line) == 2 && line[0] == '\r')
+
+	switch c.state {
+	case stateHead:
+		if !empty {
+			c.lineStart = len(c.pending)
+			return
+		}
+		if c.lineStart == 0 {
+			// Empty lines before a request line are left for the server
+			c.release()
+			return
+		}
+		c.head()
+	case stateChunkSize:
+		size, ok := chunkSize(line, c.strict)
+		if !ok {
+			c.fail(ReasonChunked)
+			return
+		}
+		c.release()
+		if size == 0 {
+			c.state = stateTrailer
+		} else {
+			c.state, c.remaining = stateChunkData, size
+		}
+	case stateChunkEnd:
+		if !empty || (c.strict && len(line) == 1) {
+			c.fail(ReasonChunked)
+			return
+		}
+		c.release()
+		c.state = stateChunkSize
+	case stateTrailer:
+		c.release()
+		if empty {
+			c.state = stateHead
+		}
+	}
+}
+
+// release hands the pending bytes over to the server
+func (c *conn) release() {
+	c.ready = append(c.ready, c.pending...)
+	c.pending, c.lineStart = c.pending[:0], 0
+}
+
+// head checks a complete header block and follows the framing of its body
+func (c *conn) head() {
+	h, reason := parseHead(c.pending, c.strict)
+	if reason != "" {
+		e := reject(reason)
+		utils.LogNewError(fmt.Sprintf("Rejected request from %v: %v", c.RemoteAddr(), e))
+		c.ready = append(c.ready, rejectedRequest...)
+		c.pending = nil
+		c.state = stateDiscard
+		return
+	}
+	c.release()
+	switch {
+	case h.chunked:
+		c.state = stateChunkSize
+	case h.length > 0:
+		c.state, c.remaining = stateBody, h.length
+	}
+}
+
+// fail ends a connection whose body framing is broken, the server sees a read error
+func (c *conn) fail(reason string) {
+	e := reject(reason)
+	utils.LogNewError(fmt.Sprintf("Rejected request from %v: %v", c.RemoteAddr(), e))
+	c.pending = nil
+	c.err = e
+}
+
+// head is the framing of a request.
+// Minato never switches protocols, the server answers upgrade and CONNECT requests like any other
+// and keeps reading requests after them, so their framing is followed too.
+type head struct {
+	chunked bool
+	length  int64
+}
+
+// parseHead checks the header block of a request, it ends with its empty line
+func parseHead(block []byte, strict bool) (head, string) {
+	var h head
+	var hosts int
+	var lengths, encodings []string
+	http11, connect := false, false
+
+	for first := true; len(block) > 0; first = false {
+		i := bytes.IndexByte(block, '\n')
+		line := block[:i]
+		block = block[i+1:]
+		if len(line) > 0 && line[len(line)-1] == '\r' {
+			line = line[:len(line)-1]
+		} else if strict {
+			return h, ReasonBareLF
+		}
+
+		if first {
+			// Malformed request lines are left for the server to reject
+			fields := strings.Fields(string(line))
+			if len(fields) == 3 {
+				http11 = fields[2] != "HTTP/1.0" && strings.HasPrefix(fields[2], "HTTP/1.")
+				connect = fields[0] == "CONNECT"
+			}
+			continue
+		}
+		if len(line) == 0 {
+			break
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			if strict {
+				return h, ReasonLineFolding
+			}
+			if !validValue(line) {
+				return h, ReasonHeaderValue
+			}
+			continue
+		}
+
+		colon := bytes.IndexByte(line, ':')
+		if colon <= 0 || !validToken(line[:colon]) {
+			return h, ReasonHeaderName
+		}
+		value := bytes.Trim(line[colon+1:], " \t")
+		if !validValue(value) {
+			return h, ReasonHeaderValue
+		}
+		switch strings.ToLower(string(line[:colon])) {
+		case "host":
+			hosts++
+		case "content-length":
+			lengths = append(lengths, string(value))
+		case "transfer-encoding":
+			encodings = append(encodings, string(value))
+		}
+	}
+
+	if hosts > 1 {
+		return h, ReasonDuplicateHost
+	}
+	if hosts == 0 && http11 && !connect {
+		return h, ReasonMissingHost
+	}
+
+	if len(encodings) > 0 {
+		if len(lengths) > 0 {
+			return h, ReasonLengthAndEncoding
+		}
+		// HTTP/1.0 has no chunked encoding, the server ignores the header there
+		if len(encodings) > 1 || !strings.EqualFold(encodings[0], "chunked") || (strict && !http11) {
+			return h, ReasonTransferEncoding
+		}
+		h.chunked = http11
+		return h, ""
+	}
+
+	for k, v := range lengths {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 || v[0] == '+' || (k > 0 && v != lengths[0]) || (strict && k > 0) {
+			return h, ReasonContentLength
+		}
+		h.length = n
+	}
+	return h, ""
+}
+
+// chunkSize parses a chunk size line, extensions after ; are ignored
+func chunkSize(line []byte, strict bool) (int64, bool) {
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		if strict {
+			return 0, false
+		}
+		line = line[:len(line)-1]
+	} else {
+		line = line[:len(line)-2]
+	}
+	if i := bytes.IndexByte(line, ';'); i >= 0 {
+		line = line[:i]
+	}
+	line = bytes.TrimRight(line, " \t")
+	if len(line) == 0 || len(line) > 16 {
+		return 0, false
+	}
+	size, err := strconv.ParseUint(string(line), 16, 63)
+	return int64(size), err == nil
+}
+
+// validToken reports if a header name only has token characters
+func validToken(b []byte) bool {
+	for _, ch := range b {
+		if ch <= ' ' || ch >= 0x7f || strings.IndexByte(`"(),/:;<=>?@[\]{}`, ch) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// validValue reports if a header value has no control characters other than tabs
+func validValue(b []byte) bool {
+	for _, ch := range b {
+		if (ch < ' ' && ch != '\t') || ch == 0x7f {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,99 @@
+package normalize
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// rawConn is a connection whose client sent data and closed its side
+type rawConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *rawConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+func (c *rawConn) RemoteAddr() net.Addr       { return &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4000} }
+
+// serverView returns the bytes the HTTP server reads from a connection that received data
+func serverView(t *testing.T, data string, strict bool) string {
+	t.Helper()
+	c := &conn{Conn: &rawConn{r: strings.NewReader(data)}, strict: strict}
+	got, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatalf("reading connection: %v", err)
+	}
+	return string(got)
+}
+
+func TestPipelinedAfterUpgrade(t *testing.T) {
+	first := "GET / HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: x\r\n\r\n"
+	smuggled := "POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 4\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n"
+
+	got := serverView(t, first+smuggled, false)
+	if want := first + string(rejectedRequest); got != want {
+		t.Fatalf("server reads %q, want %q", got, want)
+	}
+}
+
+func TestPipelinedAfterConnect(t *testing.T) {
+	first := "CONNECT example.com:443 HTTP/1.1\r\n\r\n"
+	smuggled := "GET / HTTP/1.1\r\nHost: example.com\r\nHost: other.example.com\r\n\r\n"
+
+	got := serverView(t, first+smuggled, false)
+	if want := first + string(rejectedRequest); got != want {
+		t.Fatalf("server reads %q, want %q", got, want)
+	}
+}
+
+func TestPipelinedAfterBody(t *testing.T) {
+	// The body looks like a request with both headers, it must be passed on as a body
+	body := "GET / HTTP/1.1\r\nContent-Length: 1\r\nTransfer-Encoding: chunked\r\n\r\n"
+	first := "POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body
+	second := "GET /next HTTP/1.1\r\nHost: example.com\r\n\r\n"
+
+	got := serverView(t, first+second, false)
+	if got != first+second {
+		t.Fatalf("server reads %q, want %q", got, first+second)
+	}
+}
+
+func TestRejectedHeads(t *testing.T) {
+	tests := []struct {
+		name   string
+		head   string
+		strict bool
+	}{
+		{"length and encoding", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 3\r\nTransfer-Encoding: chunked\r\n\r\n", false},
+		{"differing lengths", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 3\r\nContent-Length: 4\r\n\r\n", false},
+		{"repeated length", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 3\r\nContent-Length: 3\r\n\r\n", true},
+		{"unknown encoding", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: gzip\r\n\r\n", false},
+		{"duplicate host", "GET / HTTP/1.1\r\nHost: a\r\nHost: b\r\n\r\n", false},
+		{"missing host", "GET / HTTP/1.1\r\n\r\n", false},
+		{"line folding", "GET / HTTP/1.1\r\nHost: a\r\nX-A: b\r\n c\r\n\r\n", true},
+		{"bare LF", "GET / HTTP/1.1\nHost: a\n\n", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := serverView(t, tt.head+"abc", tt.strict)
+			if got != string(rejectedRequest) {
+				t.Fatalf("server reads %q, want the request rejected", got)
+			}
+		})
+	}
+}
+
+func TestBrokenChunks(t *testing.T) {
+	data := "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\n"
+	c := &conn{Conn: &rawConn{r: strings.NewReader(data)}}
+	got, err := io.ReadAll(c)
+	if err == nil {
+		t.Fatal("broken chunk size was read without error")
+	}
+	if bytes.Contains(got, []byte("zz")) {
+		t.Fatalf("server reads the broken chunk: %q", got)
+	}
+}
@@ -0,0 +1,74 @@
+package normalize
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// Levels of strictness
+const (
+	// Requests are passed on as the HTTP server parsed them
+	LevelOff = "off"
+
+	// Ambiguous framing and malformed headers are rejected, paths are normalized
+	LevelNormal = "normal"
+
+	// Obsolete syntax which some servers still accept is rejected too
+	LevelStrict = "strict"
+)
+
+// Reasons requests are rejected for
+const (
+	ReasonLengthAndEncoding = "content_length_with_transfer_encoding"
+	ReasonContentLength     = "invalid_content_length"
+	ReasonTransferEncoding  = "invalid_transfer_encoding"
+	ReasonChunked           = "invalid_chunked_encoding"
+	ReasonDuplicateHost     = "duplicate_host"
+	ReasonMissingHost       = "missing_host"
+	ReasonHeaderName        = "invalid_header_name"
+	ReasonHeaderValue       = "invalid_header_value"
+	ReasonLineFolding       = "obsolete_line_folding"
+	ReasonBareLF            = "bare_lf"
+	ReasonPercentEncoding   = "invalid_percent_encoding"
+	ReasonPathCharacters    = "invalid_path_characters"
+	ReasonEncodedSlash      = "encoded_slash"
+)
+
+// Rejections counted per reason since the start
+var counters = map[string]*atomic.Uint64{
+	ReasonLengthAndEncoding: {},
+	ReasonContentLength:     {},
+	ReasonTransferEncoding:  {},
+	ReasonChunked:           {},
+	ReasonDuplicateHost:     {},
+	ReasonMissingHost:       {},
+	ReasonHeaderName:        {},
+	ReasonHeaderValue:       {},
+	ReasonLineFolding:       {},
+	ReasonBareLF:            {},
+	ReasonPercentEncoding:   {},
+	ReasonPathCharacters:    {},
+	ReasonEncodedSlash:      {},
+}
+
+// ValidLevel reports if a level exists
+func ValidLevel(level string) bool {
+	return level == LevelOff || level == LevelNormal || level == LevelStrict
+}
+
+// Rejection is a request refused for its framing, headers or path
+type Rejection struct {
+	Reason string
+
+	// Requests rejected for the same reason so far, this one included
+	Count uint64
+}
+
+func (e *Rejection) Error() string {
+	return fmt.Sprintf("%s (%d rejected for this reason)", e.Reason, e.Count)
+}
+
+// reject counts a rejection
+func reject(reason string) *Rejection {
+	return &Rejection{Reason: reason, Count: counters[reason].Add(1)}
+}
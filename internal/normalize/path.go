@@ -0,0 +1,105 @@
+package normalize
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const upperhex = "0123456789ABCDEF"
+
+// Request normalizes the path of a request in place, so routing, the cache key and the upstream all see the same path.
+// Percent-encodings are upper cased and decoded for unreserved characters, repeated slashes are merged and dot segments removed.
+func Request(r *http.Request, level string) error {
+	if level == LevelOff || !strings.HasPrefix(r.URL.Path, "/") {
+		return nil
+	}
+	escaped, reason := cleanPath(r.URL.EscapedPath(), level == LevelStrict)
+	if reason != "" {
+		return reject(reason)
+	}
+	path, err := url.PathUnescape(escaped)
+	if err != nil {
+		return reject(ReasonPercentEncoding)
+	}
+	r.URL.Path, r.URL.RawPath = path, escaped
+	return nil
+}
+
+// cleanPath normalizes an escaped path, returning the reason if it is rejected
+func cleanPath(p string, strict bool) (string, string) {
+	var b strings.Builder
+	b.Grow(len(p))
+	for i := 0; i < len(p); i++ {
+		ch := p[i]
+		switch {
+		case ch == '%':
+			if i+2 >= len(p) || !ishex(p[i+1]) || !ishex(p[i+2]) {
+				return "", ReasonPercentEncoding
+			}
+			v := unhex(p[i+1])<<4 | unhex(p[i+2])
+			i += 2
+			switch {
+			case v < ' ' || v == 0x7f:
+				return "", ReasonPathCharacters
+			case strict && (v == '/' || v == '\\'):
+				return "", ReasonEncodedSlash
+			case unreserved(v):
+				b.WriteByte(v)
+			default:
+				b.WriteByte('%')
+				b.WriteByte(upperhex[v>>4])
+				b.WriteByte(upperhex[v&15])
+			}
+		case ch < ' ' || ch == 0x7f || (strict && ch == '\\'):
+			return "", ReasonPathCharacters
+		default:
+			b.WriteByte(ch)
+		}
+	}
+	return removeDotSegments(b.String()), ""
+}
+
+// removeDotSegments resolves . and .. segments and drops empty ones, keeping a trailing slash
+func removeDotSegments(p string) string {
+	trailing := strings.HasSuffix(p, "/") || strings.HasSuffix(p, "/.") || strings.HasSuffix(p, "/..")
+	var segments []string
+	for _, seg := range strings.Split(p, "/") {
+		switch seg {
+		case "", ".":
+		case "..":
+			if len(segments) > 0 {
+				segments = segments[:len(segments)-1]
+			}
+		default:
+			segments = append(segments, seg)
+		}
+	}
+	if len(segments) == 0 {
+		return "/"
+	}
+	clean := "/" + strings.Join(segments, "/")
+	if trailing {
+		clean += "/"
+	}
+	return clean
+}
+
+func unreserved(ch byte) bool {
+	return 'a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z' || '0' <= ch && ch <= '9' || ch == '-' || ch == '.' || ch == '_' || ch == '~'
+}
+
+func ishex(ch byte) bool {
+	return '0' <= ch && ch <= '9' || 'a' <= ch && ch <= 'f' || 'A' <= ch && ch <= 'F'
+}
+
+func unhex(ch byte) byte {
+	switch {
+	case ch <= '9':
+		return ch - '0'
+	case ch <= 'F':
+		return ch - 'A' + 10
+	default:
+		return ch - 'a' + 10
+	}
+}
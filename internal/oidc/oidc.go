@@ -0,0 +1,463 @@
+package oidc
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kunalvirwal/minato/internal/auth"
+	"github.com/kunalvirwal/minato/internal/proxy"
+	"github.com/kunalvirwal/minato/internal/utils"
+)
+
+// Defaults of optional settings
+const (
+	DefaultCookieName      = "minato_session"
+	DefaultSessionLifetime = 24 * time.Hour
+	DefaultGroupsClaim     = "groups"
+)
+
+// DefaultScopes are requested when no scopes are configured
+var DefaultScopes = []string{"openid", "profile", "email"}
+
+// Time a login may take between the redirect to the IdP and the callback
+const loginTimeout = 10 * time.Minute
+
+// A failed discovery is retried after this long
+const discoveryRetry = 10 * time.Second
+
+// Largest response read from the IdP
+const maxResponseSize = 1 << 20
+
+var client = &http.Client{Timeout: 10 * time.Second}
+
+// RelyingParty logs browser users in with an OpenID Connect provider and keeps their session in an encrypted cookie
+type RelyingParty struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+
+	// Absolute URL of the callback, its path must be served by the route
+	RedirectURL string
+
+	CookieName      string
+	SessionLifetime time.Duration
+
+	// Path which ends the session, empty disables logout
+	LogoutPath string
+
+	// Where the IdP sends users after logging out, passed as post_logout_redirect_uri
+	PostLogoutRedirectURL string
+
+	// Users need one of these groups, empty allows every user
+	AllowedGroups []string
+	GroupsClaim   string
+
+	// Headers set upstream from claims, keyed by claim name
+	ForwardClaims map[string]string
+
+	// Responses of the route are only cached when this is set
+	AllowCache bool
+
+	callbackPath string
+	sealer       *sealer
+
+	mu         sync.Mutex
+	provider   *provider
+	discovered time.Time
+
+	// Closed when the discovery in flight finishes, nil while none is
+	discovering  chan struct{}
+	discoveryErr error
+}
+
+// provider holds the endpoints found with OpenID Connect discovery
+type provider struct {
+	AuthURL    string `json:"authorization_endpoint"`
+	TokenURL   string `json:"token_endpoint"`
+	JWKSURL    string `json:"jwks_uri"`
+	LogoutURL  string `json:"end_session_endpoint"`
+	IssuerName string `json:"issuer"`
+
+	idToken *auth.JWT
+}
+
+// tokenResponse is the response of the token endpoint
+type tokenResponse struct {
+	IDToken      string `json:"id_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	Error        string `json:"error"`
+}
+
+// New creates a relying party, the provider is discovered when the first request needs it
+func New(rp *RelyingParty, cookieSecret string) *RelyingParty {
+	parsed, _ := url.Parse(rp.RedirectURL)
+	rp.callbackPath = parsed.Path
+	rp.sealer = newSealer(cookieSecret)
+	return rp
+}
+
+// Authenticate returns the session of the request's user. Requests without a valid session are sent to the IdP,
+// and the callback and logout paths are served here. It returns false when it has written the response.
+// Errors are written with the error pages of the route attached to r.
+func (rp *RelyingParty) Authenticate(w http.ResponseWriter, r *http.Request) (*Session, bool) {
+	switch r.URL.Path {
+	case rp.callbackPath:
+		rp.callback(w, r)
+		return nil, false
+	case rp.LogoutPath:
+		if rp.LogoutPath != "" {
+			rp.logout(w, r)
+			return nil, false
+		}
+	}
+
+	s, ok := rp.readSession(r)
+	if ok && time.Now().Unix() >= s.Expiry {
+		ok = s.RefreshToken != "" && rp.refresh(w, r, s)
+	}
+	if !ok {
+		rp.login(w, r)
+		return nil, false
+	}
+
+	if !rp.allowed(s) {
+		utils.LogRequestError(r, fmt.Sprintf("User %v is not in an allowed group", s.Claims["sub"]))
+		proxy.WriteError(w, r, http.StatusForbidden, "Forbidden")
+		return nil, false
+	}
+	return s, true
+}
+
+// Forward sets the identity headers of a session on the upstream request.
+// Client supplied values of these headers and the session cookies are removed.
+func (rp *RelyingParty) Forward(r *http.Request, s *Session) {
+	for claim, header := range rp.ForwardClaims {
+		r.Header.Del(header)
+		if v := auth.ClaimString(s.Claims[claim]); v != "" && !strings.ContainsAny(v, "\r\n\x00") {
+			r.Header.Set(header, v)
+		}
+	}
+	rp.stripCookies(r)
+}
+
+// allowed reports if the user of a session is in one of the allowed groups
+func (rp *RelyingParty) allowed(s *Session) bool {
+	if len(rp.AllowedGroups) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(rp.AllowedGroups, func(g string) bool {
+		return auth.ClaimHas(s.Claims[rp.GroupsClaim], g)
+	})
+}
+
+// login redirects browsers to the IdP, other clients can't follow the flow and get a 401
+func (rp *RelyingParty) login(w http.ResponseWriter, r *http.Request) {
+	browser := (r.Method == http.MethodGet || r.Method == http.MethodHead) && strings.Contains(r.Header.Get("Accept"), "text/html")
+	if !browser {
+		proxy.WriteError(w, r, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	p, err := rp.discover(r.Context())
+	if err != nil {
+		utils.LogRequestError(r, "OIDC discovery failed: "+err.Error())
+		proxy.WriteError(w, r, http.StatusBadGateway, "Bad Gateway")
+		return
+	}
+
+	st := loginState{
+		State:    randomString(),
+		Nonce:    randomString(),
+		Verifier: randomString(),
+		Return:   r.URL.RequestURI(),
+	}
+	value, err := rp.sealer.seal(rp.stateCookieName(), st)
+	if err != nil {
+		utils.LogRequestError(r, "Unable to create OIDC login state: "+err.Error())
+		proxy.WriteError(w, r, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	http.SetCookie(w, rp.cookie(r, rp.stateCookieName(), value, time.Now().Add(loginTimeout)))
+
+	challenge := sha256.Sum256([]byte(st.Verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {rp.ClientID},
+		"redirect_uri":          {rp.RedirectURL},
+		"scope":                 {strings.Join(rp.Scopes, " ")},
+		"state":                 {st.State},
+		"nonce":                 {st.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	http.Redirect(w, r, withQuery(p.AuthURL, q), http.StatusFound)
+}
+
+// callback finishes a login, exchanging the code for tokens and starting the session
+func (rp *RelyingParty) callback(w http.ResponseWriter, r *http.Request) {
+	fail := func(status int, msg string, err error) {
+		utils.LogRequestError(r, fmt.Sprintf("OIDC login failed: %v", err))
+		proxy.WriteError(w, r, status, msg)
+	}
+
+	var st loginState
+	c, err := r.Cookie(rp.stateCookieName())
+	if err != nil {
+		fail(http.StatusBadRequest, "Bad Request", errors.New("no login state cookie"))
+		return
+	}
+	if err := rp.sealer.open(rp.stateCookieName(), c.Value, &st); err != nil {
+		fail(http.StatusBadRequest, "Bad Request", err)
+		return
+	}
+	http.SetCookie(w, rp.cookie(r, rp.stateCookieName(), "", time.Time{}))
+
+	q := r.URL.Query()
+	if subtle.ConstantTimeCompare([]byte(q.Get("state")), []byte(st.State)) != 1 {
+		fail(http.StatusBadRequest, "Bad Request", errors.New("state mismatch"))
+		return
+	}
+	if e := q.Get("error"); e != "" {
+		fail(http.StatusForbidden, "Forbidden", fmt.Errorf("idp returned %s: %s", e, q.Get("error_description")))
+		return
+	}
+
+	p, err := rp.discover(r.Context())
+	if err != nil {
+		fail(http.StatusBadGateway, "Bad Gateway", err)
+		return
+	}
+	tokens, err := rp.token(p, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {q.Get("code")},
+		"redirect_uri":  {rp.RedirectURL},
+		"code_verifier": {st.Verifier},
+	})
+	if err != nil {
+		fail(http.StatusBadGateway, "Bad Gateway", err)
+		return
+	}
+	claims, err := p.idToken.Verify(tokens.IDToken)
+	if err != nil {
+		fail(http.StatusUnauthorized, "Unauthorized", fmt.Errorf("invalid id token: %v", err))
+		return
+	}
+	if nonce, _ := claims["nonce"].(string); subtle.ConstantTimeCompare([]byte(nonce), []byte(st.Nonce)) != 1 {
+		fail(http.StatusUnauthorized, "Unauthorized", errors.New("id token nonce mismatch"))
+		return
+	}
+
+	s := &Session{Created: time.Now().Unix()}
+	rp.update(s, tokens, claims)
+	if err := rp.writeSession(w, r, s); err != nil {
+		fail(http.StatusInternalServerError, "Internal Server Error", err)
+		return
+	}
+	utils.LogRequestInfo(r, fmt.Sprintf("OIDC login of %v", claims["sub"]))
+
+	// Only return to paths of this site
+	target := st.Return
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") {
+		target = "/"
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// refresh renews the tokens of an expired session, returns false if the user has to log in again
+func (rp *RelyingParty) refresh(w http.ResponseWriter, r *http.Request, s *Session) bool {
+	p, err := rp.discover(r.Context())
+	if err != nil {
+		utils.LogRequestError(r, "OIDC discovery failed: "+err.Error())
+		return false
+	}
+	tokens, err := rp.token(p, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {s.RefreshToken},
+	})
+	if err != nil {
+		utils.LogRequestError(r, "OIDC token refresh failed: "+err.Error())
+		return false
+	}
+
+	claims := s.Claims
+	if tokens.IDToken != "" {
+		if claims, err = p.idToken.Verify(tokens.IDToken); err != nil {
+			utils.LogRequestError(r, "OIDC token refresh returned an invalid id token: "+err.Error())
+			return false
+		}
+	}
+	if tokens.RefreshToken == "" {
+		tokens.RefreshToken = s.RefreshToken
+	}
+	rp.update(s, tokens, claims)
+	if err := rp.writeSession(w, r, s); err != nil {
+		utils.LogRequestError(r, "Unable to store refreshed OIDC session: "+err.Error())
+		return false
+	}
+	return true
+}
+
+// update stores new tokens in a session, keeping only the claims which are forwarded or checked
+func (rp *RelyingParty) update(s *Session, tokens *tokenResponse, claims map[string]any) {
+	s.Claims = make(map[string]any)
+	for claim := range rp.ForwardClaims {
+		if v, ok := claims[claim]; ok {
+			s.Claims[claim] = v
+		}
+	}
+	if len(rp.AllowedGroups) != 0 {
+		s.Claims[rp.GroupsClaim] = claims[rp.GroupsClaim]
+	}
+	s.Claims["sub"] = claims["sub"]
+	s.RefreshToken = tokens.RefreshToken
+
+	// Sessions last as long as the tokens, the ID token's expiry is used if no lifetime is given
+	if tokens.ExpiresIn > 0 {
+		s.Expiry = time.Now().Unix() + tokens.ExpiresIn
+	} else if exp, ok := claims["exp"].(float64); ok {
+		s.Expiry = int64(exp)
+	}
+}
+
+// logout ends the session and sends the user to the IdP's logout endpoint if it has one
+func (rp *RelyingParty) logout(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, rp.cookie(r, rp.CookieName, "", time.Time{}))
+
+	target := rp.PostLogoutRedirectURL
+	if target == "" {
+		target = "/"
+	}
+	if p, err := rp.discover(r.Context()); err == nil && p.LogoutURL != "" {
+		q := url.Values{"client_id": {rp.ClientID}}
+		if rp.PostLogoutRedirectURL != "" {
+			q.Set("post_logout_redirect_uri", rp.PostLogoutRedirectURL)
+		}
+		target = withQuery(p.LogoutURL, q)
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// token calls the token endpoint, authenticating with the client secret
+func (rp *RelyingParty) token(p *provider, form url.Values) (*tokenResponse, error) {
+	req, err := http.NewRequest(http.MethodPost, p.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(rp.ClientID), url.QueryEscape(rp.ClientSecret))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return nil, err
+	}
+
+	var tokens tokenResponse
+	if err := json.Unmarshal(body, &tokens); err != nil {
+		return nil, fmt.Errorf("token endpoint returned %s", resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK || tokens.Error != "" {
+		return nil, fmt.Errorf("token endpoint returned %s: %s", resp.Status, tokens.Error)
+	}
+	if tokens.IDToken == "" && form.Get("grant_type") == "authorization_code" {
+		return nil, errors.New("token endpoint returned no id token")
+	}
+	return &tokens, nil
+}
+
+// discover fetches the provider's endpoints once, failures are retried after a short wait.
+// Concurrent callers share the discovery in flight, which runs without holding the lock,
+// and stop waiting for it when their ctx is done.
+func (rp *RelyingParty) discover(ctx context.Context) (*provider, error) {
+	rp.mu.Lock()
+	if p := rp.provider; p != nil {
+		rp.mu.Unlock()
+		return p, nil
+	}
+	if done := rp.discovering; done != nil {
+		rp.mu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		rp.mu.Lock()
+		defer rp.mu.Unlock()
+		if rp.provider == nil {
+			return nil, rp.discoveryErr
+		}
+		return rp.provider, nil
+	}
+	if time.Since(rp.discovered) < discoveryRetry {
+		rp.mu.Unlock()
+		return nil, errors.New("provider discovery failed recently")
+	}
+	rp.discovered = time.Now()
+	done := make(chan struct{})
+	rp.discovering = done
+	rp.mu.Unlock()
+
+	p, err := rp.fetchProvider()
+
+	rp.mu.Lock()
+	rp.provider, rp.discoveryErr, rp.discovering = p, err, nil
+	rp.mu.Unlock()
+	close(done)
+	return p, err
+}
+
+// fetchProvider reads the discovery document of the issuer
+func (rp *RelyingParty) fetchProvider() (*provider, error) {
+	resp, err := client.Get(strings.TrimSuffix(rp.Issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery returned %s", resp.Status)
+	}
+
+	var p provider
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(&p); err != nil {
+		return nil, fmt.Errorf("invalid discovery document: %v", err)
+	}
+	if p.IssuerName != rp.Issuer {
+		return nil, fmt.Errorf("discovery document is for issuer '%s'", p.IssuerName)
+	}
+	if p.AuthURL == "" || p.TokenURL == "" || p.JWKSURL == "" {
+		return nil, errors.New("discovery document misses an endpoint")
+	}
+	p.idToken = &auth.JWT{
+		Keys:     auth.NewRemoteJWKS(p.JWKSURL),
+		Issuer:   rp.Issuer,
+		Audience: []string{rp.ClientID},
+		Leeway:   time.Minute,
+	}
+	return &p, nil
+}
+
+// withQuery adds query parameters to an endpoint URL which can already have some
+func withQuery(endpoint string, q url.Values) string {
+	sep := "?"
+	if strings.Contains(endpoint, "?") {
+		sep = "&"
+	}
+	return endpoint + sep + q.Encode()
+}
@@ -0,0 +1,439 @@
+package oidc
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	testClientID     = "minato"
+	testClientSecret = "client-secret"
+	testRedirectURL  = "http://app.test/oauth2/callback"
+)
+
+// idp is a stand-in OpenID Connect provider. It logs every user in as alice without asking
+// and signs its ID tokens with an Ed25519 key served from its JWKS endpoint.
+type idp struct {
+	*httptest.Server
+	key ed25519.PrivateKey
+
+	// Groups of the user in the ID tokens
+	groups []string
+
+	// Held up before the discovery document is returned
+	discoveryDelay time.Duration
+
+	discoveries atomic.Int32
+	refreshes   atomic.Int32
+
+	mu sync.Mutex
+	// Authorization requests by the code issued for them
+	codes map[string]url.Values
+}
+
+func newIDP(t *testing.T) *idp {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &idp{key: key, codes: make(map[string]url.Values)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.discovery)
+	mux.HandleFunc("/jwks", p.jwks)
+	mux.HandleFunc("/authorize", p.authorize)
+	mux.HandleFunc("/token", p.token)
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+func (p *idp) discovery(w http.ResponseWriter, r *http.Request) {
+	p.discoveries.Add(1)
+	time.Sleep(p.discoveryDelay)
+	json.NewEncoder(w).Encode(map[string]string{
+		"issuer":                 p.URL,
+		"authorization_endpoint": p.URL + "/authorize",
+		"token_endpoint":         p.URL + "/token",
+		"jwks_uri":               p.URL + "/jwks",
+		"end_session_endpoint":   p.URL + "/logout",
+	})
+}
+
+func (p *idp) jwks(w http.ResponseWriter, r *http.Request) {
+	pub := p.key.Public().(ed25519.PublicKey)
+	json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+		"kty": "OKP",
+		"crv": "Ed25519",
+		"kid": "test",
+		"alg": "EdDSA",
+		"x":   base64.RawURLEncoding.EncodeToString(pub),
+	}}})
+}
+
+// authorize issues a code for the request and sends the browser back to the relying party
+func (p *idp) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	code := randomString()
+	p.mu.Lock()
+	p.codes[code] = q
+	p.mu.Unlock()
+	back := url.Values{"code": {code}, "state": {q.Get("state")}}
+	http.Redirect(w, r, q.Get("redirect_uri")+"?"+back.Encode(), http.StatusFound)
+}
+
+func (p *idp) token(w http.ResponseWriter, r *http.Request) {
+	fail := func(code string) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": code})
+	}
+	id, secret, _ := r.BasicAuth()
+	if id != testClientID || secret != testClientSecret {
+		fail("invalid_client")
+		return
+	}
+
+	claims := map[string]any{"groups": p.groups}
+	switch r.PostFormValue("grant_type") {
+	case "authorization_code":
+		p.mu.Lock()
+		auth, ok := p.codes[r.PostFormValue("code")]
+		delete(p.codes, r.PostFormValue("code"))
+		p.mu.Unlock()
+		verifier := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if !ok || r.PostFormValue("redirect_uri") != auth.Get("redirect_uri") ||
+			base64.RawURLEncoding.EncodeToString(verifier[:]) != auth.Get("code_challenge") {
+			fail("invalid_grant")
+			return
+		}
+		claims["nonce"] = auth.Get("nonce")
+	case "refresh_token":
+		if r.PostFormValue("refresh_token") != "refresh-token" {
+			fail("invalid_grant")
+			return
+		}
+		p.refreshes.Add(1)
+	default:
+		fail("unsupported_grant_type")
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]any{
+		"id_token":      p.idToken(claims),
+		"refresh_token": "refresh-token",
+		"expires_in":    300,
+	})
+}
+
+// idToken signs an ID token for alice with the extra claims
+func (p *idp) idToken(extra map[string]any) string {
+	claims := map[string]any{
+		"iss":   p.URL,
+		"aud":   testClientID,
+		"sub":   "alice",
+		"email": "alice@example.com",
+		"exp":   time.Now().Add(5 * time.Minute).Unix(),
+	}
+	for k, v := range extra {
+		claims[k] = v
+	}
+	header, _ := json.Marshal(map[string]string{"alg": "EdDSA", "kid": "test", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(ed25519.Sign(p.key, []byte(signed)))
+}
+
+func newRelyingParty(p *idp, allowedGroups ...string) *RelyingParty {
+	return New(&RelyingParty{
+		Issuer:                p.URL,
+		ClientID:              testClientID,
+		ClientSecret:          testClientSecret,
+		Scopes:                DefaultScopes,
+		RedirectURL:           testRedirectURL,
+		CookieName:            DefaultCookieName,
+		SessionLifetime:       DefaultSessionLifetime,
+		LogoutPath:            "/logout",
+		PostLogoutRedirectURL: "http://app.test/",
+		AllowedGroups:         allowedGroups,
+		GroupsClaim:           DefaultGroupsClaim,
+		ForwardClaims:         map[string]string{"email": "X-User-Email"},
+	}, "cookie-secret")
+}
+
+// browser keeps the cookies the relying party sets, like a browser would
+type browser struct {
+	cookies map[string]*http.Cookie
+}
+
+func (b *browser) request(target string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	r.Header.Set("Accept", "text/html")
+	for _, c := range b.cookies {
+		r.AddCookie(c)
+	}
+	return r
+}
+
+// authenticate sends a request through the relying party and stores the cookies of its response
+func (b *browser) authenticate(rp *RelyingParty, target string) (*httptest.ResponseRecorder, *Session, bool) {
+	w := httptest.NewRecorder()
+	s, ok := rp.Authenticate(w, b.request(target))
+	for _, c := range w.Result().Cookies() {
+		if c.MaxAge < 0 {
+			delete(b.cookies, c.Name)
+		} else {
+			b.cookies[c.Name] = c
+		}
+	}
+	return w, s, ok
+}
+
+// login goes through the whole login flow for target and returns the browser holding the session
+func login(t *testing.T, rp *RelyingParty, target string) *browser {
+	t.Helper()
+	b := &browser{cookies: make(map[string]*http.Cookie)}
+	w, _, _ := b.authenticate(rp, target)
+	if w.Code != http.StatusFound {
+		t.Fatalf("login returned %d, want a redirect to the idp", w.Code)
+	}
+
+	// The idp redirects back to the callback without following it
+	noFollow := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := noFollow.Get(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	callback, _ := url.Parse(resp.Header.Get("Location"))
+
+	w, _, _ = b.authenticate(rp, callback.RequestURI())
+	if w.Code != http.StatusFound || w.Header().Get("Location") != target {
+		t.Fatalf("callback returned %d to '%s', want a redirect to '%s'", w.Code, w.Header().Get("Location"), target)
+	}
+	if b.cookies[DefaultCookieName] == nil {
+		t.Fatal("callback set no session cookie")
+	}
+	return b
+}
+
+func TestLoginRedirect(t *testing.T) {
+	p := newIDP(t)
+	rp := newRelyingParty(p)
+	b := &browser{cookies: make(map[string]*http.Cookie)}
+
+	w, _, ok := b.authenticate(rp, "/app?tab=1")
+	if ok || w.Code != http.StatusFound {
+		t.Fatalf("request without session returned %d, want a redirect", w.Code)
+	}
+	location, _ := url.Parse(w.Header().Get("Location"))
+	if !strings.HasPrefix(location.String(), p.URL+"/authorize?") {
+		t.Fatalf("redirected to '%s', want the authorization endpoint", location)
+	}
+	q := location.Query()
+	for param, want := range map[string]string{
+		"response_type":         "code",
+		"client_id":             testClientID,
+		"redirect_uri":          testRedirectURL,
+		"scope":                 "openid profile email",
+		"code_challenge_method": "S256",
+	} {
+		if q.Get(param) != want {
+			t.Errorf("%s is '%s', want '%s'", param, q.Get(param), want)
+		}
+	}
+	for _, param := range []string{"state", "nonce", "code_challenge"} {
+		if q.Get(param) == "" {
+			t.Errorf("authorization request has no %s", param)
+		}
+	}
+
+	// The state, nonce and verifier are kept encrypted in the state cookie
+	var st loginState
+	c := b.cookies[rp.stateCookieName()]
+	if c == nil || rp.sealer.open(rp.stateCookieName(), c.Value, &st) != nil {
+		t.Fatal("no readable login state cookie")
+	}
+	challenge := sha256.Sum256([]byte(st.Verifier))
+	if st.State != q.Get("state") || st.Nonce != q.Get("nonce") || base64.RawURLEncoding.EncodeToString(challenge[:]) != q.Get("code_challenge") {
+		t.Error("login state doesn't match the authorization request")
+	}
+	if st.Return != "/app?tab=1" {
+		t.Errorf("login returns to '%s', want '/app?tab=1'", st.Return)
+	}
+
+	// Clients which can't follow the redirect get a 401
+	r := httptest.NewRequest(http.MethodGet, "/api", nil)
+	w = httptest.NewRecorder()
+	if _, ok := rp.Authenticate(w, r); ok || w.Code != http.StatusUnauthorized {
+		t.Errorf("api request without session returned %d, want 401", w.Code)
+	}
+}
+
+func TestLoginCallback(t *testing.T) {
+	p := newIDP(t)
+	rp := newRelyingParty(p)
+	b := login(t, rp, "/app")
+
+	w, s, ok := b.authenticate(rp, "/app")
+	if !ok {
+		t.Fatalf("request with session returned %d", w.Code)
+	}
+	if s.Claims["sub"] != "alice" || s.RefreshToken != "refresh-token" {
+		t.Errorf("session has sub '%v' and refresh token '%s'", s.Claims["sub"], s.RefreshToken)
+	}
+
+	// Forwarded claims replace the client's headers and the session cookie stays with minato
+	r := b.request("/app")
+	r.Header.Set("X-User-Email", "mallory@example.com")
+	rp.Forward(r, s)
+	if got := r.Header.Get("X-User-Email"); got != "alice@example.com" {
+		t.Errorf("X-User-Email is '%s', want alice@example.com", got)
+	}
+	if _, err := r.Cookie(DefaultCookieName); err == nil {
+		t.Error("session cookie is sent upstream")
+	}
+}
+
+func TestCallbackRejectsForeignState(t *testing.T) {
+	p := newIDP(t)
+	rp := newRelyingParty(p)
+	b := &browser{cookies: make(map[string]*http.Cookie)}
+	b.authenticate(rp, "/app")
+
+	w, _, _ := b.authenticate(rp, "/oauth2/callback?code=stolen&state=forged")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("callback with a foreign state returned %d, want 400", w.Code)
+	}
+	if b.cookies[DefaultCookieName] != nil {
+		t.Error("callback with a foreign state started a session")
+	}
+}
+
+func TestSessionIsEncrypted(t *testing.T) {
+	p := newIDP(t)
+	rp := newRelyingParty(p)
+	b := login(t, rp, "/app")
+
+	value := b.cookies[DefaultCookieName].Value
+	raw, _ := base64.RawURLEncoding.DecodeString(value)
+	if strings.Contains(value, "alice") || strings.Contains(string(raw), "alice") {
+		t.Error("session cookie holds the claims in plain text")
+	}
+
+	// A tampered cookie is no session, so the browser is sent to log in again
+	tampered := []byte(value)
+	tampered[len(tampered)/2] ^= 1
+	b.cookies[DefaultCookieName].Value = string(tampered)
+	if w, _, ok := b.authenticate(rp, "/app"); ok || w.Code != http.StatusFound {
+		t.Errorf("tampered session returned %d, want a redirect to log in", w.Code)
+	}
+
+	// Sessions of another secret can't be read either
+	other := newRelyingParty(p)
+	other.sealer = newSealer("other-secret")
+	b = login(t, rp, "/app")
+	if _, _, ok := b.authenticate(other, "/app"); ok {
+		t.Error("session was accepted with another cookie secret")
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	p := newIDP(t)
+	rp := newRelyingParty(p)
+	b := login(t, rp, "/app")
+
+	// Expire the tokens of the session
+	var s Session
+	c := b.cookies[DefaultCookieName]
+	if err := rp.sealer.open(DefaultCookieName, c.Value, &s); err != nil {
+		t.Fatal(err)
+	}
+	s.Expiry = time.Now().Add(-time.Minute).Unix()
+	c.Value, _ = rp.sealer.seal(DefaultCookieName, s)
+
+	w, refreshed, ok := b.authenticate(rp, "/app")
+	if !ok {
+		t.Fatalf("expired session returned %d, want a refresh", w.Code)
+	}
+	if p.refreshes.Load() != 1 || refreshed.Expiry <= time.Now().Unix() {
+		t.Errorf("session was not refreshed, %d refreshes", p.refreshes.Load())
+	}
+	if b.cookies[DefaultCookieName].Value == c.Value {
+		t.Error("refreshed session was not stored")
+	}
+}
+
+func TestLogout(t *testing.T) {
+	p := newIDP(t)
+	rp := newRelyingParty(p)
+	b := login(t, rp, "/app")
+
+	w, _, ok := b.authenticate(rp, "/logout")
+	if ok || w.Code != http.StatusFound {
+		t.Fatalf("logout returned %d, want a redirect", w.Code)
+	}
+	if b.cookies[DefaultCookieName] != nil {
+		t.Error("logout kept the session cookie")
+	}
+	location, _ := url.Parse(w.Header().Get("Location"))
+	if location.Path != "/logout" || location.Query().Get("post_logout_redirect_uri") != "http://app.test/" {
+		t.Errorf("logout redirected to '%s', want the idp's end session endpoint", location)
+	}
+}
+
+func TestGroupDenial(t *testing.T) {
+	p := newIDP(t)
+	p.groups = []string{"staff"}
+
+	b := login(t, newRelyingParty(p, "staff"), "/app")
+	if w, _, ok := b.authenticate(newRelyingParty(p, "staff"), "/app"); !ok {
+		t.Errorf("member of an allowed group got %d", w.Code)
+	}
+
+	rp := newRelyingParty(p, "admins")
+	b = login(t, rp, "/app")
+	if w, _, ok := b.authenticate(rp, "/app"); ok || w.Code != http.StatusForbidden {
+		t.Errorf("user outside the allowed groups got %d, want 403", w.Code)
+	}
+}
+
+func TestDiscoveryIsShared(t *testing.T) {
+	p := newIDP(t)
+	p.discoveryDelay = 200 * time.Millisecond
+	rp := newRelyingParty(p)
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := rp.discover(context.Background()); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+
+	// Waiters give up with their request instead of queueing behind the discovery
+	time.Sleep(50 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := rp.discover(ctx); err == nil || time.Since(start) > 100*time.Millisecond {
+		t.Errorf("cancelled waiter returned %v after %v", err, time.Since(start))
+	}
+
+	wg.Wait()
+	if n := p.discoveries.Load(); n != 1 {
+		t.Errorf("provider was discovered %d times, want once", n)
+	}
+}
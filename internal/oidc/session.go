@@ -0,0 +1,142 @@
+package oidc
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Session is the login of a user, stored encrypted in a cookie
+type Session struct {
+	// Claims of the ID token which are forwarded or checked
+	Claims map[string]any `json:"c"`
+
+	RefreshToken string `json:"r,omitempty"`
+
+	// Unix time the tokens expire and need a refresh
+	Expiry int64 `json:"e"`
+
+	// Unix time of the login, sessions end SessionLifetime after it
+	Created int64 `json:"t"`
+}
+
+// loginState is kept in a short lived cookie between the redirect to the IdP and the callback
+type loginState struct {
+	State    string `json:"s"`
+	Nonce    string `json:"n"`
+	Verifier string `json:"v"`
+
+	// Request URI to return to after the login
+	Return string `json:"u"`
+}
+
+// sealer encrypts cookie values with AES-GCM
+type sealer struct {
+	aead cipher.AEAD
+}
+
+func newSealer(secret string) *sealer {
+	key := sha256.Sum256([]byte(secret))
+	block, _ := aes.NewCipher(key[:])
+	aead, _ := cipher.NewGCM(block)
+	return &sealer{aead: aead}
+}
+
+// seal encrypts a value, the cookie name is authenticated so values can't be moved between cookies
+func (s *sealer) seal(name string, v any) (string, error) {
+	plain, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	rand.Read(nonce)
+	return base64.RawURLEncoding.EncodeToString(s.aead.Seal(nonce, nonce, plain, []byte(name))), nil
+}
+
+func (s *sealer) open(name string, value string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(data) < s.aead.NonceSize() {
+		return errors.New("malformed cookie")
+	}
+	nonce, sealed := data[:s.aead.NonceSize()], data[s.aead.NonceSize():]
+	plain, err := s.aead.Open(nil, nonce, sealed, []byte(name))
+	if err != nil {
+		return errors.New("cookie can not be decrypted")
+	}
+	return json.Unmarshal(plain, v)
+}
+
+// randomString returns a random URL safe string for states, nonces and PKCE verifiers
+func randomString() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (rp *RelyingParty) readSession(r *http.Request) (*Session, bool) {
+	c, err := r.Cookie(rp.CookieName)
+	if err != nil {
+		return nil, false
+	}
+	var s Session
+	if err := rp.sealer.open(rp.CookieName, c.Value, &s); err != nil {
+		return nil, false
+	}
+	if time.Since(time.Unix(s.Created, 0)) > rp.SessionLifetime {
+		return nil, false
+	}
+	return &s, true
+}
+
+func (rp *RelyingParty) writeSession(w http.ResponseWriter, r *http.Request, s *Session) error {
+	value, err := rp.sealer.seal(rp.CookieName, s)
+	if err != nil {
+		return err
+	}
+	// Browsers drop cookies above 4KB, which would loop the login forever
+	if len(value) > 4000 {
+		return errors.New("session cookie is too large, forward fewer claims")
+	}
+	expires := time.Unix(s.Created, 0).Add(rp.SessionLifetime)
+	http.SetCookie(w, rp.cookie(r, rp.CookieName, value, expires))
+	return nil
+}
+
+func (rp *RelyingParty) stateCookieName() string {
+	return rp.CookieName + "_state"
+}
+
+func (rp *RelyingParty) cookie(r *http.Request, name string, value string, expires time.Time) *http.Cookie {
+	c := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil || strings.HasPrefix(rp.RedirectURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	}
+	if value == "" {
+		c.MaxAge = -1
+	} else {
+		c.Expires = expires
+	}
+	return c
+}
+
+// stripCookies removes the cookies of the relying party from the request sent upstream
+func (rp *RelyingParty) stripCookies(r *http.Request) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, c := range cookies {
+		if c.Name != rp.CookieName && c.Name != rp.stateCookieName() {
+			r.AddCookie(c)
+		}
+	}
+}
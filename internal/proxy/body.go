@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/kunalvirwal/minato/internal/utils"
+)
+
+// DefaultBufferMemory is the part of a buffered request body kept in memory before spilling to a file
+const DefaultBufferMemory = 1 << 20 // 1MB
+
+// DefaultBufferMaxSize bounds buffered request bodies of routes without a max_size, so spilled bodies can't fill the disk
+const DefaultBufferMaxSize = 10 << 20 // 10MB
+
+// BodyLimits bounds and optionally buffers request bodies of a route
+type BodyLimits struct {
+	// Maximum request body size in bytes, 0 means unlimited. Buffered bodies are always limited.
+	MaxSize int64
+
+	// Read the whole body before proxying so slow uploads don't hold upstream connections
+	Buffer bool
+
+	// Bytes of a buffered body kept in memory, the rest is written to a temp file
+	BufferMemory int64
+}
+
+// PrepareBody enforces the body size limit of the request's route and buffers the body if configured.
+// Returns false if the request was rejected and a response was already written.
+// release must be called once the request is done to free the buffered body.
+func (o *Options) PrepareBody(w http.ResponseWriter, r *http.Request) (release func(), ok bool) {
+	release = func() {}
+	if o == nil || o.Body == nil || r.Body == nil || r.Body == http.NoBody {
+		return release, true
+	}
+	limits := o.Body
+
+	if limits.MaxSize > 0 {
+		if !o.CheckBodyLength(w, r) {
+			return release, false
+		}
+		// Bodies without a declared length are checked while they are read
+		r.Body = &limitedBody{ReadCloser: http.MaxBytesReader(w, r.Body, limits.MaxSize)}
+	}
+
+	if !limits.Buffer {
+		return release, true
+	}
+
+	buffered, size, err := bufferBody(r.Body, limits.BufferMemory, limits.MaxSize)
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			utils.LogRequestError(r, fmt.Sprintf("Request body exceeds the limit of %d bytes", limits.MaxSize))
+			o.WriteError(w, r, http.StatusRequestEntityTooLarge, "Request Entity Too Large")
+		} else {
+			utils.LogRequestError(r, "Error buffering request body: "+err.Error())
+			o.WriteError(w, r, http.StatusBadRequest, "Bad Request")
+		}
+		return release, false
+	}
+
+	// The buffered body has a known length, so it is not sent chunked
+	r.Body = buffered
+	r.ContentLength = size
+	r.TransferEncoding = nil
+	return func() { buffered.Close() }, true
+}
+
+// CheckBodyLength rejects a request whose declared body length is already larger than the limit of its route,
+// so a body which can't be proxied isn't read. Returns false if a response was written.
+func (o *Options) CheckBodyLength(w http.ResponseWriter, r *http.Request) bool {
+	if o == nil || o.Body == nil || o.Body.MaxSize <= 0 || r.ContentLength <= o.Body.MaxSize {
+		return true
+	}
+	utils.LogRequestError(r, fmt.Sprintf("Request body of %d bytes exceeds the limit of %d bytes", r.ContentLength, o.Body.MaxSize))
+	o.WriteError(w, r, http.StatusRequestEntityTooLarge, "Request Entity Too Large")
+	return false
+}
+
+// limitedBody records if the body size limit was hit while the transport streamed the body upstream
+type limitedBody struct {
+	io.ReadCloser
+	exceeded atomic.Bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	var maxErr *http.MaxBytesError
+	if err != nil && errors.As(err, &maxErr) {
+		b.exceeded.Store(true)
+	}
+	return n, err
+}
+
+// bodyLimitExceeded reports if reading body failed because it was larger than the route allows
+func bodyLimitExceeded(body io.ReadCloser) bool {
+	lb, ok := body.(*limitedBody)
+	return ok && lb.exceeded.Load()
+}
+
+// bufferedBody is a fully read request body, held in memory or in a temp file
+type bufferedBody struct {
+	io.Reader
+	file *os.File
+	once sync.Once
+}
+
+// Close removes the temp file, it is safe to call more than once
+func (b *bufferedBody) Close() error {
+	b.once.Do(func() {
+		if b.file != nil {
+			b.file.Close()
+			os.Remove(b.file.Name())
+		}
+	})
+	return nil
+}
+
+// bufferBody reads body completely, keeping up to memLimit bytes in memory and the rest in a temp file.
+// Bodies larger than maxSize fail with a *http.MaxBytesError.
+func bufferBody(body io.Reader, memLimit int64, maxSize int64) (*bufferedBody, int64, error) {
+	var mem bytes.Buffer
+	n, err := io.CopyN(&mem, body, memLimit+1)
+	if err == io.EOF {
+		return &bufferedBody{Reader: bytes.NewReader(mem.Bytes())}, n, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Larger than the memory limit, so everything is spilled to disk
+	f, err := os.CreateTemp("", "minato-body-*")
+	if err != nil {
+		return nil, 0, err
+	}
+	buffered := &bufferedBody{file: f}
+	size, err := io.CopyN(f, io.MultiReader(&mem, body), maxSize+1)
+	switch {
+	case err == io.EOF:
+		err = nil
+	case err == nil:
+		// The body is still going past the limit
+		err = &http.MaxBytesError{Limit: maxSize}
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		buffered.Close()
+		return nil, 0, err
+	}
+	buffered.Reader = f
+	return buffered, size, nil
+}
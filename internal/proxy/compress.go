@@ -0,0 +1,195 @@
+package proxy
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Supported response encodings
+const (
+	EncodingGzip   = "gzip"
+	EncodingBrotli = "br"
+	EncodingZstd   = "zstd"
+)
+
+// Default compression settings
+var (
+	DefaultEncodings = []string{EncodingBrotli, EncodingZstd, EncodingGzip}
+
+	DefaultCompressibleTypes = []string{
+		"text/*",
+		"application/json",
+		"application/javascript",
+		"application/xml",
+		"application/rss+xml",
+		"application/atom+xml",
+		"image/svg+xml",
+	}
+)
+
+const DefaultCompressionMinSize = 1024
+
+// Compression compresses upstream responses based on the client's Accept-Encoding
+type Compression struct {
+	// Encodings in the order of preference
+	Encodings []string
+
+	// Content types which are compressed, entries like text/* match a whole type
+	Types []string
+
+	// Responses with a known length smaller than this are sent as is
+	MinSize int64
+
+	// Compression level, interpreted per encoding. 0 uses each encoder's default.
+	Level int
+}
+
+// encoder is a streaming compressor
+type encoder interface {
+	io.Writer
+	Flush() error
+	Close() error
+}
+
+// Negotiate picks the most preferred encoding accepted by the client, "" if none is acceptable
+func (c *Compression) Negotiate(acceptEncoding string) string {
+	if acceptEncoding == "" {
+		return ""
+	}
+
+	accepted := make(map[string]float64)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		q := 1.0
+		if v, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			var err error
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				q = 0
+			}
+		}
+		accepted[name] = q
+	}
+
+	for _, enc := range c.Encodings {
+		q, ok := accepted[enc]
+		if !ok {
+			q, ok = accepted["*"]
+		}
+		if ok && q > 0 {
+			return enc
+		}
+	}
+	return ""
+}
+
+// Prepare decides if an upstream response is compressed for the request.
+// It updates the response headers and returns the chosen encoding, or "" if the response is sent as is.
+func (c *Compression) Prepare(r *http.Request, res *http.Response) string {
+	if !c.compressibleType(res.Header.Get("Content-Type")) {
+		return ""
+	}
+
+	// The response differs by Accept-Encoding whether or not this client gets it compressed
+	AddVary(res.Header, "Accept-Encoding")
+
+	if r.Method == http.MethodHead ||
+		res.StatusCode < http.StatusOK ||
+		res.StatusCode == http.StatusNoContent ||
+		res.StatusCode == http.StatusPartialContent ||
+		res.StatusCode == http.StatusNotModified {
+		return ""
+	}
+
+	// Already encoded by the upstream
+	if ce := res.Header.Get("Content-Encoding"); ce != "" && !strings.EqualFold(ce, "identity") {
+		return ""
+	}
+	if strings.Contains(res.Header.Get("Cache-Control"), "no-transform") {
+		return ""
+	}
+
+	// Streaming responses of unknown length are always compressed
+	if res.ContentLength != -1 && res.ContentLength < c.MinSize {
+		return ""
+	}
+
+	encoding := c.Negotiate(r.Header.Get("Accept-Encoding"))
+	if encoding == "" {
+		return ""
+	}
+
+	res.Header.Set("Content-Encoding", encoding)
+	res.Header.Del("Content-Length")
+	res.Header.Del("Accept-Ranges")
+	// A strong ETag must not be shared by the identity and the encoded body
+	if etag := res.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		res.Header.Set("ETag", "W/"+etag)
+	}
+	return encoding
+}
+
+func (c *Compression) compressibleType(contentType string) bool {
+	baseCT, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range c.Types {
+		if prefix, found := strings.CutSuffix(t, "/*"); found {
+			if strings.HasPrefix(baseCT, prefix+"/") {
+				return true
+			}
+		} else if t == baseCT {
+			return true
+		}
+	}
+	return false
+}
+
+// newEncoder creates a compressor for the encoding writing to w
+func (c *Compression) newEncoder(encoding string, w io.Writer) encoder {
+	switch encoding {
+	case EncodingBrotli:
+		level := brotli.DefaultCompression
+		if c.Level > 0 {
+			level = min(c.Level, brotli.BestCompression)
+		}
+		return brotli.NewWriterLevel(w, level)
+	case EncodingZstd:
+		level := zstd.SpeedDefault
+		if c.Level > 0 {
+			level = zstd.EncoderLevelFromZstd(c.Level)
+		}
+		// Encoder errors only occur for invalid options
+		zw, _ := zstd.NewWriter(w, zstd.WithEncoderLevel(level), zstd.WithEncoderConcurrency(1))
+		return zw
+	default:
+		level := gzip.DefaultCompression
+		if c.Level > 0 {
+			level = min(c.Level, gzip.BestCompression)
+		}
+		// Level is always valid here
+		gw, _ := gzip.NewWriterLevel(w, level)
+		return gw
+	}
+}
+
+// AddVary adds a field to the Vary header unless it is already listed
+func AddVary(h http.Header, field string) {
+	for _, v := range h.Values("Vary") {
+		for _, f := range strings.Split(v, ",") {
+			f = strings.TrimSpace(f)
+			if f == "*" || strings.EqualFold(f, field) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", field)
+}
@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Header rule actions
+const (
+	HeaderSet    = "set"
+	HeaderAdd    = "add"
+	HeaderRemove = "remove"
+	HeaderRename = "rename"
+)
+
+// Variables which can be interpolated in header values as ${name}
+var headerVars = map[string]func(v *HeaderVars) string{
+	"client_ip":     func(v *HeaderVars) string { return v.ClientIP },
+	"host":          func(v *HeaderVars) string { return v.Host },
+	"method":        func(v *HeaderVars) string { return v.Method },
+	"path":          func(v *HeaderVars) string { return v.Path },
+	"scheme":        func(v *HeaderVars) string { return v.Scheme },
+	"route":         func(v *HeaderVars) string { return v.Route },
+	"service":       func(v *HeaderVars) string { return v.Service },
+	"backend":       func(v *HeaderVars) string { return v.Backend },
+	"upstream_host": func(v *HeaderVars) string { return v.UpstreamHost },
+	"time_msec":     func(v *HeaderVars) string { return strconv.FormatInt(v.Start.UnixMilli(), 10) },
+	"time_usec":     func(v *HeaderVars) string { return strconv.FormatInt(v.Start.UnixMicro(), 10) },
+}
+
+// Prefix of the variables referring to what a wildcard or regex host captured, like ${host.1} or ${host.tenant}
+const hostCapturePrefix = "host."
+
+// HeaderVars holds the per request values available to header templates
+type HeaderVars struct {
+	ClientIP     string
+	Host         string
+	Method       string
+	Path         string
+	Scheme       string
+	Route        string
+	Service      string
+	Backend      string
+	UpstreamHost string
+	Start        time.Time
+
+	// Parts of the host captured by the route's wildcard or regex host
+	HostCaptures map[string]string
+}
+
+// Template is a header value with ${var} placeholders, parsed once at config load
+type Template struct {
+	literals []string
+	vars     []func(v *HeaderVars) string
+}
+
+// ParseTemplate parses a header value template, unknown variables are reported as errors
+func ParseTemplate(s string) (*Template, error) {
+	t := &Template{}
+	for {
+		start := strings.Index(s, "${")
+		if start == -1 {
+			t.literals = append(t.literals, s)
+			return t, nil
+		}
+		end := strings.Index(s[start:], "}")
+		if end == -1 {
+			return nil, fmt.Errorf("unterminated variable in '%s'", s)
+		}
+		name := s[start+2 : start+end]
+		fn, ok := headerVars[name]
+		if capture, found := strings.CutPrefix(name, hostCapturePrefix); found && capture != "" {
+			fn, ok = func(v *HeaderVars) string { return v.HostCaptures[capture] }, true
+		}
+		if !ok {
+			return nil, fmt.Errorf("unknown variable '${%s}'", name)
+		}
+		t.literals = append(t.literals, s[:start])
+		t.vars = append(t.vars, fn)
+		s = s[start+end+1:]
+	}
+}
+
+// Render returns the template value for a request
+func (t *Template) Render(v *HeaderVars) string {
+	if len(t.vars) == 0 {
+		return t.literals[0]
+	}
+	var sb strings.Builder
+	for i, fn := range t.vars {
+		sb.WriteString(t.literals[i])
+		sb.WriteString(fn(v))
+	}
+	sb.WriteString(t.literals[len(t.literals)-1])
+	return sb.String()
+}
+
+// HeaderRule is a single header manipulation
+type HeaderRule struct {
+	Action string
+	Name   string
+	Value  *Template
+	// New name of the header for rename
+	To string
+}
+
+// HeaderRules are applied in order to requests going upstream and to responses coming back
+type HeaderRules struct {
+	Request  []HeaderRule
+	Response []HeaderRule
+}
+
+// ApplyRequest applies the request rules to the outbound request.
+// Setting the Host header changes the Host sent upstream.
+func (hr *HeaderRules) ApplyRequest(outReq *http.Request, v *HeaderVars) {
+	for _, rule := range hr.Request {
+		if http.CanonicalHeaderKey(rule.Name) == "Host" {
+			switch rule.Action {
+			case HeaderSet, HeaderAdd:
+				outReq.Host = rule.Value.Render(v)
+			case HeaderRemove:
+				// An empty Host makes the transport use the upstream's host
+				outReq.Host = ""
+			}
+			continue
+		}
+		applyHeaderRule(outReq.Header, rule, v)
+	}
+}
+
+// ApplyResponse applies the response rules to the upstream response headers
+func (hr *HeaderRules) ApplyResponse(h http.Header, v *HeaderVars) {
+	for _, rule := range hr.Response {
+		applyHeaderRule(h, rule, v)
+	}
+}
+
+func applyHeaderRule(h http.Header, rule HeaderRule, v *HeaderVars) {
+	switch rule.Action {
+	case HeaderSet:
+		h.Set(rule.Name, rule.Value.Render(v))
+	case HeaderAdd:
+		h.Add(rule.Name, rule.Value.Render(v))
+	case HeaderRemove:
+		h.Del(rule.Name)
+	case HeaderRename:
+		values := h.Values(rule.Name)
+		if len(values) == 0 {
+			return
+		}
+		values = append([]string(nil), values...)
+		h.Del(rule.Name)
+		for _, val := range values {
+			h.Add(rule.To, val)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/kunalvirwal/minato/internal/cors"
+	"github.com/kunalvirwal/minato/internal/errorpage"
+	"github.com/kunalvirwal/minato/internal/secheaders"
+)
+
+// Options are the route specific settings used by the RevProxy while proxying a request.
+// They are built once per config reload and attached to every request matching the route.
+type Options struct {
+	// Name of the route and of the service it belongs to
+	Route   string
+	Service string
+
+	// Header manipulations for requests and responses of this route
+	Headers *HeaderRules
+
+	// Upstream timeouts of this route, nil uses the defaults
+	Timeouts *Timeouts
+
+	// Request body size limit and buffering, nil leaves bodies untouched
+	Body *BodyLimits
+
+	// Compresses responses for clients accepting it, nil disables compression
+	Compression *Compression
+
+	// Rewrites the request path and the Location/Set-Cookie headers of responses
+	Rewriter *PathRewriter
+
+	// Error pages for errors generated by Minato, nil sends plain text errors
+	ErrorPages *errorpage.Pages
+
+	// Replace upstream 5xx responses which have an error page configured
+	InterceptErrors bool
+
+	// CORS headers added to responses in place of the upstream's, nil leaves them untouched
+	CORS *cors.Policy
+
+	// Security headers added to every response of the route, nil adds none
+	Security *secheaders.Profile
+}
+
+type optionsKey struct{}
+
+// WithOptions returns a shallow copy of r carrying the route options in its context
+func WithOptions(r *http.Request, opts *Options) *http.Request {
+	if opts == nil {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), optionsKey{}, opts))
+}
+
+// OptionsFromRequest returns the route options attached to r, or nil if there are none
+func OptionsFromRequest(r *http.Request) *Options {
+	opts, _ := r.Context().Value(optionsKey{}).(*Options)
+	return opts
+}
+
+type hostCapturesKey struct{}
+
+// WithHostCaptures returns a shallow copy of r carrying what the host of its route captured
+func WithHostCaptures(r *http.Request, captures map[string]string) *http.Request {
+	if captures == nil {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), hostCapturesKey{}, captures))
+}
+
+// HostCapturesFromRequest returns what the host of the request's route captured, nil for exact hosts
+func HostCapturesFromRequest(r *http.Request) map[string]string {
+	captures, _ := r.Context().Value(hostCapturesKey{}).(map[string]string)
+	return captures
+}
+
+// WriteError responds with the error page of the route for status
+func (o *Options) WriteError(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	if o == nil {
+		http.Error(w, msg, status)
+		return
+	}
+	o.Security.Apply(w.Header(), r)
+	o.ErrorPages.Write(w, r, status, msg, o.Service)
+}
+
+// WriteError responds with the error page for status of the route the request was matched to
+func WriteError(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	OptionsFromRequest(r).WriteError(w, r, status, msg)
+}
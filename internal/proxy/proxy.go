@@ -1,6 +1,8 @@
 package proxy
 
 import (
+	"context"
+	"fmt"
 	"io"
 	"mime"
 	"net"
@@ -12,13 +14,26 @@ import (
 	"time"
 
 	"github.com/kunalvirwal/minato/internal/cache"
+	"github.com/kunalvirwal/minato/internal/ipfilter"
+	"github.com/kunalvirwal/minato/internal/requestid"
 	"github.com/kunalvirwal/minato/internal/utils"
 )
 
+// SchemeUnix is the scheme of upstreams listening on a unix socket, like unix:///run/app.sock
+const SchemeUnix = "unix"
+
 type RevProxy struct {
+	Target *url.URL
+
+	// Socket dialed instead of the target's host for unix socket upstreams
+	SocketPath string
+
 	Transport       *http.Transport
 	RequestModifier func(*http.Request)
 	BufferPool      *sync.Pool
+
+	// Transports for routes with custom connection timeouts, keyed by transportKey
+	transports sync.Map
 }
 
 var hopByHopHeaders = []string{
@@ -34,12 +49,21 @@ var hopByHopHeaders = []string{
 
 // NewRevProxy creates a new RevProxy object for a particular upstream backend
 func NewRevProxy(backendURL *url.URL) *RevProxy {
+	// Unix socket upstreams speak plain HTTP, the socket path is only used to dial
+	socketPath := ""
+	if backendURL.Scheme == SchemeUnix {
+		socketPath = backendURL.Path
+		backendURL = &url.URL{Scheme: "http", Host: "localhost"}
+	}
+
 	// This function modifies the URL of any request to a particular backend URL
 	modifier := func(req *http.Request) {
 		ModifyRequestURL(req, backendURL)
 	}
 	return &RevProxy{
-		Transport:       CreateTransport(),
+		Target:          backendURL,
+		SocketPath:      socketPath,
+		Transport:       CreateTransport(Timeouts{}, socketPath),
 		RequestModifier: modifier,
 		BufferPool:      CreateBufferPool(),
 	}
@@ -99,23 +123,32 @@ func joinURLPath(a, b *url.URL) (string, string) {
 
 }
 
-func CreateTransport() *http.Transport {
+// CreateTransport creates the transport for an upstream, zero timeouts use the defaults.
+// A non empty socketPath makes every connection dial that unix socket.
+func CreateTransport(t Timeouts, socketPath string) *http.Transport {
+	t = t.withDefaults()
 
 	dialer := &net.Dialer{
-		Timeout:   5 * time.Second,
+		Timeout:   t.Connect,
 		KeepAlive: 30 * time.Second,
 	}
+	dial := dialer.DialContext
+	if socketPath != "" {
+		dial = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", socketPath)
+		}
+	}
 
 	return &http.Transport{
 		Proxy:                  nil, // can change from nil to http.ProxyFromEnvironment if needed
-		DialContext:            dialer.DialContext,
+		DialContext:            dial,
 		ForceAttemptHTTP2:      true,
 		MaxIdleConnsPerHost:    100,
 		MaxConnsPerHost:        0, // 0 = unlimited
-		IdleConnTimeout:        90 * time.Second,
-		TLSHandshakeTimeout:    10 * time.Second,
+		IdleConnTimeout:        t.Idle,
+		TLSHandshakeTimeout:    t.TLSHandshake,
 		ExpectContinueTimeout:  1 * time.Second,
-		ResponseHeaderTimeout:  10 * time.Second,
+		ResponseHeaderTimeout:  t.ResponseHeader,
 		DisableCompression:     false,   // Disable automatic golang gzip if you want to preserve raw response
 		MaxResponseHeaderBytes: 2 << 20, // 2MB
 	}
@@ -127,7 +160,21 @@ func (p *RevProxy) ServeRequest(w http.ResponseWriter, r *http.Request) *cache.R
 	// For incoming requests, ctx cancels when connection to client closes.
 	// In that case the outbound request should also be cancelled.
 	// So they share the same context.
+	start := time.Now()
 	ctx := r.Context()
+	opts := OptionsFromRequest(r)
+
+	var timeouts *Timeouts
+	if opts != nil {
+		timeouts = opts.Timeouts
+	}
+
+	// The total request timeout also covers copying the response body
+	if timeouts != nil && timeouts.Request > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeouts.Request)
+		defer cancel()
+	}
 	outReq := r.Clone(ctx)
 
 	// If the content length is 0 we can set body = nil.
@@ -154,6 +201,11 @@ func (p *RevProxy) ServeRequest(w http.ResponseWriter, r *http.Request) *cache.R
 	// So that the backend does not close connection after a request
 	outReq.Close = false
 
+	// Apply the route's path rewrites before the path is joined with the backend's path
+	if opts != nil && opts.Rewriter != nil {
+		opts.Rewriter.RewriteRequest(outReq.URL)
+	}
+
 	// Modify the outbound request's URL to point to backend
 	p.RequestModifier(outReq)
 
@@ -183,28 +235,82 @@ func (p *RevProxy) ServeRequest(w http.ResponseWriter, r *http.Request) *cache.R
 		outReq.Header.Set("User-Agent", "")
 	}
 
+	// Apply the configured request header rules last so they can override any of the above
+	var vars *HeaderVars
+	if opts != nil && opts.Headers != nil {
+		vars = p.headerVars(r, opts, start)
+		opts.Headers.ApplyRequest(outReq, vars)
+	}
+
 	// sending the request to backend, returns when it gets headers
-	res, err := p.Transport.RoundTrip(outReq)
+	res, err := p.transportFor(timeouts).RoundTrip(outReq)
 	if err != nil {
-		utils.LogNewError("http: proxy error:" + err.Error())
-		w.WriteHeader(http.StatusBadGateway)
+		if bodyLimitExceeded(r.Body) {
+			utils.LogRequestError(r, "Request body exceeded the size limit while being proxied")
+			opts.WriteError(w, r, http.StatusRequestEntityTooLarge, "Request Entity Too Large")
+			return nil
+		}
+		if isTimeout(err) {
+			utils.LogRequestError(r, "http: proxy timeout:"+err.Error())
+			opts.WriteError(w, r, http.StatusGatewayTimeout, "Gateway Timeout: upstream did not respond in time")
+			return nil
+		}
+		utils.LogRequestError(r, "http: proxy error:"+err.Error())
+		opts.WriteError(w, r, http.StatusBadGateway, "Bad Gateway")
 		return nil
 	}
 
 	// res.Body is never nil
 	defer res.Body.Close()
 
+	// Replace upstream server errors with the route's error page
+	if opts != nil && opts.InterceptErrors && res.StatusCode >= 500 && opts.ErrorPages.Has(res.StatusCode) {
+		opts.WriteError(w, r, res.StatusCode, http.StatusText(res.StatusCode))
+		return nil
+	}
+
 	// Remove Hop-by-hop headers from backend response
 	removeHopByHopHeaders(res.Header)
 
+	// Map redirects and cookie paths back to the route the client requested
+	if opts != nil && opts.Rewriter != nil {
+		opts.Rewriter.RewriteResponse(res.Header, r, p.Target)
+	}
+
+	// Apply the configured response header rules before the headers are sent to the client
+	if vars != nil {
+		opts.Headers.ApplyResponse(res.Header, vars)
+	}
+
+	// Decide on compressing the response, this updates the encoding related headers
+	var zc *Compression
+	encoding := ""
+	if opts != nil && opts.Compression != nil {
+		zc = opts.Compression
+		encoding = zc.Prepare(r, res)
+	}
+
+	// The route's CORS headers replace the upstream's, they are added per origin so they are kept out of the cache
+	if opts != nil {
+		opts.CORS.Prepare(res.Header)
+	}
+
 	// Copy headers from res.Header to w
 	cloneHeader(w.Header(), res.Header)
+	if opts != nil {
+		opts.CORS.Decorate(w.Header(), r)
+		// Added after the copy so the cache keeps the upstream's own headers, which the profile may preserve
+		opts.Security.Apply(w.Header(), r)
+	}
+
+	// The client always gets back the ID the request was forwarded with
+	requestid.SetResponseHeader(w.Header(), r)
 
 	// Send the status code
 	w.WriteHeader(res.StatusCode)
 
 	// Copy the response body to the client
-	bodyCopy := p.copyResponse(w, res)
+	bodyCopy := p.copyResponse(w, res, zc, encoding)
 
 	return &cache.Response{
 		StatusCode: res.StatusCode,
@@ -214,6 +320,35 @@ func (p *RevProxy) ServeRequest(w http.ResponseWriter, r *http.Request) *cache.R
 
 }
 
+// headerVars collects the values which can be interpolated in header rules
+func (p *RevProxy) headerVars(r *http.Request, opts *Options, start time.Time) *HeaderVars {
+	clientIP := r.RemoteAddr
+	if ip := ipfilter.ClientIP(r); ip != nil {
+		clientIP = ip.String()
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	backend := p.Target.Host + p.Target.Path
+	if p.SocketPath != "" {
+		backend = SchemeUnix + ":" + p.SocketPath
+	}
+	return &HeaderVars{
+		ClientIP:     clientIP,
+		Host:         r.Host,
+		Method:       r.Method,
+		Path:         r.URL.Path,
+		Scheme:       scheme,
+		Route:        opts.Route,
+		Service:      opts.Service,
+		Backend:      backend,
+		UpstreamHost: p.Target.Host,
+		Start:        start,
+		HostCaptures: HostCapturesFromRequest(r),
+	}
+}
+
 func cloneHeader(dst, h http.Header) http.Header {
 	for k, vv := range h {
 		vvCopy := make([]string, len(vv))
@@ -223,9 +358,9 @@ func cloneHeader(dst, h http.Header) http.Header {
 	return dst
 }
 
-func (p *RevProxy) copyResponse(w http.ResponseWriter, res *http.Response) []byte {
-	var out []byte
-
+// copyResponse copies the upstream body to the client, compressing it with encoding if it is not empty.
+// Returns the body as sent to the client for caching, nil for streaming responses.
+func (p *RevProxy) copyResponse(w http.ResponseWriter, res *http.Response, zc *Compression, encoding string) []byte {
 	var continuousFlush bool = false
 	resType := res.Header.Get("Content-Type")
 	baseCT, _, _ := mime.ParseMediaType(resType)
@@ -241,7 +376,7 @@ func (p *RevProxy) copyResponse(w http.ResponseWriter, res *http.Response) []byt
 		var ok bool
 		flusher, ok = w.(http.Flusher)
 		if !ok {
-			utils.LogNewError("ResponseWriter does not support streaming (Flush) ")
+			utils.LogRequestError(res.Request, "ResponseWriter does not support streaming (Flush) ")
 			return nil
 		}
 		// SSE buffers are long lived so we create a new one instead of fetching from pool
@@ -253,39 +388,72 @@ func (p *RevProxy) copyResponse(w http.ResponseWriter, res *http.Response) []byt
 
 	}
 
+	// For normal responses, the body sent to the client is accumulated for caching
+	sink := &responseSink{w: w, capture: !continuousFlush}
+
+	// The upstream body is written through a compressor if the response is being compressed
+	var dst io.Writer = sink
+	var zw encoder
+	if encoding != "" {
+		zw = zc.newEncoder(encoding, sink)
+		dst = zw
+	}
+
 	for {
 		n, err := res.Body.Read(buf)
 		if n > 0 {
 			// Write event chunk the n bytes read
-			nw, err := w.Write(buf[:n])
-			if err != nil {
-				utils.LogNewError("Error writing to response: " + err.Error())
-				return nil
-			}
-			if nw != n {
-				utils.LogNewError("Less bytes written to response than read from body: " + io.ErrShortWrite.Error())
+			if _, err := dst.Write(buf[:n]); err != nil {
+				utils.LogRequestError(res.Request, "Error writing to response: "+err.Error())
 				return nil
 			}
 
-			// For normal responses, accumulate the response body for caching to be returned
-			if !continuousFlush {
-				out = append(out, buf[:n]...)
-			}
-
 			// Flush after every write
 			if continuousFlush && flusher != nil {
+				if zw != nil {
+					zw.Flush()
+				}
 				flusher.Flush()
 			}
 		}
 		if err != nil {
 			if err != io.EOF {
-				utils.LogNewError("Error reading response body: " + err.Error())
+				utils.LogRequestError(res.Request, "Error reading response body: "+err.Error())
 				return nil
 			}
 			break
 		}
 	}
-	return out
+
+	// Closing the compressor writes out its remaining buffered data
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			utils.LogRequestError(res.Request, "Error writing to response: "+err.Error())
+			return nil
+		}
+	}
+	return sink.body
+}
+
+// responseSink writes to the client and optionally keeps a copy of everything written
+type responseSink struct {
+	w       io.Writer
+	capture bool
+	body    []byte
+}
+
+func (s *responseSink) Write(b []byte) (int, error) {
+	nw, err := s.w.Write(b)
+	if err != nil {
+		return nw, err
+	}
+	if nw != len(b) {
+		return nw, fmt.Errorf("less bytes written to response than read from body: %w", io.ErrShortWrite)
+	}
+	if s.capture {
+		s.body = append(s.body, b...)
+	}
+	return nw, nil
 }
 
 // Remove Hop-by-hop headers
@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// RewriteRule is a compiled regex path rewrite, Replace can refer to capture groups as $1 or ${name}
+type RewriteRule struct {
+	Match   *regexp.Regexp
+	Replace string
+}
+
+// PathRewriter rewrites the path of requests matching a route before it is joined with the upstream path.
+// Responses are rewritten in reverse so that redirects and cookies keep pointing at the route.
+type PathRewriter struct {
+	// Path prefix of the route this rewriter belongs to
+	RoutePrefix string
+	StripPrefix bool
+	AddPrefix   string
+	Rules       []RewriteRule
+}
+
+// NewPathRewriter creates a PathRewriter for a route, returns nil when the route has nothing to rewrite
+func NewPathRewriter(routePrefix string, stripPrefix bool, addPrefix string, rules []RewriteRule) *PathRewriter {
+	if !stripPrefix && addPrefix == "" && len(rules) == 0 {
+		return nil
+	}
+	return &PathRewriter{
+		RoutePrefix: routePrefix,
+		StripPrefix: stripPrefix,
+		AddPrefix:   addPrefix,
+		Rules:       rules,
+	}
+}
+
+// RewritePath strips the route prefix, applies the first matching rewrite rule and then adds the new prefix
+func (pr *PathRewriter) RewritePath(p string) string {
+	if pr.StripPrefix {
+		p = strings.TrimPrefix(p, pr.RoutePrefix)
+	}
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+
+	for _, rule := range pr.Rules {
+		loc := rule.Match.FindStringSubmatchIndex(p)
+		if loc == nil {
+			continue
+		}
+		replaced := rule.Match.ExpandString(nil, rule.Replace, p, loc)
+		p = p[:loc[0]] + string(replaced) + p[loc[1]:]
+		break
+	}
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+
+	return pr.AddPrefix + p
+}
+
+// RewriteRequest rewrites the path of an outbound request URL.
+// RawPath is dropped so that the URL re-escapes the rewritten path.
+func (pr *PathRewriter) RewriteRequest(u *url.URL) {
+	u.Path = pr.RewritePath(u.Path)
+	u.RawPath = ""
+}
+
+// RewriteResponse maps the Location header and Set-Cookie paths of an upstream response back to the route.
+// Paths produced by regex rules can't be reversed, so only the prefix transformations are undone.
+func (pr *PathRewriter) RewriteResponse(h http.Header, r *http.Request, upstream *url.URL) {
+	if loc := h.Get("Location"); loc != "" {
+		h.Set("Location", pr.rewriteLocation(loc, r, upstream))
+	}
+	for i, cookie := range h["Set-Cookie"] {
+		h["Set-Cookie"][i] = pr.rewriteCookiePath(cookie, upstream.Path)
+	}
+}
+
+// restorePath undoes the prefix transformations applied to a path, false if the path was not produced by them
+func (pr *PathRewriter) restorePath(p string, upstreamPath string) (string, bool) {
+	prefix := strings.TrimSuffix(upstreamPath, "/") + pr.AddPrefix
+	if prefix != "" {
+		rest, ok := cutPathPrefix(p, prefix)
+		if !ok {
+			return p, false
+		}
+		p = rest
+	}
+	if pr.StripPrefix {
+		p = pr.RoutePrefix + p
+	}
+	return p, true
+}
+
+func (pr *PathRewriter) rewriteLocation(loc string, r *http.Request, upstream *url.URL) string {
+	u, err := url.Parse(loc)
+	if err != nil {
+		return loc
+	}
+
+	if u.IsAbs() {
+		// Only redirects pointing to the upstream itself are rewritten
+		if u.Host != upstream.Host {
+			return loc
+		}
+		u.Scheme = "http"
+		if r.TLS != nil {
+			u.Scheme = "https"
+		}
+		u.Host = r.Host
+	} else if u.Host != "" || !strings.HasPrefix(u.Path, "/") {
+		// Scheme relative and path relative redirects are left untouched
+		return loc
+	}
+
+	if p, ok := pr.restorePath(u.Path, upstream.Path); ok {
+		u.Path = p
+		u.RawPath = ""
+	}
+	return u.String()
+}
+
+func (pr *PathRewriter) rewriteCookiePath(cookie string, upstreamPath string) string {
+	attrs := strings.Split(cookie, ";")
+	for i, attr := range attrs {
+		name, value, found := strings.Cut(strings.TrimSpace(attr), "=")
+		if !found || !strings.EqualFold(name, "path") {
+			continue
+		}
+		p, ok := pr.restorePath(value, upstreamPath)
+		if !ok {
+			return cookie
+		}
+		// A cookie path of /api/ would not match /api itself
+		if len(p) > 1 {
+			p = strings.TrimSuffix(p, "/")
+		}
+		attrs[i] = " " + name + "=" + p
+		return strings.Join(attrs, ";")
+	}
+	return cookie
+}
+
+// cutPathPrefix removes prefix from p only if it ends at a path segment boundary
+func cutPathPrefix(p, prefix string) (string, bool) {
+	if p == prefix {
+		return "/", true
+	}
+	if strings.HasPrefix(p, prefix+"/") {
+		return p[len(prefix):], true
+	}
+	return p, false
+}
@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Default upstream timeouts
+const (
+	DefaultConnectTimeout        = 5 * time.Second
+	DefaultTLSHandshakeTimeout   = 10 * time.Second
+	DefaultResponseHeaderTimeout = 10 * time.Second
+	DefaultIdleConnTimeout       = 90 * time.Second
+)
+
+// Timeouts of requests proxied upstream, zero values use the defaults.
+// Request has no default and limits the whole exchange including the response body.
+type Timeouts struct {
+	Connect        time.Duration
+	TLSHandshake   time.Duration
+	ResponseHeader time.Duration
+	Request        time.Duration
+	Idle           time.Duration
+}
+
+// transportKey holds the timeouts which are properties of a transport's connection pool
+type transportKey struct {
+	connect        time.Duration
+	tlsHandshake   time.Duration
+	responseHeader time.Duration
+	idle           time.Duration
+}
+
+func (t Timeouts) transportKey() transportKey {
+	return transportKey{
+		connect:        t.Connect,
+		tlsHandshake:   t.TLSHandshake,
+		responseHeader: t.ResponseHeader,
+		idle:           t.Idle,
+	}
+}
+
+func (t Timeouts) withDefaults() Timeouts {
+	if t.Connect == 0 {
+		t.Connect = DefaultConnectTimeout
+	}
+	if t.TLSHandshake == 0 {
+		t.TLSHandshake = DefaultTLSHandshakeTimeout
+	}
+	if t.ResponseHeader == 0 {
+		t.ResponseHeader = DefaultResponseHeaderTimeout
+	}
+	if t.Idle == 0 {
+		t.Idle = DefaultIdleConnTimeout
+	}
+	return t
+}
+
+// transportFor returns the transport to use for a route's timeouts.
+// Routes without custom connection timeouts share the default transport of the upstream.
+func (p *RevProxy) transportFor(t *Timeouts) *http.Transport {
+	if t == nil {
+		return p.Transport
+	}
+	key := t.transportKey()
+	if key == (transportKey{}) {
+		return p.Transport
+	}
+
+	if tr, ok := p.transports.Load(key); ok {
+		return tr.(*http.Transport)
+	}
+	tr, _ := p.transports.LoadOrStore(key, CreateTransport(*t, p.SocketPath))
+	return tr.(*http.Transport)
+}
+
+// KeepTransports drops the transports of timeouts which aren't in use anymore and closes their idle connections
+func (p *RevProxy) KeepTransports(inUse []*Timeouts) {
+	keep := make(map[transportKey]bool)
+	for _, t := range inUse {
+		if t != nil {
+			keep[t.transportKey()] = true
+		}
+	}
+	p.transports.Range(func(key, tr any) bool {
+		if !keep[key.(transportKey)] {
+			p.transports.Delete(key)
+			tr.(*http.Transport).CloseIdleConnections()
+		}
+		return true
+	})
+}
+
+// isTimeout reports if a round trip failed because one of its timeouts fired
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
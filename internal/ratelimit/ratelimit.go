@@ -0,0 +1,196 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kunalvirwal/minato/internal/ipfilter"
+)
+
+// Kinds of rate limit keys, header and claim keys are written as header:<name> and claim:<name>
+const (
+	KeyIP     = "ip"
+	KeyHeader = "header"
+	KeyClaim  = "claim"
+)
+
+type claimsKey struct{}
+
+// SweepInterval is how often the buckets of idle clients should be freed
+const SweepInterval = time.Minute
+
+// Rule allows each client Requests per Period, with bursts of up to Burst requests
+type Rule struct {
+	Requests int
+	Period   time.Duration
+	Burst    int
+
+	// ip, header:<name> or claim:<name>
+	Key string
+}
+
+// Limiter keeps a token bucket for every client of a rule
+type Limiter struct {
+	Rule Rule
+
+	// Tokens added per second
+	rate float64
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Result is the outcome of taking a token for a request
+type Result struct {
+	Allowed   bool
+	Remaining int
+
+	// Time until the next token, zero if a token is left
+	RetryAfter time.Duration
+
+	// Time until the bucket is full again
+	Reset time.Duration
+
+	rule Rule
+}
+
+// New creates a limiter for a rule
+func New(rule Rule) *Limiter {
+	return &Limiter{
+		Rule:    rule,
+		rate:    float64(rule.Requests) / rule.Period.Seconds(),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Take takes a token from the bucket of the request's client
+func (l *Limiter) Take(r *http.Request) Result {
+	key := l.key(r)
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.Rule.Burst), last: now}
+		l.buckets[key] = b
+	}
+	l.refill(b, now)
+
+	res := Result{rule: l.Rule}
+	if b.tokens >= 1 {
+		b.tokens--
+		res.Allowed = true
+	} else {
+		res.RetryAfter = l.timeFor(1 - b.tokens)
+	}
+	res.Remaining = int(b.tokens)
+	res.Reset = l.timeFor(float64(l.Rule.Burst) - b.tokens)
+	return res
+}
+
+// Sweep frees the buckets which have refilled completely, a new bucket for them would be identical
+func (l *Limiter) Sweep() {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, b := range l.buckets {
+		l.refill(b, now)
+		if b.tokens >= float64(l.Rule.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func (l *Limiter) refill(b *bucket, now time.Time) {
+	elapsed := now.Sub(b.last).Seconds()
+	b.tokens = math.Min(float64(l.Rule.Burst), b.tokens+elapsed*l.rate)
+	b.last = now
+}
+
+// timeFor returns the time needed to refill a number of tokens
+func (l *Limiter) timeFor(tokens float64) time.Duration {
+	return time.Duration(tokens / l.rate * float64(time.Second))
+}
+
+// KeyedByClaim reports if the limiter keys clients by a token claim, it must then be taken once the token is verified
+func (l *Limiter) KeyedByClaim() bool {
+	return l != nil && strings.HasPrefix(l.Rule.Key, KeyClaim+":")
+}
+
+// WithClaims attaches the verified claims of the request's token, which claim keys are read from
+func WithClaims(r *http.Request, claims map[string]any) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), claimsKey{}, claims))
+}
+
+// key returns the bucket key of a request, requests without the header or a verified claim are limited by IP
+func (l *Limiter) key(r *http.Request) string {
+	kind, name, _ := strings.Cut(l.Rule.Key, ":")
+	switch kind {
+	case KeyHeader:
+		if v := r.Header.Get(name); v != "" {
+			return "header:" + v
+		}
+	case KeyClaim:
+		if v := verifiedClaim(r, name); v != "" {
+			return "claim:" + v
+		}
+	}
+	if ip := ipfilter.ClientIP(r); ip != nil {
+		return "ip:" + ip.String()
+	}
+	return "ip:" + r.RemoteAddr
+}
+
+// SetHeaders adds the RateLimit headers, and Retry-After if the request was limited
+func (res Result) SetHeaders(h http.Header) {
+	h.Set("RateLimit-Limit", strconv.Itoa(res.rule.Burst))
+	h.Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(res.Reset)))
+	h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d;burst=%d", res.rule.Requests, ceilSeconds(res.rule.Period), res.rule.Burst))
+	if !res.Allowed {
+		h.Set("Retry-After", strconv.Itoa(max(ceilSeconds(res.RetryAfter), 1)))
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// ValidKey reports if a rule key is ip, header:<name> or claim:<name>
+func ValidKey(key string) bool {
+	kind, name, found := strings.Cut(key, ":")
+	switch kind {
+	case KeyIP:
+		return !found
+	case KeyHeader, KeyClaim:
+		return name != ""
+	}
+	return false
+}
+
+// verifiedClaim reads a claim attached by WithClaims. Claims of unverified tokens are never used,
+// since a client could send a new value with every request to get a fresh bucket.
+func verifiedClaim(r *http.Request, claim string) string {
+	claims, _ := r.Context().Value(claimsKey{}).(map[string]any)
+	switch v := claims[claim].(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,188 @@
+package redirect
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/kunalvirwal/minato/internal/ipfilter"
+	"github.com/kunalvirwal/minato/internal/utils"
+)
+
+// Status codes allowed for redirect rules
+var AllowedStatus = []int{
+	http.StatusMovedPermanently,
+	http.StatusFound,
+	http.StatusTemporaryRedirect,
+	http.StatusPermanentRedirect,
+}
+
+// Variables which can be used in redirect targets along with regex captures
+var targetVars = map[string]func(r *http.Request) string{
+	"host": func(r *http.Request) string { return hostname(r.Host) },
+	"path": func(r *http.Request) string { return r.URL.Path },
+	"scheme": func(r *http.Request) string {
+		if IsSecure(r) {
+			return "https"
+		}
+		return "http"
+	},
+}
+
+// Rule redirects requests whose path matches Match to the To target.
+// To can refer to regex captures as $1 or ${name} and to the variables ${host}, ${path} and ${scheme}.
+type Rule struct {
+	// nil matches every path
+	Match     *regexp.Regexp
+	To        string
+	Status    int
+	DropQuery bool
+}
+
+// Redirector answers requests with the first matching redirect rule
+type Redirector struct {
+	Rules []Rule
+}
+
+// Serve writes a redirect for the first rule matching the request path.
+// Returns false if no rule matched and nothing was written.
+func (rd *Redirector) Serve(w http.ResponseWriter, r *http.Request) bool {
+	for _, rule := range rd.Rules {
+		var match []int
+		if rule.Match != nil {
+			match = rule.Match.FindStringSubmatchIndex(r.URL.Path)
+			if match == nil {
+				continue
+			}
+		}
+
+		target := expand(rule.To, r, rule.Match, match)
+		if !rule.DropQuery && r.URL.RawQuery != "" {
+			if strings.Contains(target, "?") {
+				target += "&" + r.URL.RawQuery
+			} else {
+				target += "?" + r.URL.RawQuery
+			}
+		}
+
+		utils.LogRequestInfo(r, fmt.Sprintf("Redirecting %v%v to %v", r.Host, r.URL.Path, target))
+		http.Redirect(w, r, target, rule.Status)
+		return true
+	}
+	return false
+}
+
+// ToHTTPS redirects a plaintext request to the same URL over https.
+// Non idempotent methods get a 308 so that clients resend the same request.
+func ToHTTPS(w http.ResponseWriter, r *http.Request, httpsPort int) {
+	host := hostname(r.Host)
+	if httpsPort != 0 && httpsPort != 443 {
+		host = net.JoinHostPort(host, strconv.Itoa(httpsPort))
+	}
+	status := http.StatusPermanentRedirect
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		status = http.StatusMovedPermanently
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), status)
+}
+
+// IsSecure reports if the client connected over TLS, either to Minato or to a trusted TLS terminating proxy in front of it.
+// X-Forwarded-Proto is ignored unless the peer is a trusted proxy, since any client can send it.
+func IsSecure(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	return ipfilter.FromTrustedProxy(r) && strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+}
+
+// ValidateTarget checks that every reference in a target is a capture of re or a known variable
+func ValidateTarget(target string, re *regexp.Regexp) error {
+	for _, name := range references(target) {
+		if _, ok := targetVars[name]; ok {
+			continue
+		}
+		if n, err := strconv.Atoi(name); err == nil {
+			if re == nil || n > re.NumSubexp() {
+				return fmt.Errorf("capture group $%d does not exist", n)
+			}
+			continue
+		}
+		if re == nil || re.SubexpIndex(name) == -1 {
+			return fmt.Errorf("unknown variable '${%s}'", name)
+		}
+	}
+	return nil
+}
+
+// expand replaces capture and variable references in the target
+func expand(target string, r *http.Request, re *regexp.Regexp, match []int) string {
+	var sb strings.Builder
+	for i := 0; i < len(target); i++ {
+		name, size := reference(target[i:])
+		if size == 0 {
+			sb.WriteByte(target[i])
+			continue
+		}
+		i += size - 1
+
+		if fn, ok := targetVars[name]; ok {
+			sb.WriteString(fn(r))
+			continue
+		}
+		if re == nil {
+			continue
+		}
+		idx, err := strconv.Atoi(name)
+		if err != nil {
+			idx = re.SubexpIndex(name)
+		}
+		if idx >= 0 && 2*idx+1 < len(match) && match[2*idx] >= 0 {
+			sb.WriteString(r.URL.Path[match[2*idx]:match[2*idx+1]])
+		}
+	}
+	return sb.String()
+}
+
+// references lists the names of all references in a target
+func references(target string) []string {
+	var names []string
+	for i := 0; i < len(target); i++ {
+		if name, size := reference(target[i:]); size > 0 {
+			names = append(names, name)
+			i += size - 1
+		}
+	}
+	return names
+}
+
+// reference parses a $1 or ${name} reference at the start of s, size is 0 if there is none
+func reference(s string) (string, int) {
+	if len(s) < 2 || s[0] != '$' {
+		return "", 0
+	}
+	if s[1] == '{' {
+		end := strings.IndexByte(s, '}')
+		if end < 3 {
+			return "", 0
+		}
+		return s[2:end], end + 1
+	}
+	end := 1
+	for end < len(s) && s[end] >= '0' && s[end] <= '9' {
+		end++
+	}
+	if end == 1 {
+		return "", 0
+	}
+	return s[1:end], end
+}
+
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
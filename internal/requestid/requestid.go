@@ -0,0 +1,151 @@
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/kunalvirwal/minato/internal/ipfilter"
+)
+
+// Request ID formats
+const (
+	FormatUUID = "uuid"
+	FormatULID = "ulid"
+)
+
+// DefaultHeader carries the request ID when no header is configured
+const DefaultHeader = "X-Request-ID"
+
+// Incoming IDs longer than this are replaced
+const maxLength = 200
+
+// Crockford's base32 alphabet used by ULIDs
+const ulidAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+type ctxKey struct{}
+
+// ID is the request ID of a request along with the header carrying it
+type ID struct {
+	Header string
+	Value  string
+}
+
+// Generator assigns request IDs, keeping the incoming ID of trusted clients
+type Generator struct {
+	Header string
+	Format string
+
+	// Clients whose incoming request ID is kept
+	Trusted *ipfilter.Trie
+}
+
+// Assign sets the request ID header of r and returns r with the ID attached to its context.
+// A nil Generator assigns UUIDs in the default header.
+func (g *Generator) Assign(r *http.Request) *http.Request {
+	header, format := DefaultHeader, FormatUUID
+	if g != nil {
+		header, format = g.Header, g.Format
+	}
+
+	id := r.Header.Get(header)
+	if !g.trusted(r) || !valid(id) {
+		id = New(format)
+	}
+	r.Header.Set(header, id)
+	return r.WithContext(context.WithValue(r.Context(), ctxKey{}, ID{Header: header, Value: id}))
+}
+
+// FromRequest returns the request ID assigned to r
+func FromRequest(r *http.Request) (ID, bool) {
+	if r == nil {
+		return ID{}, false
+	}
+	id, ok := r.Context().Value(ctxKey{}).(ID)
+	return id, ok
+}
+
+// SetResponseHeader echoes the request ID of r in the response headers h, replacing any upstream value
+func SetResponseHeader(h http.Header, r *http.Request) {
+	if id, ok := FromRequest(r); ok {
+		h.Set(id.Header, id.Value)
+	}
+}
+
+// New returns a new request ID in the format
+func New(format string) string {
+	if format == FormatULID {
+		return newULID()
+	}
+	return newUUID()
+}
+
+// newUUID returns a random version 4 UUID
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+
+	var out [36]byte
+	hex.Encode(out[0:8], b[0:4])
+	out[8] = '-'
+	hex.Encode(out[9:13], b[4:6])
+	out[13] = '-'
+	hex.Encode(out[14:18], b[6:8])
+	out[18] = '-'
+	hex.Encode(out[19:23], b[8:10])
+	out[23] = '-'
+	hex.Encode(out[24:], b[10:])
+	return string(out[:])
+}
+
+// newULID returns a ULID, a 48 bit millisecond timestamp followed by 80 random bits.
+// ULIDs sort by the time they were created.
+func newULID() string {
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], uint64(time.Now().UnixMilli())<<16)
+	rand.Read(b[6:])
+
+	// 26 characters hold 130 bits, so the first one only encodes the top 3 bits
+	hi := binary.BigEndian.Uint64(b[:8])
+	lo := binary.BigEndian.Uint64(b[8:])
+	var out [26]byte
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i] = ulidAlphabet[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
+
+// trusted reports if the incoming request ID of the client can be kept.
+// This is the connection's peer, which is the proxy that set the header.
+func (g *Generator) trusted(r *http.Request) bool {
+	if g == nil || g.Trusted.Empty() {
+		return false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && g.Trusted.Contains(ip)
+}
+
+// valid reports if an incoming request ID is safe to log and forward
+func valid(id string) bool {
+	if id == "" || len(id) > maxLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
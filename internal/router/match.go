@@ -0,0 +1,141 @@
+package router
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Condition matches a header, query parameter or cookie by its exact value, by a regex found in its value,
+// or by being present when neither is given
+type Condition struct {
+	Name  string
+	Value string
+	Regex string
+}
+
+type condition struct {
+	name    string
+	value   string
+	pattern *regexp.Regexp
+}
+
+// Matcher narrows a route down to requests with one of its methods and matching all of its conditions
+type Matcher struct {
+	methods []string
+	headers []condition
+	query   []condition
+	cookies []condition
+}
+
+// NewMatcher creates a matcher, returns nil if it has no methods or conditions
+func NewMatcher(methods []string, headers []Condition, query []Condition, cookies []Condition) (*Matcher, error) {
+	if len(methods) == 0 && len(headers) == 0 && len(query) == 0 && len(cookies) == 0 {
+		return nil, nil
+	}
+	m := &Matcher{}
+	for _, method := range methods {
+		m.methods = append(m.methods, strings.ToUpper(method))
+	}
+	var err error
+	if m.headers, err = compileConditions(headers, "header"); err != nil {
+		return nil, err
+	}
+	if m.query, err = compileConditions(query, "query"); err != nil {
+		return nil, err
+	}
+	if m.cookies, err = compileConditions(cookies, "cookie"); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func compileConditions(conditions []Condition, kind string) ([]condition, error) {
+	var compiled []condition
+	for _, c := range conditions {
+		if c.Name == "" {
+			return nil, fmt.Errorf("%s condition has no name", kind)
+		}
+		if c.Value != "" && c.Regex != "" {
+			return nil, fmt.Errorf("%s '%s' can have either a value or a regex", kind, c.Name)
+		}
+		cond := condition{name: c.Name, value: c.Value}
+		if c.Regex != "" {
+			pattern, err := regexp.Compile(c.Regex)
+			if err != nil {
+				return nil, fmt.Errorf("%s '%s' has invalid regex: %v", kind, c.Name, err)
+			}
+			cond.pattern = pattern
+		}
+		compiled = append(compiled, cond)
+	}
+	return compiled, nil
+}
+
+// Specificity is the number of things a matcher checks, more specific matchers are tried first
+func (m *Matcher) Specificity() int {
+	if m == nil {
+		return 0
+	}
+	n := len(m.headers) + len(m.query) + len(m.cookies)
+	if len(m.methods) > 0 {
+		n++
+	}
+	return n
+}
+
+// Match reports if a request has one of the methods and matches every condition, a nil matcher matches every request
+func (m *Matcher) Match(r *http.Request) bool {
+	if m == nil {
+		return true
+	}
+	if len(m.methods) > 0 && !slices.Contains(m.methods, r.Method) {
+		return false
+	}
+	for _, c := range m.headers {
+		if !c.match(r.Header.Values(c.name)) {
+			return false
+		}
+	}
+	if len(m.query) > 0 {
+		// Only routes with query conditions pay for parsing the query
+		query, _ := url.ParseQuery(r.URL.RawQuery)
+		for _, c := range m.query {
+			if !c.match(query[c.name]) {
+				return false
+			}
+		}
+	}
+	for _, c := range m.cookies {
+		var values []string
+		for _, cookie := range r.CookiesNamed(c.name) {
+			values = append(values, cookie.Value)
+		}
+		if !c.match(values) {
+			return false
+		}
+	}
+	return true
+}
+
+// match reports if any of the values matches the condition
+func (c condition) match(values []string) bool {
+	for _, v := range values {
+		switch {
+		case c.pattern != nil:
+			if c.pattern.MatchString(v) {
+				return true
+			}
+		case c.value != "":
+			if v == c.value {
+				return true
+			}
+		default:
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,303 @@
+package router
+
+import (
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// CatchAll is the host of routes taking requests for any host no other route takes
+const CatchAll = "*"
+
+// Table finds the route of a request by its port, host and longest matching path prefix.
+// Hosts are matched in the order exact, wildcard, regex and catch-all, the first kind with a route
+// for the path wins. It is built once per config and only read afterwards, so lookups need no locking.
+type Table[T any] struct {
+	ports map[uint64]*hosts[T]
+}
+
+// hosts holds the path trees of the hosts of a port by their kind
+type hosts[T any] struct {
+	exact map[string]*Tree[T]
+
+	// Wildcard hosts by the suffix following their *, like .example.com
+	wildcards map[string]*Tree[T]
+
+	// Regex hosts in the order they were added
+	regexes []*regexHost[T]
+
+	catchAll *Tree[T]
+}
+
+type regexHost[T any] struct {
+	pattern *regexp.Regexp
+	tree    *Tree[T]
+}
+
+// Captures are the parts of a host matched by a wildcard or regex, by group number and name.
+// The part matched by the * of a wildcard host is group 1.
+type Captures map[string]string
+
+// NewTable creates an empty table
+func NewTable[T any]() *Table[T] {
+	return &Table[T]{ports: make(map[uint64]*hosts[T])}
+}
+
+// IsWildcard reports if a host is a wildcard host like *.example.com
+func IsWildcard(host string) bool {
+	return strings.HasPrefix(host, "*.")
+}
+
+// CompileHost compiles a regex host, it is matched against the whole host
+func CompileHost(pattern string) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + pattern + ")$")
+}
+
+func (t *Table[T]) port(port uint64) *hosts[T] {
+	h := t.ports[port]
+	if h == nil {
+		h = &hosts[T]{exact: make(map[string]*Tree[T]), wildcards: make(map[string]*Tree[T])}
+		t.ports[port] = h
+	}
+	return h
+}
+
+// Add registers the route of a host and path prefix on a port, match and priority choose between the routes
+// of the same host and prefix. The host can be exact, a wildcard like *.example.com or the catch-all *.
+// It must not be called once the table is used for lookups.
+func (t *Table[T]) Add(port uint64, host string, prefix string, value T, match *Matcher, priority int) {
+	h := t.port(port)
+	host = strings.ToLower(host)
+	var tree *Tree[T]
+	switch {
+	case host == CatchAll:
+		if h.catchAll == nil {
+			h.catchAll = &Tree[T]{}
+		}
+		tree = h.catchAll
+	case IsWildcard(host):
+		tree = treeOf(h.wildcards, host[1:])
+	default:
+		tree = treeOf(h.exact, host)
+	}
+	tree.Insert(prefix, value, match, priority)
+}
+
+// AddRegex registers the route of a regex host compiled by CompileHost and a path prefix on a port.
+// Regex hosts are matched in the order they are added.
+func (t *Table[T]) AddRegex(port uint64, pattern *regexp.Regexp, prefix string, value T, match *Matcher, priority int) {
+	h := t.port(port)
+	for _, rh := range h.regexes {
+		if rh.pattern.String() == pattern.String() {
+			rh.tree.Insert(prefix, value, match, priority)
+			return
+		}
+	}
+	rh := &regexHost[T]{pattern: pattern, tree: &Tree[T]{}}
+	rh.tree.Insert(prefix, value, match, priority)
+	h.regexes = append(h.regexes, rh)
+}
+
+func treeOf[T any](trees map[string]*Tree[T], key string) *Tree[T] {
+	tree := trees[key]
+	if tree == nil {
+		tree = &Tree[T]{}
+		trees[key] = tree
+	}
+	return tree
+}
+
+// Lookup returns the route of a host with the longest path prefix of path whose matcher accepts r,
+// along with what its host captured. r can be nil if no route has a matcher.
+func (t *Table[T]) Lookup(port uint64, host string, path string, r *http.Request) (T, Captures, bool) {
+	var zero T
+	h := t.ports[port]
+	if h == nil {
+		return zero, nil, false
+	}
+	host = strings.ToLower(host)
+
+	if tree := h.exact[host]; tree != nil {
+		if value, ok := tree.Longest(path, r); ok {
+			return value, nil, true
+		}
+	}
+
+	// The most specific wildcard is tried first, a.b.example.com tries *.b.example.com before *.example.com
+	if len(h.wildcards) > 0 {
+		for i := strings.IndexByte(host, '.'); i > 0; {
+			if tree := h.wildcards[host[i:]]; tree != nil {
+				if value, ok := tree.Longest(path, r); ok {
+					return value, Captures{"1": host[:i]}, true
+				}
+			}
+			next := strings.IndexByte(host[i+1:], '.')
+			if next < 0 {
+				break
+			}
+			i += next + 1
+		}
+	}
+
+	for _, rh := range h.regexes {
+		groups := rh.pattern.FindStringSubmatch(host)
+		if groups == nil {
+			continue
+		}
+		if value, ok := rh.tree.Longest(path, r); ok {
+			return value, regexCaptures(rh.pattern, groups), true
+		}
+	}
+
+	if h.catchAll != nil {
+		if value, ok := h.catchAll.Longest(path, r); ok {
+			return value, nil, true
+		}
+	}
+	return zero, nil, false
+}
+
+func regexCaptures(pattern *regexp.Regexp, groups []string) Captures {
+	if len(groups) == 1 {
+		return nil
+	}
+	captures := make(Captures, len(groups)-1)
+	for i, name := range pattern.SubexpNames() {
+		if i == 0 {
+			continue
+		}
+		captures[strconv.Itoa(i)] = groups[i]
+		if name != "" {
+			captures[name] = groups[i]
+		}
+	}
+	return captures
+}
+
+// Tree is a radix tree of path prefixes, finding the longest prefix of a path in O(path length)
+type Tree[T any] struct {
+	root node[T]
+}
+
+type node[T any] struct {
+	// Part of the prefix this node adds to its parent's
+	prefix string
+
+	// First byte of the prefix of each child, in the order of children
+	indices  []byte
+	children []*node[T]
+
+	// Routes ending at this node in the order they are tried
+	entries []entry[T]
+}
+
+// entry is a route along with what it needs from a request
+type entry[T any] struct {
+	value    T
+	match    *Matcher
+	priority int
+}
+
+// before reports if e is tried before o, by priority and then by how specific its matcher is
+func (e entry[T]) before(o entry[T]) bool {
+	if e.priority != o.priority {
+		return e.priority > o.priority
+	}
+	return e.match.Specificity() > o.match.Specificity()
+}
+
+// Insert adds the route of a prefix to the tree. Routes of the same prefix are tried by descending priority,
+// then by descending specificity of their matchers, and then in the order they were inserted.
+func (t *Tree[T]) Insert(prefix string, value T, match *Matcher, priority int) {
+	n := &t.root
+	for {
+		// The prefix ends at this node
+		if prefix == "" {
+			n.insert(entry[T]{value: value, match: match, priority: priority})
+			return
+		}
+		child := n.child(prefix[0])
+		if child == nil {
+			child = &node[T]{prefix: prefix}
+			child.insert(entry[T]{value: value, match: match, priority: priority})
+			n.addChild(child)
+			return
+		}
+		common := commonPrefix(prefix, child.prefix)
+		if common < len(child.prefix) {
+			// Split the child where the prefixes differ
+			split := &node[T]{prefix: child.prefix[:common]}
+			child.prefix = child.prefix[common:]
+			split.addChild(child)
+			n.replaceChild(split)
+			child = split
+		}
+		n = child
+		prefix = prefix[common:]
+	}
+}
+
+func (n *node[T]) insert(e entry[T]) {
+	i := len(n.entries)
+	for i > 0 && e.before(n.entries[i-1]) {
+		i--
+	}
+	n.entries = slices.Insert(n.entries, i, e)
+}
+
+// Longest returns the route of the longest prefix of path in the tree whose matcher accepts r.
+// If every route of a prefix rejects r, shorter prefixes are tried. r can be nil if no route has a matcher.
+func (t *Tree[T]) Longest(path string, r *http.Request) (T, bool) {
+	return t.root.longest(path, r)
+}
+
+func (n *node[T]) longest(path string, r *http.Request) (T, bool) {
+	if path != "" {
+		if child := n.child(path[0]); child != nil && strings.HasPrefix(path, child.prefix) {
+			if value, ok := child.longest(path[len(child.prefix):], r); ok {
+				return value, true
+			}
+		}
+	}
+	for _, e := range n.entries {
+		if e.match.Match(r) {
+			return e.value, true
+		}
+	}
+	var zero T
+	return zero, false
+}
+
+func (n *node[T]) child(b byte) *node[T] {
+	for i, c := range n.indices {
+		if c == b {
+			return n.children[i]
+		}
+	}
+	return nil
+}
+
+func (n *node[T]) addChild(child *node[T]) {
+	n.indices = append(n.indices, child.prefix[0])
+	n.children = append(n.children, child)
+}
+
+// replaceChild swaps the child starting with the same byte as child
+func (n *node[T]) replaceChild(child *node[T]) {
+	for i, c := range n.indices {
+		if c == child.prefix[0] {
+			n.children[i] = child
+			return
+		}
+	}
+}
+
+func commonPrefix(a string, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
@@ -0,0 +1,248 @@
+package router
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type route struct {
+	host   string
+	prefix string
+}
+
+// routes creates hosts*paths routes on port 80, every host has a root route and nested path prefixes
+func routes(hosts int, paths int) []route {
+	var rs []route
+	for h := range hosts {
+		host := fmt.Sprintf("svc-%d.example.com", h)
+		rs = append(rs, route{host, "/"})
+		for p := 1; p < paths; p++ {
+			rs = append(rs, route{host, fmt.Sprintf("/api/v%d/resource-%d", p%10, p)})
+		}
+	}
+	return rs
+}
+
+func buildTable(rs []route) *Table[*route] {
+	t := NewTable[*route]()
+	for i := range rs {
+		t.Add(80, rs[i].host, rs[i].prefix, &rs[i], nil, 0)
+	}
+	return t
+}
+
+// linearScan is the lookup the table replaces, comparing every route with the request
+func linearScan(rs []route, host string, path string) *route {
+	var found *route
+	longest := -1
+	for i := range rs {
+		if rs[i].host == host && strings.HasPrefix(path, rs[i].prefix) && len(rs[i].prefix) > longest {
+			found, longest = &rs[i], len(rs[i].prefix)
+		}
+	}
+	return found
+}
+
+func TestHostPrecedence(t *testing.T) {
+	tbl := NewTable[string]()
+	pattern, err := CompileHost(`(?P<tenant>[a-z]+)\.example\.com`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbl.AddRegex(80, pattern, "/", "regex", nil, 0)
+	tbl.Add(80, CatchAll, "/", "catch-all", nil, 0)
+	tbl.Add(80, "*.example.com", "/", "wildcard", nil, 0)
+	tbl.Add(80, "*.eu.example.com", "/", "nested wildcard", nil, 0)
+	tbl.Add(80, "api.example.com", "/", "exact", nil, 0)
+	tbl.Add(80, "api.example.com", "/v2", "exact v2", nil, 0)
+	tbl.Add(80, "*.example.com", "/admin", "wildcard admin", nil, 0)
+
+	tests := []struct {
+		host     string
+		path     string
+		want     string
+		captures Captures
+	}{
+		{"api.example.com", "/", "exact", nil},
+		{"API.Example.com", "/v2/items", "exact v2", nil},
+		// A longer prefix of a less specific host doesn't win over the exact host
+		{"api.example.com", "/admin", "exact", nil},
+		{"shop.example.com", "/", "wildcard", Captures{"1": "shop"}},
+		{"shop.example.com", "/admin/users", "wildcard admin", Captures{"1": "shop"}},
+		{"shop.eu.example.com", "/", "nested wildcard", Captures{"1": "shop"}},
+		{"a.b.example.com", "/", "wildcard", Captures{"1": "a.b"}},
+		{"other.com", "/", "catch-all", nil},
+		{"example.com", "/", "catch-all", nil},
+	}
+	for _, tt := range tests {
+		got, captures, ok := tbl.Lookup(80, tt.host, tt.path, nil)
+		if !ok || got != tt.want {
+			t.Errorf("%s%s: got %q, want %q", tt.host, tt.path, got, tt.want)
+			continue
+		}
+		if fmt.Sprint(captures) != fmt.Sprint(tt.captures) {
+			t.Errorf("%s%s: captured %v, want %v", tt.host, tt.path, captures, tt.captures)
+		}
+	}
+
+	// Regex hosts are tried after wildcards, so they only get the hosts no wildcard takes
+	tbl = NewTable[string]()
+	tbl.AddRegex(80, pattern, "/", "regex", nil, 0)
+	tbl.Add(80, CatchAll, "/", "catch-all", nil, 0)
+	tbl.Add(80, "*.shop.example.com", "/", "wildcard", nil, 0)
+	tbl.Add(80, "api.example.com", "/", "exact", nil, 0)
+	for host, want := range map[string]string{
+		"api.example.com":      "exact",
+		"eu.shop.example.com":  "wildcard",
+		"tenant.example.com":   "regex",
+		"tenant-1.example.com": "catch-all",
+		"api.example.com.evil": "catch-all",
+	} {
+		if got, _, _ := tbl.Lookup(80, host, "/", nil); got != want {
+			t.Errorf("%s: got %q, want %q", host, got, want)
+		}
+	}
+	if _, captures, _ := tbl.Lookup(80, "tenant.example.com", "/", nil); captures["tenant"] != "tenant" || captures["1"] != "tenant" {
+		t.Errorf("regex captured %v", captures)
+	}
+
+	// Other ports don't share routes
+	if _, _, ok := tbl.Lookup(8080, "api.example.com", "/", nil); ok {
+		t.Error("route found on a port without routes")
+	}
+}
+
+func TestMatcherPrecedence(t *testing.T) {
+	tbl := NewTable[string]()
+	add := func(prefix string, name string, priority int, methods []string, headers []Condition, query []Condition, cookies []Condition) {
+		t.Helper()
+		m, err := NewMatcher(methods, headers, query, cookies)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tbl.Add(80, "app.example.com", prefix, name, m, priority)
+	}
+	add("/", "default", 0, nil, nil, nil, nil)
+	add("/", "canary", 0, nil, []Condition{{Name: "X-Canary", Value: "1"}}, nil, nil)
+	add("/", "mobile", 0, nil, []Condition{{Name: "User-Agent", Regex: "Mobile"}}, nil, nil)
+	add("/", "debug", 0, nil, []Condition{{Name: "X-Debug"}}, nil, nil)
+	add("/", "beta", 0, nil, nil, []Condition{{Name: "beta", Value: "1"}}, nil)
+	add("/", "variant b", 0, nil, nil, nil, []Condition{{Name: "variant", Value: "b"}})
+	add("/", "writes", 0, []string{"post", "PUT"}, nil, nil, nil)
+	add("/", "beta canary", 0, nil, []Condition{{Name: "X-Canary", Value: "1"}}, []Condition{{Name: "beta", Value: "1"}}, nil)
+	add("/", "pinned", 5, nil, nil, nil, []Condition{{Name: "pin"}})
+	add("/api", "api writes", 0, []string{"POST"}, nil, nil, nil)
+
+	tests := []struct {
+		name    string
+		method  string
+		target  string
+		headers map[string]string
+		want    string
+	}{
+		{"no matchers match", "GET", "/", nil, "default"},
+		{"exact header", "GET", "/", map[string]string{"X-Canary": "1"}, "canary"},
+		{"exact header differs", "GET", "/", map[string]string{"X-Canary": "2"}, "default"},
+		{"regex header", "GET", "/", map[string]string{"User-Agent": "Foo Mobile Safari"}, "mobile"},
+		{"header presence", "GET", "/", map[string]string{"X-Debug": "yes"}, "debug"},
+		{"query", "GET", "/?beta=1", nil, "beta"},
+		{"query differs", "GET", "/?beta=0", nil, "default"},
+		{"cookie", "GET", "/", map[string]string{"Cookie": "theme=dark; variant=b"}, "variant b"},
+		{"cookie differs", "GET", "/", map[string]string{"Cookie": "variant=a"}, "default"},
+		{"method", "PUT", "/", nil, "writes"},
+		{"method differs", "DELETE", "/", nil, "default"},
+		{"more specific wins", "GET", "/?beta=1", map[string]string{"X-Canary": "1"}, "beta canary"},
+		{"same specificity in insertion order", "GET", "/", map[string]string{"X-Canary": "1", "X-Debug": "yes"}, "canary"},
+		{"priority before specificity", "GET", "/?beta=1", map[string]string{"X-Canary": "1", "Cookie": "pin=1"}, "pinned"},
+		{"longer prefix", "POST", "/api/items", nil, "api writes"},
+		{"shorter prefix when the longer rejects", "GET", "/api/items", nil, "default"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.target, nil)
+		for k, v := range tt.headers {
+			r.Header.Set(k, v)
+		}
+		if got, _, _ := tbl.Lookup(80, "app.example.com", r.URL.Path, r); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// requests picks paths below 100 routes spread over the table
+func requests(rs []route) []route {
+	var reqs []route
+	for i := 0; i < len(rs); i += len(rs)/100 + 1 {
+		reqs = append(reqs, route{rs[i].host, rs[i].prefix + "/items/42"})
+	}
+	return reqs
+}
+
+func benchmarkTable(b *testing.B, hosts int, paths int) {
+	rs := routes(hosts, paths)
+	t := buildTable(rs)
+	reqs := requests(rs)
+	// The table must find the same routes as the linear scan, including near misses
+	for _, req := range reqs {
+		for _, path := range []string{req.prefix, req.prefix[:len(req.prefix)/2], req.prefix + "x", ""} {
+			if got, _, _ := t.Lookup(80, req.host, path, nil); got != linearScan(rs, req.host, path) {
+				b.Fatalf("lookup of %s%s differs from the linear scan", req.host, path)
+			}
+		}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req := reqs[i%len(reqs)]
+		if got, _, _ := t.Lookup(80, req.host, req.prefix, nil); got == nil {
+			b.Fatalf("no route found for %s%s", req.host, req.prefix)
+		}
+	}
+}
+
+func benchmarkLinearScan(b *testing.B, hosts int, paths int) {
+	rs := routes(hosts, paths)
+	reqs := requests(rs)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req := reqs[i%len(reqs)]
+		if linearScan(rs, req.host, req.prefix) == nil {
+			b.Fatalf("no route found for %s%s", req.host, req.prefix)
+		}
+	}
+}
+
+func BenchmarkLookup10kHosts(b *testing.B)      { benchmarkTable(b, 10000, 1) }
+func BenchmarkLookup10kPaths(b *testing.B)      { benchmarkTable(b, 1, 10000) }
+func BenchmarkLookup10kRoutes(b *testing.B)     { benchmarkTable(b, 100, 100) }
+func BenchmarkLinearScan10kRoutes(b *testing.B) { benchmarkLinearScan(b, 100, 100) }
+
+// BenchmarkLookupWildcard10kHosts looks up subdomains of 10k wildcard hosts
+func BenchmarkLookupWildcard10kHosts(b *testing.B) {
+	t := NewTable[*route]()
+	rs := routes(10000, 1)
+	for i := range rs {
+		t.Add(80, "*."+rs[i].host, rs[i].prefix, &rs[i], nil, 0)
+	}
+	reqs := requests(rs)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req := reqs[i%len(reqs)]
+		if got, captures, _ := t.Lookup(80, "tenant."+req.host, req.prefix, nil); got == nil || captures["1"] != "tenant" {
+			b.Fatalf("no route found for tenant.%s%s", req.host, req.prefix)
+		}
+	}
+}
+
+func BenchmarkBuild10kRoutes(b *testing.B) {
+	rs := routes(100, 100)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buildTable(rs)
+	}
+}
@@ -0,0 +1,126 @@
+package secheaders
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/kunalvirwal/minato/internal/redirect"
+)
+
+// Presets a profile starts from
+const (
+	PresetBasic  = "basic"
+	PresetStrict = "strict"
+)
+
+// Off removes a header of the preset from a profile
+const Off = "off"
+
+// Headers a profile manages
+const (
+	HSTS                  = "Strict-Transport-Security"
+	ContentTypeOptions    = "X-Content-Type-Options"
+	FrameOptions          = "X-Frame-Options"
+	ReferrerPolicy        = "Referrer-Policy"
+	ContentSecurityPolicy = "Content-Security-Policy"
+)
+
+// Order the headers are set in
+var names = []string{HSTS, ContentTypeOptions, FrameOptions, ReferrerPolicy, ContentSecurityPolicy}
+
+var presets = map[string]map[string]string{
+	PresetBasic: {
+		HSTS:               "max-age=31536000",
+		ContentTypeOptions: "nosniff",
+		FrameOptions:       "SAMEORIGIN",
+		ReferrerPolicy:     "strict-origin-when-cross-origin",
+	},
+	PresetStrict: {
+		HSTS:                  "max-age=63072000; includeSubDomains",
+		ContentTypeOptions:    "nosniff",
+		FrameOptions:          "DENY",
+		ReferrerPolicy:        "no-referrer",
+		ContentSecurityPolicy: "default-src 'self'; object-src 'none'; base-uri 'self'; frame-ancestors 'none'",
+	},
+}
+
+// Profile is the set of security headers added to the responses of a service
+type Profile struct {
+	// Header values by canonical name
+	Headers map[string]string
+
+	// Replace the values set by the upstream instead of keeping them
+	Override bool
+}
+
+// ValidPreset reports if a preset exists, an empty preset starts from no headers
+func ValidPreset(name string) bool {
+	_, ok := presets[name]
+	return ok || name == ""
+}
+
+// New creates a profile from a preset with values set on top of it, a value of Off removes the header
+func New(preset string, values map[string]string, override bool) (*Profile, error) {
+	if !ValidPreset(preset) {
+		return nil, fmt.Errorf("invalid preset '%s', can use basic or strict", preset)
+	}
+	p := &Profile{Headers: make(map[string]string), Override: override}
+	for name, v := range presets[preset] {
+		p.Headers[name] = v
+	}
+	for name, v := range values {
+		name = http.CanonicalHeaderKey(name)
+		switch {
+		case v == "":
+			continue
+		case v == Off:
+			delete(p.Headers, name)
+			continue
+		case strings.ContainsAny(v, "\r\n"):
+			return nil, fmt.Errorf("invalid %s value '%s'", name, v)
+		}
+		if err := check(name, v); err != nil {
+			return nil, err
+		}
+		p.Headers[name] = v
+	}
+	return p, nil
+}
+
+// check rejects values browsers would ignore
+func check(name string, v string) error {
+	switch name {
+	case HSTS:
+		if !strings.HasPrefix(strings.ToLower(v), "max-age=") {
+			return fmt.Errorf("invalid %s value '%s', must start with max-age=", name, v)
+		}
+	case ContentTypeOptions:
+		if !strings.EqualFold(v, "nosniff") {
+			return fmt.Errorf("invalid %s value '%s', can only be nosniff", name, v)
+		}
+	case FrameOptions:
+		if !strings.EqualFold(v, "DENY") && !strings.EqualFold(v, "SAMEORIGIN") {
+			return fmt.Errorf("invalid %s value '%s', can use DENY or SAMEORIGIN", name, v)
+		}
+	}
+	return nil
+}
+
+// Apply adds the headers of the profile to a response. HSTS is only sent over https, where browsers honour it.
+func (p *Profile) Apply(h http.Header, r *http.Request) {
+	if p == nil {
+		return
+	}
+	secure := redirect.IsSecure(r)
+	for _, name := range names {
+		v, ok := p.Headers[name]
+		if !ok || (name == HSTS && !secure) {
+			continue
+		}
+		if !p.Override && h.Get(name) != "" {
+			continue
+		}
+		h.Set(name, v)
+	}
+}
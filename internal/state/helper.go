@@ -1,20 +1,64 @@
 package state
 
 import (
+	"errors"
+	"fmt"
 	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
 
+	"github.com/kunalvirwal/minato/internal/auth"
 	"github.com/kunalvirwal/minato/internal/backend"
 	"github.com/kunalvirwal/minato/internal/balancer"
 	"github.com/kunalvirwal/minato/internal/cache"
 	"github.com/kunalvirwal/minato/internal/config"
+	"github.com/kunalvirwal/minato/internal/cors"
+	"github.com/kunalvirwal/minato/internal/errorpage"
+	"github.com/kunalvirwal/minato/internal/ipfilter"
+	"github.com/kunalvirwal/minato/internal/mtls"
+	"github.com/kunalvirwal/minato/internal/oidc"
+	"github.com/kunalvirwal/minato/internal/proxy"
+	"github.com/kunalvirwal/minato/internal/ratelimit"
+	"github.com/kunalvirwal/minato/internal/redirect"
+	"github.com/kunalvirwal/minato/internal/requestid"
+	"github.com/kunalvirwal/minato/internal/router"
+	"github.com/kunalvirwal/minato/internal/secheaders"
+	"github.com/kunalvirwal/minato/internal/static"
+	"github.com/kunalvirwal/minato/internal/stream"
 	"github.com/kunalvirwal/minato/internal/utils"
+	"github.com/kunalvirwal/minato/internal/waf"
 )
 
+// GenerateRuntimeResources builds the runtime state of a config and swaps it in, returning the ports of its HTTP services.
+// The config is validated while loading it, so the builders don't handle the errors of compiling its patterns,
+// templates, networks and CA bundles again, those can only fail for a config which wasn't validated.
 func GenerateRuntimeResources(Cfg *config.Config) []uint64 {
 
 	// new config for replacement
 	var newConfig = ConfigHolder{
-		Router: make(map[RouteKey]balancer.LoadBalancer),
+		Router:          make(map[RouteKey]*Route),
+		Routes:          router.NewTable[*Route](),
+		Listeners:       make(map[uint64]config.Listener),
+		HealthCheck:     Cfg.HealthCheck,
+		ErrorPages:      buildErrorPages(Cfg.ErrorPages, nil),
+		Streams:         make(map[StreamKey]*stream.Route),
+		RequestID:       buildRequestID(Cfg.RequestID),
+		TrustedProxies:  buildTrie(Cfg.TrustedProxies),
+		ListenerFilters: make(map[uint64]*ipfilter.Filter),
+		Normalization:   Cfg.Normalization.Level,
+		WAF:             buildWAF(Cfg.WAF),
+		TLS:             make(map[uint64]*mtls.Listener),
+		Defaults:        make(map[uint64]*ListenerDefault),
+	}
+
+	// Routes of the services taking the requests of a listener which match no route, by path alone
+	defaultRoutes := make(map[string]*router.Tree[*Route])
+	for _, ln := range Cfg.Listeners {
+		if ln.Default.Service != "" {
+			defaultRoutes[ln.Default.Service] = &router.Tree[*Route]{}
+		}
 	}
 
 	// ports needed in the new config
@@ -22,52 +66,138 @@ func GenerateRuntimeResources(Cfg *config.Config) []uint64 {
 
 	// iterate over all services defined in config
 	for _, svc := range Cfg.Services {
-		// create backends for a service
-		var backends []*backend.Backend
-		for _, upstream := range svc.Upstreams {
-
-			parsed, _ := url.Parse(upstream.Host)
-
-			b := BackendKey{
-				Address:    parsed.Host + parsed.Path,
-				Health_uri: upstream.Health_uri,
+		// Stream services are served by their own servers instead of HTTP listeners
+		if svc.Type == config.ServiceStream {
+			lb := balancer.CreateLoadBalancer(svc.Name, svc.Balancer, svc.Port, buildBackends(svc))
+			if lb == nil {
+				utils.LogNewError("Invalid balancing algorythm, nil load balancer recieved")
+				return newPorts
 			}
-
-			RuntimeCfg.Mu.Lock()
-			if existingBackend, exists := RuntimeCfg.BackendRegistry[b]; exists {
-				// Reuse existing backend state
-				backends = append(backends, existingBackend)
-
-			} else {
-				// Create a new backend
-				backend := backend.CreateBackend(upstream.Host, upstream.Health_uri, nil)
-				backends = append(backends, backend)
-				RuntimeCfg.BackendRegistry[b] = backend
+			key := StreamKey{Protocol: svc.Stream.Protocol, Port: uint64(svc.Port)}
+			newConfig.Streams[key] = &stream.Route{
+				Service:        svc.Name,
+				LB:             lb,
+				ConnectTimeout: svc.Stream.ConnectTimeout,
+				IdleTimeout:    svc.Stream.IdleTimeout,
 			}
-			RuntimeCfg.Mu.Unlock()
+			continue
 		}
 
 		// The ports needed in the latest config
 		newPorts = append(newPorts, uint64(svc.Port))
+		newConfig.Listeners[uint64(svc.Port)] = config.DefaultListener(svc.Port)
 
-		// create loadbalancer for this service
-		lb := balancer.CreateLoadBalancer(svc.Name, svc.Balancer, svc.Port, backends)
-		if lb == nil {
-			utils.LogNewError("Invalid balancing algorythm, nil load balancer recieved")
-			return newPorts
+		// create loadbalancer for this service, redirect and static services don't proxy requests.
+		// Upstreams with keys get a loadbalancer per key, the others serve every other request.
+		var lb balancer.LoadBalancer
+		var keyedLBs map[string]balancer.LoadBalancer
+		if svc.Type == config.ServiceProxy {
+			backends := buildBackends(svc)
+			if defaults := backendsForKey(svc, backends, ""); len(defaults) > 0 {
+				lb = balancer.CreateLoadBalancer(svc.Name, svc.Balancer, svc.Port, defaults)
+				if lb == nil {
+					utils.LogNewError("Invalid balancing algorythm, nil load balancer recieved")
+					return newPorts
+				}
+			}
+			keyedLBs = buildKeyedLoadBalancers(svc, backends)
+		}
+		redirects := buildRedirector(svc.Redirects)
+		staticServer := buildStaticServer(svc)
+		errorPages := buildErrorPages(svc.ErrorPages, newConfig.ErrorPages)
+		svcLimiter := buildRateLimiter(svc.Name, svc.RateLimit)
+		svcFilter := buildIPFilter(svc.IPFilter)
+		svcAuth := buildAuth(svc.Auth)
+		svcForwardAuth := buildForwardAuth(svc.ForwardAuth)
+		svcOIDC := buildOIDC(svc.OIDC)
+		svcClientCert := buildClientCert(svc.ClientCert)
+		wafMode := Cfg.WAF.Mode
+		if svc.WAFMode != "" {
+			wafMode = svc.WAFMode
 		}
 
 		// Add the created loadbalancer to the state struct
-		for _, link := range svc.Hosts {
-			parsed, _ := url.Parse(link)
+		for _, host := range svc.Hosts {
+			parsed, _ := url.Parse(host.URL)
+			limiter := svcLimiter
+			if host.RateLimit.Requests > 0 {
+				limiter = buildRateLimiter(svc.Name+"|"+host.URL, host.RateLimit)
+			}
+			policy := svcAuth
+			if host.Auth.Enabled() {
+				policy = buildAuth(host.Auth)
+			}
+			forwardAuth := svcForwardAuth
+			if host.ForwardAuth.URL != "" {
+				forwardAuth = buildForwardAuth(host.ForwardAuth)
+			}
+			relyingParty := svcOIDC
+			if host.OIDC.Issuer != "" {
+				relyingParty = buildOIDC(host.OIDC)
+			}
+			clientCert := svcClientCert
+			if host.ClientCert.Enabled() {
+				clientCert = buildClientCert(host.ClientCert)
+			}
 			route := RouteKey{
-				Domain:     parsed.Host,
+				Domain:     strings.ToLower(parsed.Host),
 				PathPrefix: parsed.Path,
 				Port:       uint64(svc.Port),
+				Match:      host.Match.Key(),
+			}
+			rt := &Route{
+				Service:     svc.Name,
+				LB:          lb,
+				KeyedLBs:    keyedLBs,
+				UpstreamKey: svc.UpstreamKey,
+				Options:     buildRouteOptions(svc, host, parsed.Path, errorPages),
+				Redirects:   redirects,
+				Static:      staticServer,
+				RateLimit:   limiter,
+				IPFilters:   buildIPFilters(svcFilter, buildIPFilter(host.IPFilter)),
+				Auth:        policy,
+				ForwardAuth: forwardAuth,
+				OIDC:        relyingParty,
+				WAFMode:     wafMode,
+				ClientCert:  clientCert,
+				ForceHTTPS:  svc.ForceHTTPS,
+				HTTPSPort:   svc.HTTPSPort,
+				MatchKey:    route.Match,
+			}
+			matcher, _ := host.Match.Matcher()
+			if host.HostRegex != "" {
+				route.Domain = "regex:" + host.HostRegex
+				pattern, _ := router.CompileHost(host.HostRegex)
+				newConfig.Routes.AddRegex(route.Port, pattern, route.PathPrefix, rt, matcher, host.Match.Priority)
+			} else {
+				newConfig.Routes.Add(route.Port, route.Domain, route.PathPrefix, rt, matcher, host.Match.Priority)
+			}
+			newConfig.Router[route] = rt
+			if tree := defaultRoutes[svc.Name]; tree != nil {
+				tree.Insert(route.PathPrefix, rt, matcher, host.Match.Priority)
+			}
+		}
+	}
+	// Overlay the configured listener settings on the defaults
+	for _, ln := range Cfg.Listeners {
+		newConfig.Listeners[uint64(ln.Port)] = ln
+		if filter := buildIPFilter(ln.IPFilter); filter != nil {
+			newConfig.ListenerFilters[uint64(ln.Port)] = filter
+		}
+		if tlsListener := buildTLSListener(ln.TLS); tlsListener != nil {
+			newConfig.TLS[uint64(ln.Port)] = tlsListener
+		}
+		if ln.Default.Service != "" {
+			newConfig.Defaults[uint64(ln.Port)] = &ListenerDefault{Routes: defaultRoutes[ln.Default.Service]}
+		} else if ln.Default.Status != 0 {
+			newConfig.Defaults[uint64(ln.Port)] = &ListenerDefault{
+				Status:      ln.Default.Status,
+				Body:        ln.Default.Body,
+				ContentType: ln.Default.ContentType,
 			}
-			newConfig.Router[route] = lb
 		}
 	}
+
 	// Create cache
 	if Cfg.Cache.Enabled {
 		Cache := cache.CreateCache(Cfg.Cache.Type, Cfg.Cache.Capacity, Cfg.Cache.MaxSize, Cfg.Cache.TTL)
@@ -81,6 +211,481 @@ func GenerateRuntimeResources(Cfg *config.Config) []uint64 {
 	return newPorts
 }
 
+// buildBackends returns the backends of a service, reusing the registered backend of an upstream if one exists
+func buildBackends(svc config.Service) []*backend.Backend {
+	var backends []*backend.Backend
+	for _, upstream := range svc.Upstreams {
+
+		parsed, _ := url.Parse(upstream.Host)
+
+		b := BackendKey{
+			Address:    parsed.Host + parsed.Path,
+			Health_uri: upstream.Health_uri,
+		}
+		if svc.Type == config.ServiceStream {
+			b.Protocol = svc.Stream.Protocol
+		}
+
+		RuntimeCfg.Mu.Lock()
+		if existingBackend, exists := RuntimeCfg.BackendRegistry[b]; exists {
+			// Reuse existing backend state
+			backends = append(backends, existingBackend)
+
+		} else {
+			// Create a new backend, stream upstreams are only dialed and need no HTTP proxy
+			var created *backend.Backend
+			if svc.Type == config.ServiceStream {
+				created = backend.CreateStreamBackend(upstream.Host, nil)
+			} else {
+				created = backend.CreateBackend(upstream.Host, upstream.Health_uri, nil)
+			}
+			backends = append(backends, created)
+			RuntimeCfg.BackendRegistry[b] = created
+		}
+		RuntimeCfg.Mu.Unlock()
+	}
+
+	return backends
+}
+
+// backendsForKey returns the backends of the upstreams having key, or of the upstreams without keys for an empty key.
+// Backends are in the order of the service's upstreams.
+func backendsForKey(svc config.Service, backends []*backend.Backend, key string) []*backend.Backend {
+	var selected []*backend.Backend
+	for i, upstream := range svc.Upstreams {
+		if (key == "" && len(upstream.Keys) == 0) || slices.Contains(upstream.Keys, key) {
+			selected = append(selected, backends[i])
+		}
+	}
+	return selected
+}
+
+// buildKeyedLoadBalancers creates a loadbalancer for every key of the service's upstreams, returns nil if they have none
+func buildKeyedLoadBalancers(svc config.Service, backends []*backend.Backend) map[string]balancer.LoadBalancer {
+	var lbs map[string]balancer.LoadBalancer
+	for _, upstream := range svc.Upstreams {
+		for _, key := range upstream.Keys {
+			if _, ok := lbs[key]; ok {
+				continue
+			}
+			if lbs == nil {
+				lbs = make(map[string]balancer.LoadBalancer)
+			}
+			lbs[key] = balancer.CreateLoadBalancer(svc.Name, svc.Balancer, svc.Port, backendsForKey(svc, backends, key))
+		}
+	}
+	return lbs
+}
+
+// buildTrie builds a prefix trie of IPs and CIDRs
+func buildTrie(entries []string) *ipfilter.Trie {
+	networks, _ := ipfilter.ParseNetworks(entries)
+	return ipfilter.NewTrie(networks)
+}
+
+// buildIPFilter loads the lists of an IP filter, returns nil if both are empty.
+// Lists are validated while loading the config, so a file only fails to load if it changed since.
+// A filter which can't be loaded denies everyone rather than letting everyone through.
+func buildIPFilter(f config.IPFilter) *ipfilter.Filter {
+	allow, allowErr := ipfilter.LoadList(f.Allow, f.AllowFile)
+	deny, denyErr := ipfilter.LoadList(f.Deny, f.DenyFile)
+	if err := errors.Join(allowErr, denyErr); err != nil {
+		utils.LogNewError("Unable to load ip_filter, denying all clients: " + err.Error())
+		return &ipfilter.Filter{Deny: buildTrie([]string{"0.0.0.0/0", "::/0"})}
+	}
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil
+	}
+	return &ipfilter.Filter{
+		Allow: ipfilter.NewTrie(allow),
+		Deny:  ipfilter.NewTrie(deny),
+	}
+}
+
+// buildIPFilters lists the IP filters a route's clients must pass, skipping the levels without one
+func buildIPFilters(filters ...*ipfilter.Filter) []*ipfilter.Filter {
+	var list []*ipfilter.Filter
+	for _, f := range filters {
+		if f != nil {
+			list = append(list, f)
+		}
+	}
+	return list
+}
+
+// buildAuth loads the credentials of an auth policy, returns nil if no method is configured.
+// Credential files are validated while loading the config, so they only fail to load if they changed since.
+// A method which can't be loaded rejects every request rather than letting them through.
+func buildAuth(a config.Auth) *auth.Policy {
+	if !a.Enabled() {
+		return nil
+	}
+	policy := &auth.Policy{
+		UserHeader: a.UserHeader,
+		AllowCache: a.AllowCache,
+	}
+	var err error
+	if a.Basic.Htpasswd != "" {
+		if policy.Basic, err = auth.LoadHtpasswd(a.Basic.Htpasswd, a.Basic.Realm); err != nil {
+			utils.LogNewError("Unable to load htpasswd file, rejecting its users: " + err.Error())
+			policy.Basic = &auth.Basic{Realm: a.Basic.Realm}
+		}
+	}
+	if a.APIKey.File != "" {
+		if policy.APIKeys, err = auth.LoadAPIKeys(a.APIKey.File, a.APIKey.Header); err != nil {
+			utils.LogNewError("Unable to load api key file, rejecting its keys: " + err.Error())
+			policy.APIKeys = &auth.APIKeys{Header: a.APIKey.Header}
+		}
+	}
+
+	jwt := a.JWT
+	if jwt.JWKSFile != "" || jwt.JWKSURL != "" {
+		policy.JWT = &auth.JWT{
+			Issuer:         jwt.Issuer,
+			Audience:       jwt.Audience,
+			RequiredClaims: jwt.RequiredClaims,
+			ForwardClaims:  jwt.ForwardClaims,
+			Leeway:         jwt.Leeway,
+		}
+		if jwt.JWKSURL != "" {
+			policy.JWT.Keys = auth.NewRemoteJWKS(jwt.JWKSURL)
+		} else if policy.JWT.Keys, err = auth.LoadJWKSFile(jwt.JWKSFile); err != nil {
+			utils.LogNewError("Unable to load jwks file, rejecting all tokens: " + err.Error())
+			policy.JWT.Keys = &auth.JWKS{}
+		}
+	}
+	return policy
+}
+
+// buildForwardAuth creates the forward auth middleware, returns nil if no URL is configured
+func buildForwardAuth(f config.ForwardAuth) *auth.ForwardAuth {
+	if f.URL == "" {
+		return nil
+	}
+	return auth.NewForwardAuth(&auth.ForwardAuth{
+		URL:             f.URL,
+		RequestHeaders:  f.RequestHeaders,
+		ResponseHeaders: f.ResponseHeaders,
+		Timeout:         f.Timeout,
+		CacheTTL:        f.CacheTTL,
+		AllowCache:      f.AllowCache,
+	})
+}
+
+// buildOIDC creates the OIDC relying party, returns nil if no issuer is configured
+func buildOIDC(o config.OIDC) *oidc.RelyingParty {
+	if o.Issuer == "" {
+		return nil
+	}
+	return oidc.New(&oidc.RelyingParty{
+		Issuer:                o.Issuer,
+		ClientID:              o.ClientID,
+		ClientSecret:          o.ClientSecret,
+		Scopes:                o.Scopes,
+		RedirectURL:           o.RedirectURL,
+		CookieName:            o.CookieName,
+		SessionLifetime:       o.SessionLifetime,
+		LogoutPath:            o.LogoutPath,
+		PostLogoutRedirectURL: o.PostLogoutRedirectURL,
+		AllowedGroups:         o.AllowedGroups,
+		GroupsClaim:           o.GroupsClaim,
+		ForwardClaims:         o.ForwardClaims,
+		AllowCache:            o.AllowCache,
+	}, o.CookieSecret)
+}
+
+// buildTLSListener loads the certificate and client CAs of a listener, returns nil if it serves plain http
+func buildTLSListener(t config.TLS) *mtls.Listener {
+	if !t.Enabled() {
+		return nil
+	}
+	clientAuth, _ := mtls.LoadClientAuth(t.ClientAuth.Mode, t.ClientAuth.CAFile, t.ClientAuth.CRLFile)
+	hosts := make(map[string]*mtls.ClientAuth)
+	for _, host := range t.Hosts {
+		hostAuth, _ := mtls.LoadClientAuth(host.ClientAuth.Mode, host.ClientAuth.CAFile, host.ClientAuth.CRLFile)
+		for _, name := range host.Names {
+			hosts[name] = hostAuth
+		}
+	}
+	l, err := mtls.NewListener(t.CertFile, t.KeyFile, clientAuth, hosts)
+	if err != nil {
+		utils.LogNewError("Unable to load TLS certificate: " + err.Error())
+		return nil
+	}
+	return l
+}
+
+// buildClientCert creates the client certificate policy, returns nil if certificates aren't checked or forwarded
+func buildClientCert(c config.ClientCert) *mtls.Policy {
+	if !c.Enabled() {
+		return nil
+	}
+	policy, _ := mtls.NewPolicy(c.AllowedSubjects, c.AllowedSANs, mtls.Headers{
+		Subject:     c.Headers.Subject,
+		SANs:        c.Headers.SANs,
+		Fingerprint: c.Headers.Fingerprint,
+		PEM:         c.Headers.PEM,
+	}, c.AllowCache)
+	return policy
+}
+
+// buildRateLimiter returns the limiter of a scope, reusing the registered limiter if the rule is unchanged
+func buildRateLimiter(scope string, rl config.RateLimit) *ratelimit.Limiter {
+	if rl.Requests == 0 {
+		return nil
+	}
+	key := RateLimitKey{
+		Scope: scope,
+		Rule: ratelimit.Rule{
+			Requests: rl.Requests,
+			Period:   rl.Period,
+			Burst:    rl.Burst,
+			Key:      rl.Key,
+		},
+	}
+
+	RuntimeCfg.Mu.Lock()
+	defer RuntimeCfg.Mu.Unlock()
+	if limiter, exists := RuntimeCfg.RateLimiters[key]; exists {
+		return limiter
+	}
+	limiter := ratelimit.New(key.Rule)
+	RuntimeCfg.RateLimiters[key] = limiter
+	return limiter
+}
+
+// buildWAF loads the WAF rules and attaches the limiters of rate_limit rules, returns nil without a rules file.
+// The rules are validated while loading the config, so the file only fails to load if it changed since.
+// Unlike an IP filter the WAF then lets requests through, as blocking everyone would take every service down.
+func buildWAF(w config.WAF) *waf.Engine {
+	if w.RulesFile == "" {
+		return nil
+	}
+	rules, err := waf.LoadRules(w.RulesFile)
+	if err != nil {
+		utils.LogNewError("Unable to load WAF rules, requests are not inspected: " + err.Error())
+		return nil
+	}
+	for _, rule := range rules {
+		if rule.Action != waf.ActionRateLimit {
+			continue
+		}
+		rule.Limiter = buildRateLimiter("waf|"+rule.ID, config.RateLimit{
+			Requests: rule.RateLimit.Requests,
+			Period:   rule.RateLimit.Period,
+			Burst:    rule.RateLimit.Burst,
+			Key:      rule.RateLimit.Key,
+		})
+	}
+	return waf.New(rules, w.BodyLimit, w.TagHeader)
+}
+
+// buildRedirector compiles the redirect rules of a service, returns nil if there are none
+func buildRedirector(redirects []config.Redirect) *redirect.Redirector {
+	if len(redirects) == 0 {
+		return nil
+	}
+	rd := &redirect.Redirector{}
+	for _, r := range redirects {
+		rule := redirect.Rule{
+			To:        r.To,
+			Status:    r.Status,
+			DropQuery: r.DropQuery,
+		}
+		if r.Match != "" {
+			rule.Match = regexp.MustCompile(r.Match)
+		}
+		rd.Rules = append(rd.Rules, rule)
+	}
+	return rd
+}
+
+// buildRequestID creates the request ID generator
+func buildRequestID(rid config.RequestID) *requestid.Generator {
+	return &requestid.Generator{
+		Header:  rid.Header,
+		Format:  rid.Format,
+		Trusted: buildTrie(rid.Trusted),
+	}
+}
+
+// buildStaticServer returns the file server of a static service, nil for other services
+func buildStaticServer(svc config.Service) *static.Server {
+	if svc.Type != config.ServiceStatic {
+		return nil
+	}
+	return &static.Server{
+		Root:     svc.Static.Root,
+		Index:    svc.Static.Index,
+		Listing:  svc.Static.Listing,
+		SPA:      svc.Static.SPA,
+		Dotfiles: svc.Static.Dotfiles,
+	}
+}
+
+// buildRouteOptions creates the proxy options for a service host
+func buildRouteOptions(svc config.Service, host config.Route, pathPrefix string, errorPages *errorpage.Pages) *proxy.Options {
+	var rules []proxy.RewriteRule
+	for _, rule := range host.Rewrite {
+		rules = append(rules, proxy.RewriteRule{
+			Match:   regexp.MustCompile(rule.Match),
+			Replace: rule.Replace,
+		})
+	}
+
+	return &proxy.Options{
+		Route:           host.Name,
+		Service:         svc.Name,
+		Headers:         buildHeaderRules(svc.Headers, host.Headers),
+		Timeouts:        buildTimeouts(svc.Timeouts, host.Timeouts),
+		Compression:     buildCompression(svc.Compression),
+		Body:            buildBodyLimits(svc.RequestBody, host.RequestBody),
+		ErrorPages:      errorPages,
+		InterceptErrors: svc.InterceptErrors,
+		CORS:            buildCORS(svc.CORS, host.CORS),
+		Security:        buildSecurityHeaders(svc.SecurityHeaders),
+		Rewriter:        proxy.NewPathRewriter(pathPrefix, host.StripPrefix, host.AddPrefix, rules),
+	}
+}
+
+// buildCORS returns the CORS policy of a route, its own policy replaces the service's.
+// Returns nil if neither has one.
+func buildCORS(svcCORS config.CORS, routeCORS config.CORS) *cors.Policy {
+	c := svcCORS
+	if len(routeCORS.AllowedOrigins) != 0 {
+		c = routeCORS
+	}
+	if len(c.AllowedOrigins) == 0 {
+		return nil
+	}
+	policy, _ := cors.New(c.AllowedOrigins, c.AllowedMethods, c.AllowedHeaders, c.ExposedHeaders, c.AllowCredentials, c.MaxAge)
+	return policy
+}
+
+// buildSecurityHeaders returns the security header profile of a service, nil if it has none
+func buildSecurityHeaders(sh config.SecurityHeaders) *secheaders.Profile {
+	if !sh.Enabled() {
+		return nil
+	}
+	profile, _ := secheaders.New(sh.Preset, sh.Values(), sh.Override)
+	return profile
+}
+
+// buildHeaderRules merges the service and route header rules, service rules are applied first.
+// Returns nil if there are no rules.
+func buildHeaderRules(svcRules config.HeaderRules, routeRules config.HeaderRules) *proxy.HeaderRules {
+	convert := func(rules ...[]config.HeaderRule) []proxy.HeaderRule {
+		var out []proxy.HeaderRule
+		for _, list := range rules {
+			for _, rule := range list {
+				value, _ := proxy.ParseTemplate(rule.Value)
+				out = append(out, proxy.HeaderRule{
+					Action: rule.Action,
+					Name:   rule.Name,
+					Value:  value,
+					To:     rule.To,
+				})
+			}
+		}
+		return out
+	}
+
+	hr := &proxy.HeaderRules{
+		Request:  convert(svcRules.Request, routeRules.Request),
+		Response: convert(svcRules.Response, routeRules.Response),
+	}
+	if len(hr.Request) == 0 && len(hr.Response) == 0 {
+		return nil
+	}
+	return hr
+}
+
+// buildErrorPages loads the error pages of a scope, scopes without pages share their parent's pages
+func buildErrorPages(pages map[string]config.ErrorPage, parent *errorpage.Pages) *errorpage.Pages {
+	if len(pages) == 0 {
+		return parent
+	}
+	ep := &errorpage.Pages{
+		Pages:  make(map[string]*errorpage.Page),
+		Parent: parent,
+	}
+	for key, page := range pages {
+		loaded, err := errorpage.LoadPage(page.HTML, page.JSON)
+		if err != nil {
+			// Templates are validated while loading the config, so this only happens if a file changed since
+			utils.LogNewError(fmt.Sprintf("Unable to load error page for %v: %v", key, err))
+			continue
+		}
+		ep.Pages[key] = loaded
+	}
+	return ep
+}
+
+// buildCompression returns the compression settings of a service, nil if compression is disabled
+func buildCompression(c config.Compression) *proxy.Compression {
+	if !c.Enabled {
+		return nil
+	}
+	return &proxy.Compression{
+		Encodings: c.Encodings,
+		Types:     c.Types,
+		MinSize:   c.MinSize,
+		Level:     c.Level,
+	}
+}
+
+// buildBodyLimits overlays the route body limits on the service ones, returns nil if bodies are unrestricted
+func buildBodyLimits(svcBody config.RequestBody, routeBody config.RequestBody) *proxy.BodyLimits {
+	limits := proxy.BodyLimits{
+		MaxSize:      svcBody.MaxSize,
+		BufferMemory: svcBody.BufferMemory,
+	}
+	if svcBody.Buffer != nil {
+		limits.Buffer = *svcBody.Buffer
+	}
+	if routeBody.MaxSize != 0 {
+		limits.MaxSize = routeBody.MaxSize
+	}
+	if routeBody.BufferMemory != 0 {
+		limits.BufferMemory = routeBody.BufferMemory
+	}
+	if routeBody.Buffer != nil {
+		limits.Buffer = *routeBody.Buffer
+	}
+
+	if limits.MaxSize == 0 && !limits.Buffer {
+		return nil
+	}
+	if limits.BufferMemory == 0 {
+		limits.BufferMemory = proxy.DefaultBufferMemory
+	}
+	if limits.Buffer && limits.MaxSize == 0 {
+		limits.MaxSize = proxy.DefaultBufferMaxSize
+	}
+	return &limits
+}
+
+// buildTimeouts overlays the route timeouts on the service timeouts, returns nil if none are set
+func buildTimeouts(svcTimeouts config.Timeouts, routeTimeouts config.Timeouts) *proxy.Timeouts {
+	pick := func(svc, route time.Duration) time.Duration {
+		if route != 0 {
+			return route
+		}
+		return svc
+	}
+	t := proxy.Timeouts{
+		Connect:        pick(svcTimeouts.Connect, routeTimeouts.Connect),
+		TLSHandshake:   pick(svcTimeouts.TLSHandshake, routeTimeouts.TLSHandshake),
+		ResponseHeader: pick(svcTimeouts.ResponseHeader, routeTimeouts.ResponseHeader),
+		Request:        pick(svcTimeouts.Request, routeTimeouts.Request),
+		Idle:           pick(svcTimeouts.Idle, routeTimeouts.Idle),
+	}
+	if t == (proxy.Timeouts{}) {
+		return nil
+	}
+	return &t
+}
+
 // Atomically swaps the config
 func CommitConfig(cfg *ConfigHolder) {
 	RuntimeCfg.Config.Store(cfg)
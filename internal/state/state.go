@@ -1,13 +1,29 @@
 package state
 
 import (
+	"io"
 	"net/http"
+	"strconv"
 	"sync"
 	"sync/atomic"
 
+	"github.com/kunalvirwal/minato/internal/auth"
 	"github.com/kunalvirwal/minato/internal/backend"
 	"github.com/kunalvirwal/minato/internal/balancer"
 	"github.com/kunalvirwal/minato/internal/cache"
+	"github.com/kunalvirwal/minato/internal/config"
+	"github.com/kunalvirwal/minato/internal/errorpage"
+	"github.com/kunalvirwal/minato/internal/ipfilter"
+	"github.com/kunalvirwal/minato/internal/mtls"
+	"github.com/kunalvirwal/minato/internal/oidc"
+	"github.com/kunalvirwal/minato/internal/proxy"
+	"github.com/kunalvirwal/minato/internal/ratelimit"
+	"github.com/kunalvirwal/minato/internal/redirect"
+	"github.com/kunalvirwal/minato/internal/requestid"
+	"github.com/kunalvirwal/minato/internal/router"
+	"github.com/kunalvirwal/minato/internal/static"
+	"github.com/kunalvirwal/minato/internal/stream"
+	"github.com/kunalvirwal/minato/internal/waf"
 )
 
 // [TODO] create mutable []backend registry that persists across config reloads
@@ -16,8 +32,13 @@ var RuntimeCfg MinatoCfg = MinatoCfg{
 	Config: atomic.Pointer[ConfigHolder]{},
 	Lm: ListenerManager{
 		Listeners: make(map[uint64]*http.Server),
+		Settings:  make(map[uint64]config.Listener),
 	},
 	BackendRegistry: make(map[BackendKey]*backend.Backend),
+	RateLimiters:    make(map[RateLimitKey]*ratelimit.Limiter),
+	Sm: StreamManager{
+		Servers: make(map[StreamKey]*stream.Server),
+	},
 }
 
 // MinatoCfg is a structure to hold the current runtime config
@@ -29,10 +50,16 @@ type MinatoCfg struct {
 	// Keeps track of all HTTP servers running
 	Lm ListenerManager
 
+	// Keeps track of all stream servers running
+	Sm StreamManager
+
 	// Keeps track of backend states across config reloads
 	BackendRegistry map[BackendKey]*backend.Backend
 
-	// RWMutex to protect BackendRegistry
+	// Keeps the client buckets of unchanged rate limits across config reloads
+	RateLimiters map[RateLimitKey]*ratelimit.Limiter
+
+	// RWMutex to protect BackendRegistry and RateLimiters
 	Mu sync.RWMutex
 }
 
@@ -40,8 +67,132 @@ type MinatoCfg struct {
 // This is needed because we can have multiple services which
 // only differ by host path and not the domain.
 type ConfigHolder struct {
-	Router map[RouteKey]balancer.LoadBalancer
+	Router map[RouteKey]*Route
 	Cache  cache.Cache
+
+	// The routes of Router indexed by port, host and path prefix for lookups
+	Routes *router.Table[*Route]
+
+	// Settings of the HTTP server running on each port
+	Listeners map[uint64]config.Listener
+
+	HealthCheck config.HealthCheck
+
+	// Error pages for requests which don't match any route
+	ErrorPages *errorpage.Pages
+
+	// Stream services by the protocol and port they listen on
+	Streams map[StreamKey]*stream.Route
+
+	// Assigns the ID of every HTTP request
+	RequestID *requestid.Generator
+
+	// Proxies trusted to report the client IP in X-Forwarded-For
+	TrustedProxies *ipfilter.Trie
+
+	// IP filters of the listeners which have one, checked before routing
+	ListenerFilters map[uint64]*ipfilter.Filter
+
+	// How strictly requests are checked before routing, off, normal or strict
+	Normalization string
+
+	// Rule engine checking the requests of every route, nil without a rules file
+	WAF *waf.Engine
+
+	// TLS settings of the listeners serving https, looked up on every handshake
+	TLS map[uint64]*mtls.Listener
+
+	// Handle the requests of the listeners which have one when no route matches
+	Defaults map[uint64]*ListenerDefault
+}
+
+// ListenerDefault handles the requests of a listener which match no route
+type ListenerDefault struct {
+	// Routes of the default service by path prefix alone, nil for a fixed response
+	Routes *router.Tree[*Route]
+
+	Status      int
+	Body        string
+	ContentType string
+}
+
+// Route returns the route of the default service for a request, nil if there is none
+func (d *ListenerDefault) Route(r *http.Request) *Route {
+	if d == nil || d.Routes == nil {
+		return nil
+	}
+	route, _ := d.Routes.Longest(r.URL.Path, r)
+	return route
+}
+
+// Write sends the fixed response, reports false if the listener has none
+func (d *ListenerDefault) Write(w http.ResponseWriter) bool {
+	if d == nil || d.Status == 0 {
+		return false
+	}
+	w.Header().Set("Content-Type", d.ContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(d.Body)))
+	w.WriteHeader(d.Status)
+	io.WriteString(w, d.Body)
+	return true
+}
+
+// Route is the runtime form of a service host, it binds the service's loadbalancer
+// with the options specific to this host
+type Route struct {
+	Service string
+
+	// nil for services which don't proxy requests, or whose upstreams all have keys
+	LB      balancer.LoadBalancer
+	Options *proxy.Options
+
+	// Loadbalancers of the upstreams having a key, picked by the host capture named by UpstreamKey
+	KeyedLBs    map[string]balancer.LoadBalancer
+	UpstreamKey string
+
+	// Redirect rules checked before the request is proxied
+	Redirects *redirect.Redirector
+
+	// Serves files for static services, nil otherwise
+	Static *static.Server
+
+	// nil if requests to this route are not rate limited
+	RateLimit *ratelimit.Limiter
+
+	// IP filters of the service and the route, a client must pass all of them
+	IPFilters []*ipfilter.Filter
+
+	// nil if requests to this route don't need to authenticate
+	Auth *auth.Policy
+
+	// Authorization service asked before proxying, nil if there is none
+	ForwardAuth *auth.ForwardAuth
+
+	// OpenID Connect login of browser users, nil if there is none
+	OIDC *oidc.RelyingParty
+
+	// Whether the WAF blocks, only logs or skips requests to this route
+	WAFMode string
+
+	// Client certificates allowed on this route, nil if they aren't checked
+	ClientCert *mtls.Policy
+
+	ForceHTTPS bool
+	HTTPSPort  int
+
+	// Matchers of the route in their canonical form, keeping its cached responses apart from routes of the same URL
+	MatchKey string
+}
+
+// LoadBalancer returns the loadbalancer of the upstreams serving a request with the given host captures,
+// nil if no upstream serves it
+func (rt *Route) LoadBalancer(captures map[string]string) balancer.LoadBalancer {
+	if rt.UpstreamKey != "" {
+		if lb, ok := rt.KeyedLBs[captures[rt.UpstreamKey]]; ok {
+			return lb
+		}
+	}
+	return rt.LB
 }
 
 // The combination of a URL and port uniquely identifies a loadbalancer
@@ -49,16 +200,44 @@ type RouteKey struct {
 	Domain     string
 	PathPrefix string
 	Port       uint64
+
+	// Matchers of the route in their canonical form, empty if it has none
+	Match string
 }
 
 // The combination of a URL and health check URI uniquely identifies a backend
 type BackendKey struct {
 	Address    string // Stores "host:port/path"
 	Health_uri string
+
+	// tcp or udp for upstreams of stream services, empty for HTTP upstreams
+	Protocol string
+}
+
+// The scope a rate limit applies to and its rule uniquely identify a limiter
+type RateLimitKey struct {
+	// Service name, followed by the route URL for route level limits
+	Scope string
+	Rule  ratelimit.Rule
+}
+
+// The combination of a protocol and port uniquely identifies a stream service
+type StreamKey struct {
+	Protocol string
+	Port     uint64
 }
 
 // Keeps a track of port to http.Server mapping
 type ListenerManager struct {
 	Listeners map[uint64]*http.Server
-	Mu        sync.Mutex
+
+	// Settings each running server was created with, to detect changes on reload
+	Settings map[uint64]config.Listener
+	Mu       sync.Mutex
+}
+
+// Keeps a track of the running stream servers
+type StreamManager struct {
+	Servers map[StreamKey]*stream.Server
+	Mu      sync.Mutex
 }
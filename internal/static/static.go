@@ -0,0 +1,291 @@
+package static
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/kunalvirwal/minato/internal/proxy"
+	"github.com/kunalvirwal/minato/internal/utils"
+)
+
+// DefaultIndex is the index file served for directories when none are configured
+const DefaultIndex = "index.html"
+
+// Precompressed sidecar files in the order of preference, keyed by their Content-Encoding
+var sidecars = []struct {
+	encoding string
+	ext      string
+}{
+	{proxy.EncodingBrotli, ".br"},
+	{proxy.EncodingGzip, ".gz"},
+}
+
+// Server serves files of a local directory for the routes of a static service
+type Server struct {
+	// Directory the request paths are resolved against
+	Root string
+
+	// Files served for a directory, the first existing one wins
+	Index []string
+
+	// List the contents of directories without an index file
+	Listing bool
+
+	// Serve the root index file for missing paths without a file extension
+	SPA bool
+
+	// Serve files and directories whose name starts with a dot, like .env or .git
+	Dotfiles bool
+}
+
+// errOutsideRoot is returned for paths which resolve to a file outside the root through a symlink
+var errOutsideRoot = fmt.Errorf("path leaves the root: %w", fs.ErrNotExist)
+
+// ServeHTTP serves the file for the request path after the route's path rewrites are applied.
+// Errors are written with the error pages of the route attached to the request.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		proxy.WriteError(w, r, http.StatusMethodNotAllowed, "Method Not Allowed")
+		return
+	}
+
+	reqPath := r.URL.Path
+	if opts := proxy.OptionsFromRequest(r); opts != nil && opts.Rewriter != nil {
+		reqPath = opts.Rewriter.RewritePath(reqPath)
+	}
+	// Cleaning a rooted path removes every .. so it can't leave the root
+	name := path.Clean("/" + reqPath)
+	if !s.Dotfiles && hasDotSegment(name) {
+		proxy.WriteError(w, r, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	info, err := s.stat(name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) && s.SPA && path.Ext(name) == "" {
+			s.serveSPA(w, r)
+			return
+		}
+		s.writeStatError(w, r, err)
+		return
+	}
+
+	if !info.IsDir() {
+		s.serveFile(w, r, name, info)
+		return
+	}
+
+	// Directories are served with a trailing slash so relative links resolve inside them
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		target := r.URL.Path + "/"
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+		return
+	}
+
+	for _, index := range s.Index {
+		indexName := path.Join(name, index)
+		if indexInfo, err := s.stat(indexName); err == nil && !indexInfo.IsDir() {
+			s.serveFile(w, r, indexName, indexInfo)
+			return
+		}
+	}
+
+	if !s.Listing {
+		proxy.WriteError(w, r, http.StatusForbidden, "Forbidden")
+		return
+	}
+	s.serveListing(w, r, name)
+}
+
+// fullPath maps a cleaned, rooted request path to a path on disk with its symlinks resolved.
+// Paths whose symlinks lead out of the root don't exist as far as clients are concerned.
+func (s *Server) fullPath(name string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(filepath.Join(s.Root, filepath.FromSlash(name)))
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(s.Root, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errOutsideRoot
+	}
+	return resolved, nil
+}
+
+// stat returns the file info of a request path
+func (s *Server) stat(name string) (fs.FileInfo, error) {
+	full, err := s.fullPath(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(full)
+}
+
+// hasDotSegment reports if any segment of a cleaned request path starts with a dot
+func hasDotSegment(name string) bool {
+	for _, segment := range strings.Split(name, "/") {
+		if strings.HasPrefix(segment, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// serveSPA serves the root index file in place of a missing path
+func (s *Server) serveSPA(w http.ResponseWriter, r *http.Request) {
+	for _, index := range s.Index {
+		indexName := "/" + index
+		if info, err := s.stat(indexName); err == nil && !info.IsDir() {
+			s.serveFile(w, r, indexName, info)
+			return
+		}
+	}
+	proxy.WriteError(w, r, http.StatusNotFound, "Not Found")
+}
+
+// serveFile serves a regular file, preferring a precompressed sidecar the client accepts.
+// http.ServeContent handles ranges and the conditional request headers.
+func (s *Server) serveFile(w http.ResponseWriter, r *http.Request, name string, info fs.FileInfo) {
+	contentType := mime.TypeByExtension(path.Ext(name))
+
+	servedPath, err := s.fullPath(name)
+	if err != nil {
+		s.writeStatError(w, r, err)
+		return
+	}
+	servedInfo := info
+	encoding := ""
+	for _, sc := range sidecars {
+		scPath, err := s.fullPath(name + sc.ext)
+		if err != nil {
+			continue
+		}
+		scInfo, err := os.Stat(scPath)
+		if err != nil || scInfo.IsDir() {
+			continue
+		}
+		// The response differs by Accept-Encoding as soon as a sidecar exists
+		proxy.AddVary(w.Header(), "Accept-Encoding")
+		if encoding == "" && accepts(r, sc.encoding) {
+			encoding = sc.encoding
+			servedPath = scPath
+			servedInfo = scInfo
+		}
+	}
+	if encoding != "" {
+		w.Header().Set("Content-Encoding", encoding)
+		// Sniffing the compressed bytes would give a wrong type
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+	}
+
+	f, err := os.Open(servedPath)
+	if err != nil {
+		w.Header().Del("Content-Encoding")
+		s.writeStatError(w, r, err)
+		return
+	}
+	defer f.Close()
+
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	// The ETag changes with the file and differs between the sidecars and the original
+	w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, servedInfo.ModTime().UnixNano(), servedInfo.Size()))
+	http.ServeContent(w, r, name, servedInfo.ModTime(), f)
+}
+
+// accepts reports if the client accepts the content encoding
+func accepts(r *http.Request, encoding string) bool {
+	c := proxy.Compression{Encodings: []string{encoding}}
+	return c.Negotiate(r.Header.Get("Accept-Encoding")) != ""
+}
+
+var listingTemplate = template.Must(template.New("listing").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Index of {{.Path}}</title></head>
+<body>
+<h1>Index of {{.Path}}</h1>
+<ul>
+{{- if ne .Path "/"}}
+<li><a href="../">../</a></li>
+{{- end}}
+{{- range .Entries}}
+<li><a href="{{.Href}}">{{.Name}}</a></li>
+{{- end}}
+</ul>
+</body>
+</html>
+`))
+
+type listingEntry struct {
+	Name string
+	Href string
+}
+
+// serveListing writes an HTML listing of a directory, subdirectories first
+func (s *Server) serveListing(w http.ResponseWriter, r *http.Request, name string) {
+	full, err := s.fullPath(name)
+	if err != nil {
+		s.writeStatError(w, r, err)
+		return
+	}
+	entries, err := os.ReadDir(full)
+	if err != nil {
+		s.writeStatError(w, r, err)
+		return
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].IsDir() && !entries[j].IsDir()
+	})
+
+	data := struct {
+		Path    string
+		Entries []listingEntry
+	}{Path: r.URL.Path}
+	for _, entry := range entries {
+		entryName := entry.Name()
+		if !s.Dotfiles && strings.HasPrefix(entryName, ".") {
+			continue
+		}
+		if entry.IsDir() {
+			entryName += "/"
+		}
+		// The ./ keeps names containing a colon from being read as a scheme
+		href := "./" + (&url.URL{Path: entryName}).EscapedPath()
+		data.Entries = append(data.Entries, listingEntry{Name: entryName, Href: href})
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := listingTemplate.Execute(w, data); err != nil {
+		utils.LogRequestError(r, "Error writing directory listing: "+err.Error())
+	}
+}
+
+// writeStatError maps a file system error to an error response
+func (s *Server) writeStatError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, fs.ErrNotExist), errors.Is(err, syscall.ENOTDIR):
+		proxy.WriteError(w, r, http.StatusNotFound, "Not Found")
+	case errors.Is(err, fs.ErrPermission):
+		proxy.WriteError(w, r, http.StatusForbidden, "Forbidden")
+	default:
+		utils.LogRequestError(r, "Error serving static file: "+err.Error())
+		proxy.WriteError(w, r, http.StatusInternalServerError, "Internal Server Error")
+	}
+}
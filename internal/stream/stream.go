@@ -0,0 +1,338 @@
+package stream
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kunalvirwal/minato/internal/backend"
+	"github.com/kunalvirwal/minato/internal/balancer"
+	"github.com/kunalvirwal/minato/internal/utils"
+)
+
+// Stream protocols
+const (
+	TCP = "tcp"
+	UDP = "udp"
+)
+
+// Default stream settings
+const (
+	DefaultConnectTimeout = 5 * time.Second
+	DefaultUDPIdleTimeout = 30 * time.Second
+)
+
+// Largest UDP payload
+const maxDatagramSize = 64 * 1024
+
+// Route is the runtime form of a stream service
+type Route struct {
+	Service string
+	LB      balancer.LoadBalancer
+
+	// Time allowed to connect to an upstream
+	ConnectTimeout time.Duration
+
+	// Time a connection or UDP session is kept open without traffic, 0 never closes idle TCP connections
+	IdleTimeout time.Duration
+}
+
+// Server forwards the connections or datagrams received on a port to the upstreams of its route.
+// The route is looked up for every new connection so config reloads apply without restarting the server.
+type Server struct {
+	Protocol string
+	Port     uint64
+
+	// Returns the route of this server from the latest config, nil once it is removed
+	Lookup func() *Route
+
+	mu       sync.Mutex
+	closed   bool
+	ln       net.Listener
+	pc       net.PacketConn
+	sessions map[string]*udpSession
+}
+
+// NewServer creates a stream server, it doesn't bind the port until Listen is called
+func NewServer(protocol string, port uint64, lookup func() *Route) *Server {
+	return &Server{
+		Protocol: protocol,
+		Port:     port,
+		Lookup:   lookup,
+		sessions: make(map[string]*udpSession),
+	}
+}
+
+// Listen binds the port of the server
+func (s *Server) Listen() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return net.ErrClosed
+	}
+
+	addr := fmt.Sprintf(":%d", s.Port)
+	var err error
+	if s.Protocol == UDP {
+		s.pc, err = net.ListenPacket("udp", addr)
+	} else {
+		s.ln, err = net.Listen("tcp", addr)
+	}
+	return err
+}
+
+// Serve forwards traffic until the server is closed, Listen must have succeeded before
+func (s *Server) Serve() error {
+	if s.Protocol == UDP {
+		return s.serveUDP()
+	}
+	return s.serveTCP()
+}
+
+// Close stops accepting traffic and ends the UDP sessions.
+// Established TCP connections are kept open until either side closes them.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	if s.ln != nil {
+		s.ln.Close()
+	}
+	if s.pc != nil {
+		s.pc.Close()
+	}
+	for _, sess := range s.sessions {
+		sess.upstream.Close()
+	}
+	return nil
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+func (s *Server) serveTCP() error {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return nil
+			}
+			// Errors like running out of file descriptors are temporary, like in net/http
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go s.handleTCP(conn)
+	}
+}
+
+// handleTCP connects a client to the next healthy upstream and copies data both ways
+func (s *Server) handleTCP(client net.Conn) {
+	defer client.Close()
+
+	route := s.Lookup()
+	if route == nil {
+		return
+	}
+	b := route.LB.GetNextBackend()
+	if b == nil {
+		utils.LogNewError(fmt.Sprintf("Connection Dropped %v: No healthy servers available", route.Service))
+		return
+	}
+	b.IncrementConnections()
+	defer b.DecrementConnections()
+
+	upstream, err := net.DialTimeout("tcp", b.Config.URL.Host, route.ConnectTimeout)
+	if err != nil {
+		utils.LogNewError(fmt.Sprintf("Connection to upstream %v failed: %v", b.Address(), err))
+		return
+	}
+	defer upstream.Close()
+
+	utils.LogInfo(fmt.Sprintf("Connection forwarded to: %v", b.Address()))
+	pipe(client, upstream, route.IdleTimeout)
+}
+
+// pipe copies data between two connections until both directions are done
+func pipe(a net.Conn, b net.Conn, idle time.Duration) {
+	var last atomic.Int64
+	last.Store(time.Now().UnixNano())
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		copyHalf(b, a, idle, &last)
+	}()
+	go func() {
+		defer wg.Done()
+		copyHalf(a, b, idle, &last)
+	}()
+	wg.Wait()
+}
+
+// copyHalf copies src to dst and passes the end of the stream on, so the other direction can still finish
+func copyHalf(dst net.Conn, src net.Conn, idle time.Duration, last *atomic.Int64) {
+	var reader io.Reader = src
+	if idle > 0 {
+		reader = &idleConn{Conn: src, idle: idle, last: last}
+	}
+
+	_, err := io.Copy(dst, reader)
+	if err != nil {
+		// Resets and idle timeouts end both directions
+		dst.Close()
+		src.Close()
+		return
+	}
+	if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	} else {
+		dst.Close()
+	}
+}
+
+// idleConn fails reads once neither direction of a connection had traffic for the idle timeout
+type idleConn struct {
+	net.Conn
+	idle time.Duration
+	last *atomic.Int64
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	for {
+		c.Conn.SetReadDeadline(time.Now().Add(c.idle))
+		n, err := c.Conn.Read(p)
+		if n > 0 {
+			c.last.Store(time.Now().UnixNano())
+		}
+
+		// The other direction was active, so the connection isn't idle yet
+		var ne net.Error
+		if n == 0 && errors.As(err, &ne) && ne.Timeout() && time.Since(time.Unix(0, c.last.Load())) < c.idle {
+			continue
+		}
+		return n, err
+	}
+}
+
+// udpSession forwards the datagrams of one client address to the upstream picked for it
+type udpSession struct {
+	client   net.Addr
+	upstream net.Conn
+	backend  *backend.Backend
+	last     atomic.Int64
+}
+
+func (s *Server) serveUDP() error {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := s.pc.ReadFrom(buf)
+		if err != nil {
+			if s.isClosed() {
+				return nil
+			}
+			return err
+		}
+
+		sess := s.session(addr)
+		if sess == nil {
+			continue
+		}
+		sess.last.Store(time.Now().UnixNano())
+		if _, err := sess.upstream.Write(buf[:n]); err != nil {
+			utils.LogNewError(fmt.Sprintf("Datagram to upstream %v failed: %v", sess.backend.Address(), err))
+		}
+	}
+}
+
+// session returns the session of a client address, creating it on the first datagram.
+// Sessions are only created by the serveUDP goroutine.
+func (s *Server) session(addr net.Addr) *udpSession {
+	key := addr.String()
+	s.mu.Lock()
+	sess, ok := s.sessions[key]
+	s.mu.Unlock()
+	if ok {
+		return sess
+	}
+
+	route := s.Lookup()
+	if route == nil {
+		return nil
+	}
+	b := route.LB.GetNextBackend()
+	if b == nil {
+		utils.LogNewError(fmt.Sprintf("Datagram Dropped %v: No healthy servers available", route.Service))
+		return nil
+	}
+	upstream, err := net.DialTimeout("udp", b.Config.URL.Host, route.ConnectTimeout)
+	if err != nil {
+		utils.LogNewError(fmt.Sprintf("Connection to upstream %v failed: %v", b.Address(), err))
+		return nil
+	}
+
+	sess = &udpSession{client: addr, upstream: upstream, backend: b}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		upstream.Close()
+		return nil
+	}
+	s.sessions[key] = sess
+	s.mu.Unlock()
+
+	b.IncrementConnections()
+	utils.LogInfo(fmt.Sprintf("UDP session of %v forwarded to: %v", key, b.Address()))
+	go s.reply(sess, route.IdleTimeout)
+	return sess
+}
+
+// reply sends the upstream's datagrams back to the client until the session is idle or closed
+func (s *Server) reply(sess *udpSession, idle time.Duration) {
+	defer s.endSession(sess)
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		sess.upstream.SetReadDeadline(time.Now().Add(idle))
+		n, err := sess.upstream.Read(buf)
+		if err != nil {
+			// Datagrams from the client keep the session alive too
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() && time.Since(time.Unix(0, sess.last.Load())) < idle {
+				continue
+			}
+			return
+		}
+		sess.last.Store(time.Now().UnixNano())
+		if _, err := s.pc.WriteTo(buf[:n], sess.client); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) endSession(sess *udpSession) {
+	s.mu.Lock()
+	key := sess.client.String()
+	if s.sessions[key] == sess {
+		delete(s.sessions, key)
+	}
+	s.mu.Unlock()
+
+	sess.upstream.Close()
+	sess.backend.DecrementConnections()
+}
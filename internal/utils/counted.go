@@ -0,0 +1,86 @@
+package utils
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Keys counted per interval, the rest are only summed up
+const maxCountedKeys = 100
+
+// Keys listed in a single log line
+const maxLoggedKeys = 10
+
+// CountedLog aggregates frequent events, like requests for unknown hosts, into one error line per interval
+// listing the most frequent keys with how often they occurred
+type CountedLog struct {
+	Interval time.Duration
+
+	// Describes the events, like "Requests for hosts without a route"
+	Title string
+
+	mu     sync.Mutex
+	counts map[string]int
+	others int
+}
+
+// NewCountedLog creates a log writing at most one line per interval
+func NewCountedLog(interval time.Duration, title string) *CountedLog {
+	return &CountedLog{Interval: interval, Title: title}
+}
+
+// Add counts an event, the first event of an interval schedules the log line
+func (l *CountedLog) Add(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.counts == nil {
+		l.counts = make(map[string]int)
+		time.AfterFunc(l.Interval, l.flush)
+	}
+	if _, ok := l.counts[key]; ok || len(l.counts) < maxCountedKeys {
+		l.counts[key]++
+	} else {
+		l.others++
+	}
+}
+
+// flush logs the events of the interval and starts a new one
+func (l *CountedLog) flush() {
+	l.mu.Lock()
+	counts, others := l.counts, l.others
+	l.counts, l.others = nil, 0
+	l.mu.Unlock()
+
+	keys := make([]string, 0, len(counts))
+	total := others
+	for key, n := range counts {
+		keys = append(keys, key)
+		total += n
+	}
+	slices.SortFunc(keys, func(a, b string) int {
+		if counts[a] != counts[b] {
+			return counts[b] - counts[a]
+		}
+		return strings.Compare(a, b)
+	})
+
+	var parts []string
+	for _, key := range keys[:min(len(keys), maxLoggedKeys)] {
+		parts = append(parts, fmt.Sprintf("%s (%d)", key, counts[key]))
+	}
+	if rest := total - sumCounts(counts, keys[:len(parts)]); rest > 0 {
+		parts = append(parts, fmt.Sprintf("%d more", rest))
+	}
+	LogNewError(fmt.Sprintf("%s in the last %v (%d): %s", l.Title, l.Interval, total, strings.Join(parts, ", ")))
+}
+
+func sumCounts(counts map[string]int, keys []string) int {
+	sum := 0
+	for _, key := range keys {
+		sum += counts[key]
+	}
+	return sum
+}
@@ -2,7 +2,10 @@ package utils
 
 import (
 	"fmt"
+	"net/http"
 	"time"
+
+	"github.com/kunalvirwal/minato/internal/requestid"
 )
 
 const (
@@ -64,3 +67,25 @@ func LogInfo(msg string) {
 func LogCustom(color string, context string, msg string) {
 	fmt.Println(getTime(), color+"["+context+"]"+Reset+White+": "+msg+Reset)
 }
+
+// requestTag prefixes the log lines of a request with its request ID
+func requestTag(r *http.Request) string {
+	if id, ok := requestid.FromRequest(r); ok {
+		return "[" + id.Value + "] "
+	}
+	return ""
+}
+
+// Logs a custom error message of a request
+func LogRequestError(r *http.Request, msg string) {
+	out(ErrorTAG, requestTag(r)+msg)
+}
+
+// Logs a debug/info message of a request
+func LogRequestInfo(r *http.Request, msg string) {
+	out(InfoTAG, requestTag(r)+msg)
+}
+
+func LogRequestCustom(r *http.Request, color string, context string, msg string) {
+	LogCustom(color, context, requestTag(r)+msg)
+}
@@ -0,0 +1,208 @@
+package waf
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/kunalvirwal/minato/internal/ratelimit"
+	"gopkg.in/yaml.v3"
+)
+
+// Rule actions
+const (
+	ActionBlock     = "block"
+	ActionLog       = "log"
+	ActionTag       = "tag"
+	ActionRateLimit = "rate_limit"
+)
+
+// Fields a condition can inspect, headers are written as header:<name>
+const (
+	FieldMethod    = "method"
+	FieldPath      = "path"
+	FieldURI       = "uri"
+	FieldQuery     = "query"
+	FieldUserAgent = "user_agent"
+	FieldBody      = "body"
+	FieldHeader    = "header"
+)
+
+// ruleFile is the format of a rules file
+type ruleFile struct {
+	Rules []ruleConfig `yaml:"rules"`
+}
+
+type ruleConfig struct {
+	ID          string            `yaml:"id"`
+	Description string            `yaml:"description"`
+	Conditions  []conditionConfig `yaml:"conditions"`
+	Action      string            `yaml:"action"`
+
+	// Status of blocked requests, defaults to 403 for block and 429 for rate_limit
+	Status int `yaml:"status"`
+
+	// Tag added to the request by the tag action
+	Tag string `yaml:"tag"`
+
+	RateLimit rateLimitConfig `yaml:"rate_limit"`
+}
+
+// conditionConfig matches a field with exactly one of the matchers
+type conditionConfig struct {
+	Field    string `yaml:"field"`
+	Regex    string `yaml:"regex"`
+	Equals   string `yaml:"equals"`
+	Prefix   string `yaml:"prefix"`
+	Contains string `yaml:"contains"`
+
+	// Literal matchers ignore case
+	IgnoreCase bool `yaml:"ignore_case"`
+
+	// The condition holds when the matcher does not match
+	Negate bool `yaml:"negate"`
+}
+
+type rateLimitConfig struct {
+	Requests int           `yaml:"requests"`
+	Period   time.Duration `yaml:"period"`
+	Burst    int           `yaml:"burst"`
+	Key      string        `yaml:"key"`
+}
+
+// LoadRules parses and validates a rules file. Limiters of rate_limit rules are left for the caller to attach.
+func LoadRules(file string) ([]*Rule, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var rf ruleFile
+	if err := yaml.Unmarshal(data, &rf); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+
+	ids := make(map[string]bool)
+	var rules []*Rule
+	for i, rc := range rf.Rules {
+		rule, err := parseRule(rc)
+		if err != nil {
+			return nil, fmt.Errorf("%s: rule[%d]: %v", file, i, err)
+		}
+		if ids[rule.ID] {
+			return nil, fmt.Errorf("%s: duplicate rule id '%s'", file, rule.ID)
+		}
+		ids[rule.ID] = true
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func parseRule(rc ruleConfig) (*Rule, error) {
+	if rc.ID == "" {
+		return nil, errors.New("rule has no id")
+	}
+	if len(rc.Conditions) == 0 {
+		return nil, fmt.Errorf("rule '%s' has no conditions", rc.ID)
+	}
+	rule := &Rule{ID: rc.ID, Description: rc.Description, Action: rc.Action, Status: rc.Status, Tag: rc.Tag}
+
+	switch rc.Action {
+	case ActionBlock:
+		if rule.Status == 0 {
+			rule.Status = http.StatusForbidden
+		}
+	case ActionRateLimit:
+		if rule.Status == 0 {
+			rule.Status = http.StatusTooManyRequests
+		}
+		rl := rc.RateLimit
+		if rl.Requests <= 0 || rl.Period < 0 || rl.Burst < 0 {
+			return nil, fmt.Errorf("rule '%s' needs a positive rate_limit requests", rc.ID)
+		}
+		if rl.Period == 0 {
+			rl.Period = time.Second
+		}
+		if rl.Burst == 0 {
+			rl.Burst = rl.Requests
+		}
+		if rl.Key == "" {
+			rl.Key = ratelimit.KeyIP
+		}
+		if !ratelimit.ValidKey(rl.Key) {
+			return nil, fmt.Errorf("rule '%s' has invalid rate_limit key '%s'", rc.ID, rl.Key)
+		}
+		// Rules run before any token is verified
+		if strings.HasPrefix(rl.Key, ratelimit.KeyClaim+":") {
+			return nil, fmt.Errorf("rule '%s' can't key its rate_limit by a claim, can use ip or header:<name>", rc.ID)
+		}
+		rule.RateLimit = ratelimit.Rule{Requests: rl.Requests, Period: rl.Period, Burst: rl.Burst, Key: rl.Key}
+	case ActionLog:
+	case ActionTag:
+		if rule.Tag == "" || strings.ContainsAny(rule.Tag, ",\r\n") {
+			return nil, fmt.Errorf("rule '%s' needs a tag without commas", rc.ID)
+		}
+	default:
+		return nil, fmt.Errorf("rule '%s' has invalid action '%s', can use block, log, tag or rate_limit", rc.ID, rc.Action)
+	}
+	if (rc.Action == ActionBlock || rc.Action == ActionRateLimit) && (rule.Status < 400 || rule.Status > 599) {
+		return nil, fmt.Errorf("rule '%s' has invalid status %d, must be 4xx or 5xx", rc.ID, rule.Status)
+	}
+
+	for k, cc := range rc.Conditions {
+		cond, err := parseCondition(cc)
+		if err != nil {
+			return nil, fmt.Errorf("rule '%s' condition[%d]: %v", rc.ID, k, err)
+		}
+		rule.conditions = append(rule.conditions, cond)
+	}
+	return rule, nil
+}
+
+func parseCondition(cc conditionConfig) (*condition, error) {
+	c := &condition{negate: cc.Negate, ignoreCase: cc.IgnoreCase}
+
+	kind, name, _ := strings.Cut(cc.Field, ":")
+	switch kind {
+	case FieldMethod, FieldPath, FieldURI, FieldQuery, FieldUserAgent, FieldBody:
+		c.field = kind
+	case FieldHeader:
+		if name == "" {
+			return nil, errors.New("header field needs a name like header:Referer")
+		}
+		c.field, c.header = kind, http.CanonicalHeaderKey(name)
+	default:
+		return nil, fmt.Errorf("invalid field '%s', can use method, path, uri, query, user_agent, body or header:<name>", cc.Field)
+	}
+
+	set := 0
+	for _, m := range []string{cc.Regex, cc.Equals, cc.Prefix, cc.Contains} {
+		if m != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return nil, errors.New("needs exactly one of regex, equals, prefix or contains")
+	}
+	switch {
+	case cc.Regex != "":
+		re, err := regexp.Compile(cc.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex: %v", err)
+		}
+		c.regex = re
+	case cc.Equals != "":
+		c.op, c.literal = opEquals, cc.Equals
+	case cc.Prefix != "":
+		c.op, c.literal = opPrefix, cc.Prefix
+	default:
+		c.op, c.literal = opContains, cc.Contains
+	}
+	if c.ignoreCase {
+		c.literal = strings.ToLower(c.literal)
+	}
+	return c, nil
+}
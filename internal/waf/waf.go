@@ -0,0 +1,223 @@
+package waf
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/kunalvirwal/minato/internal/ratelimit"
+	"github.com/kunalvirwal/minato/internal/utils"
+)
+
+// Modes of the engine, a service can override the global mode
+const (
+	ModeBlock  = "block"
+	ModeDetect = "detect"
+	ModeOff    = "off"
+)
+
+// Defaults of optional settings
+const (
+	DefaultBodyLimit = 8 << 10
+	DefaultTagHeader = "X-WAF-Tags"
+)
+
+// Literal matchers
+const (
+	opEquals = iota
+	opPrefix
+	opContains
+)
+
+// Rule takes its action on requests matching all of its conditions
+type Rule struct {
+	ID          string
+	Description string
+	Action      string
+
+	// Status of requests blocked or limited by the rule
+	Status int
+	Tag    string
+
+	// Limit of rate_limit rules, the limiter is attached once the rule is built
+	RateLimit ratelimit.Rule
+	Limiter   *ratelimit.Limiter
+
+	conditions []*condition
+}
+
+type condition struct {
+	field  string
+	header string
+
+	regex   *regexp.Regexp
+	op      int
+	literal string
+
+	ignoreCase bool
+	negate     bool
+}
+
+// Engine evaluates the rules on every request of the services using it
+type Engine struct {
+	Rules []*Rule
+
+	// Bytes of the request body inspected by body conditions
+	BodyLimit int64
+
+	// Header carrying the tags of a request upstream
+	TagHeader string
+
+	needsBody bool
+}
+
+// New creates an engine, bodies are only read if a rule inspects them
+func New(rules []*Rule, bodyLimit int64, tagHeader string) *Engine {
+	e := &Engine{Rules: rules, BodyLimit: bodyLimit, TagHeader: tagHeader}
+	for _, rule := range rules {
+		for _, c := range rule.conditions {
+			if c.field == FieldBody {
+				e.needsBody = true
+			}
+		}
+	}
+	return e
+}
+
+// Evaluate runs the rules on a request and returns the rule blocking it, nil if the request may pass.
+// Matches are logged, and tags are set on the request for the upstream. In detect mode nothing is blocked,
+// the rules which would have blocked are only logged.
+func (e *Engine) Evaluate(r *http.Request, detect bool) *Rule {
+	// Clients can't tag their own requests
+	r.Header.Del(e.TagHeader)
+
+	in := &inspector{r: r}
+	if e.needsBody {
+		in.body = e.readBody(r)
+	}
+
+	var tags []string
+	for _, rule := range e.Rules {
+		if !rule.matches(in) {
+			continue
+		}
+		switch rule.Action {
+		case ActionLog:
+			e.log(r, rule, "matched")
+		case ActionTag:
+			e.log(r, rule, "tagged the request as "+rule.Tag)
+			tags = append(tags, rule.Tag)
+		case ActionBlock, ActionRateLimit:
+			if rule.Action == ActionRateLimit && rule.Limiter.Take(r).Allowed {
+				continue
+			}
+			if detect {
+				e.log(r, rule, fmt.Sprintf("would block the request with %d", rule.Status))
+				continue
+			}
+			e.log(r, rule, fmt.Sprintf("blocked the request with %d", rule.Status))
+			return rule
+		}
+	}
+	if len(tags) > 0 {
+		r.Header.Set(e.TagHeader, strings.Join(tags, ","))
+	}
+	return nil
+}
+
+func (e *Engine) log(r *http.Request, rule *Rule, what string) {
+	utils.LogRequestCustom(r, utils.Magenta, "WAF", fmt.Sprintf("Rule %v %v: %v %v", rule.ID, what, r.Method, r.URL.RequestURI()))
+}
+
+// readBody reads the inspected prefix of the body and puts it back in front of the rest
+func (e *Engine) readBody(r *http.Request) []byte {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil
+	}
+	prefix, _ := io.ReadAll(io.LimitReader(r.Body, e.BodyLimit))
+	r.Body = readCloser{io.MultiReader(bytes.NewReader(prefix), r.Body), r.Body}
+	return prefix
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// inspector reads the fields of a request for the conditions, decoding the query once
+type inspector struct {
+	r     *http.Request
+	body  []byte
+	query *string
+}
+
+func (in *inspector) values(c *condition) []string {
+	r := in.r
+	switch c.field {
+	case FieldMethod:
+		return []string{r.Method}
+	case FieldPath:
+		return []string{r.URL.Path}
+	case FieldURI:
+		return []string{r.RequestURI}
+	case FieldQuery:
+		if in.query == nil {
+			q, err := url.QueryUnescape(r.URL.RawQuery)
+			if err != nil {
+				q = r.URL.RawQuery
+			}
+			in.query = &q
+		}
+		return []string{*in.query}
+	case FieldUserAgent:
+		return []string{r.UserAgent()}
+	case FieldBody:
+		return []string{string(in.body)}
+	case FieldHeader:
+		return r.Header.Values(c.header)
+	}
+	return nil
+}
+
+// matches reports if all conditions of the rule hold
+func (rule *Rule) matches(in *inspector) bool {
+	for _, c := range rule.conditions {
+		if !c.holds(in.values(c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// holds reports if any value matches, or none does for negated conditions
+func (c *condition) holds(values []string) bool {
+	matched := false
+	for _, v := range values {
+		if c.match(v) {
+			matched = true
+			break
+		}
+	}
+	return matched != c.negate
+}
+
+func (c *condition) match(v string) bool {
+	if c.regex != nil {
+		return c.regex.MatchString(v)
+	}
+	if c.ignoreCase {
+		v = strings.ToLower(v)
+	}
+	switch c.op {
+	case opEquals:
+		return v == c.literal
+	case opPrefix:
+		return strings.HasPrefix(v, c.literal)
+	default:
+		return strings.Contains(v, c.literal)
+	}
+}